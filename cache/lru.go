@@ -4,6 +4,7 @@ package cache
 import (
 	"container/list"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 )
@@ -23,6 +24,7 @@ type entry struct {
 	hit       int
 	createdAt time.Time
 	ttl       time.Duration
+	part      *partition
 }
 
 func (e *entry) expiredAt() time.Time {
@@ -39,11 +41,21 @@ type Item struct {
 	TTL time.Duration
 }
 
-type LRU struct {
+// partition has its own capacity, entries only evict entries of the same
+// partition.
+type partition struct {
+	name     string
 	capacity int
 	deque    *list.List
-	items    map[interface{}]*list.Element
-	lock     *sync.Mutex
+}
+
+type LRU struct {
+	def   *partition
+	parts map[string]*partition
+	items map[interface{}]*list.Element
+	lock  *sync.Mutex
+	// expired entries are kept for maxStale, see GetStale
+	maxStale time.Duration
 }
 
 func NewLRU(capacity int) (*LRU, error) {
@@ -51,24 +63,81 @@ func NewLRU(capacity int) (*LRU, error) {
 		return nil, errors.New("LRU capacity must > 0")
 	}
 	return &LRU{
-		capacity: capacity,
-		deque:    list.New(),
-		items:    make(map[interface{}]*list.Element),
-		lock:     new(sync.Mutex),
+		def:   &partition{capacity: capacity, deque: list.New()},
+		parts: make(map[string]*partition),
+		items: make(map[interface{}]*list.Element),
+		lock:  new(sync.Mutex),
 	}, nil
 }
 
+// SetCapacity change capacity of default partition
+func (c *LRU) SetCapacity(capacity int) error {
+	if capacity <= 0 {
+		return errors.New("LRU capacity must > 0")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.def.capacity = capacity
+	c.shrink(c.def)
+	return nil
+}
+
+// SetPartition create partition name with capacity, or change its capacity,
+// entries added by AddTo(name, ...) are limited by it instead of capacity
+// of the whole cache.
+func (c *LRU) SetPartition(name string, capacity int) error {
+	if capacity <= 0 {
+		return errors.New("LRU capacity must > 0")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p, ok := c.parts[name]
+	if !ok {
+		p = &partition{name: name, deque: list.New()}
+		c.parts[name] = p
+	}
+	p.capacity = capacity
+	c.shrink(p)
+	return nil
+}
+
+func (c *LRU) partition(name string) *partition {
+	if p, ok := c.parts[name]; ok {
+		return p
+	}
+	return c.def
+}
+
+// partitions return default partition and others sorted by name
+func (c *LRU) partitions() []*partition {
+	names := make([]string, 0, len(c.parts))
+	for name := range c.parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []*partition{c.def}
+	for _, name := range names {
+		parts = append(parts, c.parts[name])
+	}
+	return parts
+}
+
+// PrefetchTopN check top n entries of each partition
 func (c *LRU) PrefetchTopN(n int) []Item {
-	item := c.deque.Front()
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	result := make([]Item, 0, n)
-	count := 0
-	for item != nil && count <= n {
-		v := item.Value.(*entry)
-		if shouldPrefetch(v, prefetchMinHitCount) {
-			result = append(result, v.toItem())
+	for _, p := range c.partitions() {
+		item := p.deque.Front()
+		count := 0
+		for item != nil && count <= n {
+			v := item.Value.(*entry)
+			if shouldPrefetch(v, prefetchMinHitCount) {
+				result = append(result, v.toItem())
+			}
+			item = item.Next()
+			count++
 		}
-		item = item.Next()
-		count++
 	}
 	return result
 }
@@ -83,46 +152,91 @@ func shouldPrefetch(e *entry, minHit int) bool {
 	return false
 }
 
+// SetMaxStale keep expired entries for d, so they can be served by
+// GetStale when fresh data is unavailable.
+func (c *LRU) SetMaxStale(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if d < 0 {
+		d = 0
+	}
+	c.maxStale = d
+}
+
+// dead check whether entry is expired and out of stale window
+func (c *LRU) dead(e *entry, now time.Time) bool {
+	return !e.expiredAt().Add(c.maxStale).After(now)
+}
+
 func (c *LRU) Get(key interface{}) interface{} {
+	if v, _, stale := c.GetStale(key); !stale {
+		return v
+	}
+	return nil
+}
+
+// GetStale return value of key and time elapsed since it's added, stale is
+// true if value is expired but still in stale window.
+func (c *LRU) GetStale(key interface{}) (value interface{}, age time.Duration, stale bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	if v, ok := c.items[key]; ok {
 		_v := v.Value.(*entry)
-		if _v.expiredAt().Before(time.Now()) {
-			// expired
+		now := time.Now()
+		if c.dead(_v, now) {
 			c.removeElement(v)
-			return nil
+			return nil, 0, false
 		}
 		_v.hit++
-		c.deque.MoveToFront(v)
-		return _v.value
+		_v.part.deque.MoveToFront(v)
+		return _v.value, now.Sub(_v.createdAt), !_v.expiredAt().After(now)
 	}
-	return nil
+	return nil, 0, false
 }
 
 func (c *LRU) Add(key, value interface{}, ttl time.Duration) bool {
+	return c.AddTo("", key, value, ttl)
+}
+
+// AddTo add entry to partition, default partition is used if it doesn't
+// exist. Existing entry is moved to the partition.
+func (c *LRU) AddTo(part string, key, value interface{}, ttl time.Duration) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	p := c.partition(part)
 	if v, ok := c.items[key]; ok {
 		_v := v.Value.(*entry)
-		_v.value = value
-		_v.ttl = ttl
-		_v.hit++
-		c.deque.MoveToFront(v)
+		if _v.part == p {
+			_v.value = value
+			_v.createdAt = time.Now()
+			_v.ttl = ttl
+			_v.hit++
+			p.deque.MoveToFront(v)
+			return false
+		}
+		c.removeElement(v)
+		c.push(&entry{key, value, _v.hit + 1, time.Now(), ttl, p})
 		return false
 	}
-	ent := &entry{key, value, 1, time.Now(), ttl}
-	ele := c.deque.PushFront(ent)
-	c.items[key] = ele
-	if c.Len() > c.capacity {
-		ele := c.deque.Back()
-		c.removeElement(ele)
-	}
+	c.push(&entry{key, value, 1, time.Now(), ttl, p})
 	return true
 }
 
+// push add new entry to front of its partition
+func (c *LRU) push(ent *entry) {
+	c.items[ent.key] = ent.part.deque.PushFront(ent)
+	c.shrink(ent.part)
+}
+
+// shrink evict least recently used entries over capacity of p
+func (c *LRU) shrink(p *partition) {
+	for p.deque.Len() > p.capacity {
+		c.removeElement(p.deque.Back())
+	}
+}
+
 func (c *LRU) Evict(key interface{}) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -134,10 +248,13 @@ func (c *LRU) Evict(key interface{}) bool {
 }
 
 func (c *LRU) removeElement(item *list.Element) {
-	c.deque.Remove(item)
-	delete(c.items, item.Value.(*entry).key)
+	e := item.Value.(*entry)
+	e.part.deque.Remove(item)
+	delete(c.items, e.key)
 }
 
 func (c *LRU) Len() int {
-	return c.deque.Len()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.items)
 }
@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"bytes"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -52,3 +54,127 @@ func TestLRUWithTTL(t *testing.T) {
 		t.Error("should alredy expired")
 	}
 }
+
+func TestSaveLoad(t *testing.T) {
+	c, _ := NewLRU(4)
+	c.Add("k1", []byte("v1"), time.Hour)
+	c.Add("k2", []byte("v2"), time.Hour)
+	c.Add("k3", []byte("v3"), time.Millisecond)
+	c.Add("k4", "not bytes", time.Hour)
+	c.Get("k1")
+	time.Sleep(5 * time.Millisecond)
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, _ := NewLRU(2)
+	c2.Add("k2", []byte("new"), time.Hour)
+	n, err := c2.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || c2.Len() != 2 {
+		t.Fatal("unexpected loaded entries", n, c2.Len())
+	}
+	if v, _ := c2.Get("k1").([]byte); string(v) != "v1" {
+		t.Error("k1 should be loaded")
+	}
+	if v, _ := c2.Get("k2").([]byte); string(v) != "new" {
+		t.Error("existing k2 should be kept")
+	}
+	if c2.Get("k3") != nil || c2.Get("k4") != nil {
+		t.Error("expired or non bytes entries should not be saved")
+	}
+	// ttl is counted from time of adding, not loading
+	for e := c2.def.deque.Front(); e != nil; e = e.Next() {
+		if v := e.Value.(*entry); v.key == "k1" && time.Until(v.expiredAt()) > time.Hour-5*time.Millisecond {
+			t.Error("ttl should be reduced by elapsed time", time.Until(v.expiredAt()))
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	c, _ := NewLRU(3)
+	if _, err := c.Load(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Error("should fail for invalid snapshot")
+	}
+	if _, err := c.LoadFile("/nonexistent/dns-cache"); err == nil {
+		t.Error("should fail for missing file")
+	}
+}
+
+func TestGetStale(t *testing.T) {
+	c, _ := NewLRU(3)
+	c.SetMaxStale(time.Second)
+	c.Add("k1", "v1", 10*time.Millisecond)
+	if v, _, stale := c.GetStale("k1"); v != "v1" || stale {
+		t.Error("k1 should be fresh")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if c.Get("k1") != nil {
+		t.Error("Get should not return stale value")
+	}
+	v, age, stale := c.GetStale("k1")
+	if v != "v1" || !stale || age < 20*time.Millisecond {
+		t.Error("k1 should be stale", v, age, stale)
+	}
+	c.SetMaxStale(0)
+	if v, _, _ := c.GetStale("k1"); v != nil || c.Len() != 0 {
+		t.Error("k1 should be removed out of stale window")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	fakeTTL := time.Hour
+	c, _ := NewLRU(2)
+	if err := c.SetPartition("AAAA", 1); err != nil {
+		t.Fatal(err)
+	}
+	c.Add("a1", []byte("v"), fakeTTL)
+	c.Add("a2", []byte("v"), fakeTTL)
+	c.AddTo("AAAA", "b1", []byte("v"), fakeTTL)
+	c.AddTo("AAAA", "b2", []byte("v"), fakeTTL)
+	if c.Get("a1") == nil || c.Get("a2") == nil {
+		t.Error("entries of other partition should not evict default partition")
+	}
+	if c.Get("b1") != nil || c.Get("b2") == nil {
+		t.Error("b1 should be evicted by b2")
+	}
+	// unknown partition is default one
+	c.AddTo("MX", "c1", []byte("v"), fakeTTL)
+	if c.Get("a1") != nil || c.Len() != 3 {
+		t.Error("a1 should be evicted by c1", c.Len())
+	}
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := NewLRU(2)
+	c2.SetPartition("AAAA", 1)
+	if n, err := c2.Load(&buf); err != nil || n != 3 {
+		t.Fatal("unexpected loaded entries", n, err)
+	}
+	if c2.parts["AAAA"].deque.Len() != 1 {
+		t.Error("partition of entries should be restored")
+	}
+}
+
+func TestLenConcurrent(t *testing.T) {
+	c, _ := NewLRU(100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			c.Add(strconv.Itoa(i), []byte("v"), time.Minute)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		c.Len()
+	}
+	<-done
+	if c.Len() != 100 {
+		t.Error("unexpected len", c.Len())
+	}
+}
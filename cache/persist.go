@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// bump it if format of snapshot or its values changed, snapshot of other
+// version is ignored. 2: dns answers are saved with offsets of their ttls.
+const snapshotVersion = 2
+
+type snapshot struct {
+	Version int
+	Entries []snapshotEntry
+}
+
+type snapshotEntry struct {
+	Key       string
+	Part      string
+	Value     []byte
+	Hit       int
+	CreatedAt time.Time
+	TTL       time.Duration
+}
+
+// Save write unexpired or stale entries to w, only entries with string key and
+// []byte value are saved.
+func (c *LRU) Save(w io.Writer) error {
+	c.lock.Lock()
+	snap := snapshot{Version: snapshotVersion, Entries: make([]snapshotEntry, 0, len(c.items))}
+	now := time.Now()
+	for _, p := range c.partitions() {
+		// from least recently used, so the order is restored by Load
+		for e := p.deque.Back(); e != nil; e = e.Prev() {
+			v := e.Value.(*entry)
+			key, ok := v.key.(string)
+			value, ok2 := v.value.([]byte)
+			if !ok || !ok2 || c.dead(v, now) {
+				continue
+			}
+			snap.Entries = append(snap.Entries, snapshotEntry{key, p.name, value, v.hit, v.createdAt, v.ttl})
+		}
+	}
+	c.lock.Unlock()
+	return gob.NewEncoder(w).Encode(&snap)
+}
+
+// Load add entries saved by Save, they expire at the same time as before,
+// so time elapsed since saving is deducted from their ttl. Entries out of
+// stale window and keys already in cache are skipped, number of loaded
+// entries is returned.
+func (c *LRU) Load(r io.Reader) (int, error) {
+	var snap snapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != snapshotVersion {
+		return 0, errors.New("unsupported cache snapshot version")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	n := len(c.items)
+	for _, se := range snap.Entries {
+		ent := &entry{se.Key, se.Value, se.Hit, se.CreatedAt, se.TTL, c.partition(se.Part)}
+		if _, ok := c.items[se.Key]; ok || c.dead(ent, now) {
+			continue
+		}
+		c.push(ent)
+	}
+	return len(c.items) - n, nil
+}
+
+// LoadFile load snapshot saved by Save
+func (c *LRU) LoadFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return c.Load(f)
+}
@@ -3,14 +3,14 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
-	"math"
+	"errors"
+	"io/ioutil"
 	"os"
-	"strconv"
 	"strings"
 	"text/template"
 	"time"
+
+	"snet/remotelist"
 )
 
 var apnicGlobalFile = "apnic.txt"
@@ -28,35 +28,23 @@ var Chnroutes = []string{
 }
 `))
 
-func ipStartCountToCIDR(ipStart string, ipCount int) string {
-	result := math.Log2(float64(ipCount))
-	return fmt.Sprintf("%s/%d", ipStart, 32-int(result))
-}
-
+// genChnroute parse ipv4 and ipv6 routes of China from apnic stats, it's
+// the same parser used for chnroutes-url.
 func genChnroute() ([]string, error) {
-	f, err := os.Open(apnicGlobalFile)
+	data, err := ioutil.ReadFile(apnicGlobalFile)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	result := make([]string, 0, 8000) // 8000 is a approximate number of cn cidr numbers
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "apnic|CN|ipv4") {
-			record := strings.FieldsFunc(line,
-				func(c rune) bool {
-					return c == '|'
-				})
-
-			ipCount, err := strconv.Atoi(record[4])
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, ipStartCountToCIDR(record[3], ipCount))
+	routes, err := remotelist.ParseChnroutes(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if strings.Contains(r, ":") {
+			return routes, nil
 		}
 	}
-	return result, nil
+	return nil, errors.New("no ipv6 route found in " + apnicGlobalFile)
 }
 
 func main() {
@@ -1,15 +1,18 @@
 // Package cidradix use radix tree to store cidrs for chnroutes.
 // Used to check whether a ip is in cidrs quickly, and use less memory.
+// IPv4 and IPv6 cidrs share one tree, IPv4 address is stored in
+// IPv4-mapped IPv6 form(::ffff:a.b.c.d), so tree depth is at most 128.
 package cidradix
 
 import (
-	"encoding/binary"
 	"net"
+	"sync"
 )
 
 const (
-	startbit     = uint32(0x80000000)
 	placeholdval = 1
+	// bits of ::ffff: prefix for IPv4-mapped address
+	v4MappedPrefixLen = 96
 )
 
 type Node struct {
@@ -19,6 +22,7 @@ type Node struct {
 }
 
 type Tree struct {
+	mu   sync.RWMutex
 	root *Node
 }
 
@@ -28,68 +32,90 @@ func NewTree() *Tree {
 	return t
 }
 
-func (t *Tree) AddCIDR(cidr *net.IPNet) {
-	bit := startbit
-	node := t.root
-	next := t.root
-	ip := ip2uint32(cidr.IP)
-	mask := ip2uint32(cidr.Mask)
-	// search until we find target parent node
-	for (bit & mask) > 0 {
-		if (ip & bit) > 0 {
-			next = node.right
-		} else {
-			next = node.left
-		}
-		// reach end
-		if next == nil {
-			break
+// NewTreeFromCIDRs build tree from cidr list, eg: chnroutes
+func NewTreeFromCIDRs(cidrs []string) (*Tree, error) {
+	t := NewTree()
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
 		}
-		bit >>= 1
-		node = next
+		t.AddCIDR(ipnet)
 	}
-	// already has this cidr, update value
-	if next != nil {
-		node.value = placeholdval
+	return t, nil
+}
+
+func (t *Tree) AddCIDR(cidr *net.IPNet) {
+	ip := cidr.IP.To16()
+	if ip == nil {
 		return
 	}
-	// build left nodes
-	for (bit & mask) > 0 {
-		next = new(Node)
-		if (ip & bit) > 0 {
-			node.right = next
+	ones, bits := cidr.Mask.Size()
+	if bits == 8*net.IPv4len {
+		ones += v4MappedPrefixLen
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	node := t.root
+	for i := 0; i < ones; i++ {
+		if node.value == placeholdval {
+			// a larger cidr already covers this one
+			return
+		}
+		var next *Node
+		if bitAt(ip, i) {
+			if node.right == nil {
+				node.right = new(Node)
+			}
+			next = node.right
 		} else {
-			node.left = next
+			if node.left == nil {
+				node.left = new(Node)
+			}
+			next = node.left
 		}
-		bit >>= 1
 		node = next
 	}
 	node.value = placeholdval
 }
 
 func (t *Tree) Contains(ip net.IP) bool {
-	bit := startbit
+	_ip := ip.To16()
+	if _ip == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	node := t.root
-	_ip := ip2uint32(ip)
-	for node != nil {
+	for i := 0; node != nil; i++ {
 		if node.value == placeholdval {
 			// reach the bottom leaf node
 			return true
 		}
-		if (_ip & bit) > 0 {
+		if i == 8*net.IPv6len {
+			break
+		}
+		if bitAt(_ip, i) {
 			node = node.right
 		} else {
 			node = node.left
 		}
-		bit >>= 1
 	}
 	return false
 }
 
-func ip2uint32(ip []byte) uint32 {
-	if len(ip) == 16 {
-		// store ipv4 in tail
-		return binary.BigEndian.Uint32(ip[12:16])
-	}
-	return binary.BigEndian.Uint32(ip)
+// Replace swap content of tree with other's, used to reload cidrs
+// while tree is in use. other should not be modified afterwards.
+func (t *Tree) Replace(other *Tree) {
+	other.mu.RLock()
+	root := other.root
+	other.mu.RUnlock()
+	t.mu.Lock()
+	t.root = root
+	t.mu.Unlock()
+}
+
+// bitAt return whether the i-th bit(from most significant) of ip is set
+func bitAt(ip net.IP, i int) bool {
+	return ip[i/8]&(0x80>>uint(i%8)) != 0
 }
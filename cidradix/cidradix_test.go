@@ -19,3 +19,30 @@ func TestCIDRadix(t *testing.T) {
 		t.Fatal("should not in")
 	}
 }
+
+func TestCIDRadixIPv6(t *testing.T) {
+	tree := NewTree()
+	for _, c := range []string{"2001:250::/35", "1.0.1.0/24"} {
+		_, cidr, _ := net.ParseCIDR(c)
+		tree.AddCIDR(cidr)
+	}
+	for _, ip := range []string{"2001:250::1", "2001:250:1fff::1", "1.0.1.1"} {
+		if !tree.Contains(net.ParseIP(ip)) {
+			t.Error("should in:", ip)
+		}
+	}
+	for _, ip := range []string{"2001:250:2000::1", "::1", "1.0.2.1", "::101:101"} {
+		if tree.Contains(net.ParseIP(ip)) {
+			t.Error("should not in:", ip)
+		}
+	}
+}
+
+func TestCIDRadixReplace(t *testing.T) {
+	tree, _ := NewTreeFromCIDRs([]string{"10.0.0.0/8"})
+	other, _ := NewTreeFromCIDRs([]string{"192.168.0.0/16"})
+	tree.Replace(other)
+	if tree.Contains(net.ParseIP("10.0.0.1")) || !tree.Contains(net.ParseIP("192.168.1.1")) {
+		t.Error("tree should be replaced")
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net"
 
 	"snet/config"
 	"snet/proxy"
+	"snet/proxy/group"
 	"snet/proxy/http"
 	"snet/proxy/socks5"
 	"snet/proxy/ss"
@@ -13,6 +15,92 @@ import (
 	"snet/proxy/tls"
 )
 
+// newProxies init all upstream proxies and proxy groups by name. Legacy top
+// level proxy-type is named after its type, blocks in "proxies" use their
+// own proxy-type.
+// The default one is used when rule doesn't specify a proxy name.
+func newProxies(c *config.Config) (proxies map[string]proxy.Proxy, defaultProxy string, err error) {
+	blocks := make(map[string]*config.Config, len(c.Proxies)+1)
+	for name, b := range c.Proxies {
+		blocks[name] = b
+	}
+	if c.ProxyType != "" {
+		if _, ok := blocks[c.ProxyType]; ok {
+			return nil, "", errors.New("proxy name conflicts with proxy-type: " + c.ProxyType)
+		}
+		blocks[c.ProxyType] = c
+	}
+	proxies = make(map[string]proxy.Proxy, len(blocks))
+	for name, b := range blocks {
+		if b == nil || b.ProxyType == "" {
+			return nil, "", errors.New("missing proxy-type for proxy " + name)
+		}
+		p, err := proxy.Get(b.ProxyType)
+		if err != nil {
+			return nil, "", err
+		}
+		cfg, err := genConfigByType(b, b.ProxyType)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := p.Init(cfg); err != nil {
+			return nil, "", fmt.Errorf("failed to init proxy %s: %v", name, err)
+		}
+		proxies[name] = p
+	}
+	groupMembers := make(map[string][]string, len(c.ProxyGroups))
+	for name, gc := range c.ProxyGroups {
+		groupMembers[name] = gc.Proxies
+	}
+	// groups may be members of other groups, build members first
+	order, err := group.SortGroups(groupMembers)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, name := range order {
+		gc := c.ProxyGroups[name]
+		if _, ok := proxies[name]; ok {
+			return nil, "", errors.New("proxy group name conflicts with proxy: " + name)
+		}
+		members := make([]proxy.Proxy, 0, len(gc.Proxies))
+		for _, m := range gc.Proxies {
+			p, ok := proxies[m]
+			if !ok {
+				return nil, "", fmt.Errorf("unknown proxy %s in group %s", m, name)
+			}
+			members = append(members, p)
+		}
+		g := new(group.Group)
+		if err := g.Init(&group.Config{
+			Strategy:      gc.Strategy,
+			CheckURL:      gc.CheckURL,
+			CheckInterval: gc.CheckInterval,
+			CheckTimeout:  gc.CheckTimeout,
+			Names:         gc.Proxies,
+			Members:       members,
+		}); err != nil {
+			return nil, "", fmt.Errorf("failed to init proxy group %s: %v", name, err)
+		}
+		proxies[name] = g
+	}
+	defaultProxy = c.DefaultProxy
+	if defaultProxy == "" {
+		if c.ProxyType != "" {
+			defaultProxy = c.ProxyType
+		} else if len(proxies) == 1 {
+			for name := range proxies {
+				defaultProxy = name
+			}
+		} else {
+			return nil, "", errors.New("default-proxy is required for multiple proxies")
+		}
+	}
+	if _, ok := proxies[defaultProxy]; !ok {
+		return nil, "", errors.New("unknown default-proxy " + defaultProxy)
+	}
+	return proxies, defaultProxy, nil
+}
+
 func genConfigByType(c *config.Config, proxyType string) (proxy.Config, error) {
 	switch proxyType {
 	case "ss":
@@ -13,71 +13,193 @@ const (
 
 const (
 	DefaultLHost            = "127.0.0.1"
+	DefaultLHost6           = "::1"
 	DefaultLPort            = 1111
 	DefaultProxyTimeout     = 30
 	DefaultProxyScope       = ProxyScopeBypassCN
 	DefaultCNDNS            = "223.6.6.6"
 	DefaultFQDNS            = "8.8.8.8"
+	DefaultBootstrapDNS     = DefaultCNDNS // resolve host of DoH/DoT cn-dns
 	DefaultMode             = "local"
 	DefaultPrefetchCount    = 10
 	DefaultPrefetchInterval = 10
 	DefaultStatsPort        = 8810
+	DefaultUDPTimeout       = 60
+	DefaultFakeIPRange      = "198.18.0.0/15"
+	DefaultBlockResponse    = "zero"
+	// refresh remote lists daily
+	DefaultListRefreshInterval = 86400
+	DefaultListCacheDir        = "/var/cache/snet"
+
+	DefaultDNSCacheSize = 5000
+	DefaultDNSMaxTTL    = 86400
+	// serve expired dns answers up to a day if upstream fails, RFC 8767
+	DefaultDNSMaxStale  = 86400
+	DefaultDNSCacheFile = "/var/cache/snet/dns-cache"
+	// save dns cache every 10 minutes, in case snet is killed
+	DefaultDNSCacheSaveInterval = 600
+
+	DefaultStatsHistoryFile         = "/var/cache/snet/traffic-history"
+	DefaultStatsHistorySaveInterval = 600
 )
 
+// QTypePolicy is dns cache policy of a query type
+type QTypePolicy struct {
+	// answers of this type only evict each other if > 0, and they are
+	// limited by it instead of dns-cache-size
+	Size    int    `json:"size"`
+	NoCache bool   `json:"no-cache"`
+	MinTTL  uint32 `json:"min-ttl"` // override dns-min-ttl if > 0
+	MaxTTL  uint32 `json:"max-ttl"` // override dns-max-ttl if > 0
+}
+
+// DefaultDNSCachePolicy keep AAAA answers in their own partition, most
+// of them are empty when ipv6 is unavailable, they should not evict
+// useful A answers.
+func DefaultDNSCachePolicy() map[string]QTypePolicy {
+	return map[string]QTypePolicy{"AAAA": {Size: 1000}}
+}
+
+// RateLimit is bandwidth limit in KB/s, 0 means unlimited
+type RateLimit struct {
+	Download int `json:"download"`
+	Upload   int `json:"upload"`
+}
+
+// DstRateLimit limit connections matched by a rule without action,
+// eg: "domain-suffix,youtube.com", the limit is shared by them.
+type DstRateLimit struct {
+	Match string `json:"match"`
+	RateLimit
+}
+
+// Quota is monthly traffic(rx + tx) limit of a client, proxied connections
+// are switched to action(direct or reject) when it's exceeded.
+type Quota struct {
+	MonthlyMB uint64 `json:"monthly-mb"`
+	Action    string `json:"action"`
+}
+
+// ProxyGroup select one of member proxies by strategy,
+// members are health checked by http request to check-url.
+type ProxyGroup struct {
+	Strategy      string   `json:"strategy"` // failover, round-robin or lowest-latency
+	Proxies       []string `json:"proxies"`
+	CheckURL      string   `json:"check-url"`
+	CheckInterval int      `json:"check-interval"`
+	CheckTimeout  int      `json:"check-timeout"`
+}
+
+// HostMapValue is ip, ip list or cname target of a host-map entry,
+// both "1.1.1.1" and ["1.1.1.1", "::1"] are accepted in json.
+type HostMapValue []string
+
+func (v *HostMapValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = HostMapValue{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(data, &l); err != nil {
+		return errors.New("host-map value should be string or string list")
+	}
+	*v = HostMapValue(l)
+	return nil
+}
+
 type Config struct {
-	AsUpstream                 bool              `json:"as-upstream"`
-	LHost                      string            `json:"listen-host"`
-	LPort                      int               `json:"listen-port"`
-	ProxyType                  string            `json:"proxy-type"`
-	ProxyTimeout               int               `json:"proxy-timeout"`
-	ProxyScope                 string            `json:"proxy-scope"`
-	BypassHosts                []string          `json:"bypass-hosts"`
-	BypassSrcIPs               []string          `json:"bypass-src-ips"`
-	HTTPProxyHost              string            `json:"http-proxy-host"`
-	HTTPProxyPort              int               `json:"http-proxy-port"`
-	HTTPProxyAuthUser          string            `json:"http-proxy-auth-user"`
-	HTTPProxyAuthPassword      string            `json:"http-proxy-auth-password"`
-	SSHost                     string            `json:"ss-host"`
-	SSPort                     int               `json:"ss-port"`
-	SSChpierMethod             string            `json:"ss-chpier-method"`
-	SSCipherMethod             string            `json:"ss-cipher-method"`
-	SSPasswd                   string            `json:"ss-passwd"`
-	SS2Host                    string            `json:"ss2-host"`
-	SS2Port                    int               `json:"ss2-port"`
-	SS2CipherMethod            string            `json:"ss2-cipher-method"`
-	SS2Passwd                  string            `json:"ss2-passwd"`
-	SS2Key                     string            `json:"ss2-key"`
-	TLSHost                    string            `json:"tls-host"`
-	TLSPort                    int               `json:"tls-port"`
-	TLSToken                   string            `json:"tls-token"`
-	SOCKS5Host                 string            `json:"socks5-host"`
-	SOCKS5Port                 int               `json:"socks5-port"`
-	SOCKS5AuthUser             string            `json:"socks5-auth-user"`
-	SOCKS5AuthPassword         string            `json:"socks5-auth-password"`
-	DNSLoggingFile             string            `json:"dns-logging-file"`
-	CNDNS                      string            `json:"cn-dns"`
-	FQDNS                      string            `json:"fq-dns"`
-	EnableDNSCache             bool              `json:"enable-dns-cache"`
-	EnforceTTL                 uint32            `json:"enforce-ttl"`
-	DNSPrefetchEnable          bool              `json:"dns-prefetch-enable"`
-	DNSPrefetchCount           int               `json:"dns-prefetch-count"`
-	DNSPrefetchInterval        int               `json:"dns-prefetch-interval"`
-	DisableQTypes              []string          `json:"disable-qtypes"`
-	ForceFQ                    []string          `json:"force-fq"`
-	HostMap                    map[string]string `json:"host-map"`
-	BlockHostFile              string            `json:"block-host-file"`
-	BlockHosts                 []string          `json:"block-hosts"`
-	Mode                       string            `json:"mode"`
-	EnableStats                bool              `json:"enable-stats"`
-	StatsPort                  int               `json:"stats-port"`
-	StatsEnableTLSSNISniffer   bool              `json:"stats-enable-tls-sni-sniffer"`
-	StatsEnableHTTPHostSniffer bool              `json:"stats-enable-http-host-sniffer"`
-	ActiveEni                  string            `json:"active-eni"`
-	UpstreamType               string            `json:"upstream-type"`
-	UpstreamTLSServerListen    string            `json:"upstream-tls-server-listen"`
-	UpstreamTLSKey             string            `json:"upstream-tls-key"`
-	UpstreamTLSCRT             string            `json:"upstream-tls-crt"`
-	UpstreamTLSToken           string            `json:"upstream-tls-token"`
+	AsUpstream                 bool                    `json:"as-upstream"`
+	LHost                      string                  `json:"listen-host"`
+	LPort                      int                     `json:"listen-port"`
+	EnableIPv6                 bool                    `json:"enable-ipv6"`
+	LHost6                     string                  `json:"listen-host6"`
+	ProxyType                  string                  `json:"proxy-type"`
+	Proxies                    map[string]*Config      `json:"proxies"`
+	DefaultProxy               string                  `json:"default-proxy"`
+	ProxyGroups                map[string]*ProxyGroup  `json:"proxy-groups"`
+	ProxyTimeout               int                     `json:"proxy-timeout"`
+	EnableUDPRelay             bool                    `json:"enable-udp-relay"`
+	UDPTimeout                 int                     `json:"udp-timeout"`
+	ProxyScope                 string                  `json:"proxy-scope"`
+	BypassHosts                []string                `json:"bypass-hosts"`
+	BypassSrcIPs               []string                `json:"bypass-src-ips"`
+	HTTPProxyHost              string                  `json:"http-proxy-host"`
+	HTTPProxyPort              int                     `json:"http-proxy-port"`
+	HTTPProxyAuthUser          string                  `json:"http-proxy-auth-user"`
+	HTTPProxyAuthPassword      string                  `json:"http-proxy-auth-password"`
+	SSHost                     string                  `json:"ss-host"`
+	SSPort                     int                     `json:"ss-port"`
+	SSChpierMethod             string                  `json:"ss-chpier-method"`
+	SSCipherMethod             string                  `json:"ss-cipher-method"`
+	SSPasswd                   string                  `json:"ss-passwd"`
+	SS2Host                    string                  `json:"ss2-host"`
+	SS2Port                    int                     `json:"ss2-port"`
+	SS2CipherMethod            string                  `json:"ss2-cipher-method"`
+	SS2Passwd                  string                  `json:"ss2-passwd"`
+	SS2Key                     string                  `json:"ss2-key"`
+	TLSHost                    string                  `json:"tls-host"`
+	TLSPort                    int                     `json:"tls-port"`
+	TLSToken                   string                  `json:"tls-token"`
+	SOCKS5Host                 string                  `json:"socks5-host"`
+	SOCKS5Port                 int                     `json:"socks5-port"`
+	SOCKS5AuthUser             string                  `json:"socks5-auth-user"`
+	SOCKS5AuthPassword         string                  `json:"socks5-auth-password"`
+	DNSLoggingFile             string                  `json:"dns-logging-file"`
+	CNDNS                      string                  `json:"cn-dns"`
+	FQDNS                      string                  `json:"fq-dns"`
+	BootstrapDNS               string                  `json:"bootstrap-dns"` // plain dns ip to resolve host of DoH/DoT cn-dns
+	EnableDNSCache             bool                    `json:"enable-dns-cache"`
+	EnforceTTL                 uint32                  `json:"enforce-ttl"` // deprecated, same as dns-min-ttl and dns-max-ttl
+	DNSMinTTL                  uint32                  `json:"dns-min-ttl"`
+	DNSMaxTTL                  uint32                  `json:"dns-max-ttl"`
+	DNSMaxStale                int                     `json:"dns-max-stale"` // -1 disable serve-stale
+	DNSCacheSize               int                     `json:"dns-cache-size"`
+	DNSCachePolicy             map[string]QTypePolicy  `json:"dns-cache-policy"` // key is query type, eg: AAAA
+	DNSCacheFile               string                  `json:"dns-cache-file"`
+	DNSCacheSaveInterval       int                     `json:"dns-cache-save-interval"`
+	DNSPrefetchEnable          bool                    `json:"dns-prefetch-enable"`
+	DNSPrefetchCount           int                     `json:"dns-prefetch-count"`
+	DNSPrefetchInterval        int                     `json:"dns-prefetch-interval"`
+	DisableQTypes              []string                `json:"disable-qtypes"`
+	ForceFQ                    []string                `json:"force-fq"`
+	EnableFakeIP               bool                    `json:"enable-fake-ip"`
+	FakeIPRange                string                  `json:"fake-ip-range"`
+	Rules                      []string                `json:"rules"`
+	HostMap                    map[string]HostMapValue `json:"host-map"`
+	BlockHostFile              string                  `json:"block-host-file"`
+	BlockHosts                 []string                `json:"block-hosts"`
+	BlockHostURLs              []string                `json:"block-host-urls"`
+	BlockResponse              string                  `json:"block-response"`
+	ChnroutesURL               string                  `json:"chnroutes-url"`
+	ListRefreshInterval        int                     `json:"list-refresh-interval"`
+	ListCacheDir               string                  `json:"list-cache-dir"`
+	Mode                       string                  `json:"mode"`
+	RateLimit                  RateLimit               `json:"rate-limit"`         // shared by all connections
+	ClientRateLimits           map[string]RateLimit    `json:"client-rate-limits"` // key is client ip or cidr
+	DstRateLimits              []DstRateLimit          `json:"dst-rate-limits"`
+	ClientQuotas               map[string]Quota        `json:"client-quotas"` // key is client ip or cidr
+	EnableStats                bool                    `json:"enable-stats"`
+	StatsPort                  int                     `json:"stats-port"`
+	StatsEnableTLSSNISniffer   bool                    `json:"stats-enable-tls-sni-sniffer"`
+	StatsEnableHTTPHostSniffer bool                    `json:"stats-enable-http-host-sniffer"`
+	StatsHistoryFile           string                  `json:"stats-history-file"`
+	StatsHistorySaveInterval   int                     `json:"stats-history-save-interval"`
+	ActiveEni                  string                  `json:"active-eni"`
+	UpstreamType               string                  `json:"upstream-type"`
+	UpstreamTLSServerListen    string                  `json:"upstream-tls-server-listen"`
+	UpstreamTLSKey             string                  `json:"upstream-tls-key"`
+	UpstreamTLSCRT             string                  `json:"upstream-tls-crt"`
+	UpstreamTLSToken           string                  `json:"upstream-tls-token"`
+}
+
+// ListenHosts return all hosts snet should listen on,
+// listen-host6 is included only when ipv6 is enabled.
+func (c *Config) ListenHosts() []string {
+	if c.EnableIPv6 {
+		return []string{c.LHost, c.LHost6}
+	}
+	return []string{c.LHost}
 }
 
 func LoadConfig(configPath string) (*Config, error) {
@@ -94,7 +216,7 @@ func LoadConfig(configPath string) (*Config, error) {
 }
 
 func fillDefault(c *Config) error {
-	if c.ProxyType == "" {
+	if c.ProxyType == "" && len(c.Proxies) == 0 {
 		return errors.New("missing proxy-type")
 	}
 	switch c.ProxyScope {
@@ -110,18 +232,30 @@ func fillDefault(c *Config) error {
 	if c.LHost == "" {
 		c.LHost = DefaultLHost
 	}
+	if c.LHost6 == "" {
+		c.LHost6 = DefaultLHost6
+	}
 	if c.LPort == 0 {
 		c.LPort = DefaultLPort
 	}
 	if c.ProxyTimeout == 0 {
 		c.ProxyTimeout = DefaultProxyTimeout
 	}
+	if c.UDPTimeout == 0 {
+		c.UDPTimeout = DefaultUDPTimeout
+	}
+	if c.FakeIPRange == "" {
+		c.FakeIPRange = DefaultFakeIPRange
+	}
 	if c.CNDNS == "" {
 		c.CNDNS = DefaultCNDNS
 	}
 	if c.FQDNS == "" {
 		c.FQDNS = DefaultFQDNS
 	}
+	if c.BootstrapDNS == "" {
+		c.BootstrapDNS = DefaultBootstrapDNS
+	}
 	if c.Mode == "" {
 		c.Mode = DefaultMode
 	}
@@ -134,5 +268,44 @@ func fillDefault(c *Config) error {
 	if c.StatsPort == 0 {
 		c.StatsPort = DefaultStatsPort
 	}
+	if c.BlockResponse == "" {
+		c.BlockResponse = DefaultBlockResponse
+	}
+	if c.ListRefreshInterval == 0 {
+		c.ListRefreshInterval = DefaultListRefreshInterval
+	}
+	if c.ListCacheDir == "" {
+		c.ListCacheDir = DefaultListCacheDir
+	}
+	if c.EnforceTTL > 0 {
+		c.DNSMinTTL, c.DNSMaxTTL = c.EnforceTTL, c.EnforceTTL
+	}
+	if c.DNSCacheSize == 0 {
+		c.DNSCacheSize = DefaultDNSCacheSize
+	}
+	if c.DNSCachePolicy == nil {
+		c.DNSCachePolicy = DefaultDNSCachePolicy()
+	}
+	if c.DNSMaxTTL == 0 {
+		c.DNSMaxTTL = DefaultDNSMaxTTL
+	}
+	if c.DNSMinTTL > c.DNSMaxTTL {
+		return errors.New("dns-min-ttl should not be larger than dns-max-ttl")
+	}
+	if c.DNSMaxStale == 0 {
+		c.DNSMaxStale = DefaultDNSMaxStale
+	}
+	if c.DNSCacheFile == "" {
+		c.DNSCacheFile = DefaultDNSCacheFile
+	}
+	if c.DNSCacheSaveInterval == 0 {
+		c.DNSCacheSaveInterval = DefaultDNSCacheSaveInterval
+	}
+	if c.StatsHistoryFile == "" {
+		c.StatsHistoryFile = DefaultStatsHistoryFile
+	}
+	if c.StatsHistorySaveInterval == 0 {
+		c.StatsHistorySaveInterval = DefaultStatsHistorySaveInterval
+	}
 	return nil
 }
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	BlockNXDomain = "nxdomain" // NXDOMAIN with SOA
+	BlockNoData   = "nodata"   // NOERROR without answer, with SOA
+	BlockZero     = "zero"     // 0.0.0.0 for A, :: for AAAA
+	BlockRefused  = "refused"  // REFUSED
+	// ttl of blocked answers and SOA minimum of negative answers,
+	// so clients cache blocked result
+	blockTTL = 3600
+	// SOA of negative answers, RFC 2308
+	blockSOAMName = "fake-for-negative-caching.snet"
+	blockSOARName = "hostmaster.snet"
+)
+
+// blockResponse build response for blocked domains by mode, ip4 and ip6
+// are answers of A and AAAA query, empty answer is used if it's nil.
+type blockResponse struct {
+	mode string
+	ip4  net.IP
+	ip6  net.IP
+}
+
+// parseBlockResponse parse block-response option, it's one of nxdomain,
+// nodata, zero, refused, or a custom ip.
+func parseBlockResponse(s string) (*blockResponse, error) {
+	switch s = strings.ToLower(s); s {
+	case "", BlockZero:
+		return &blockResponse{mode: BlockZero, ip4: net.IPv4zero.To4(), ip6: net.IPv6zero}, nil
+	case BlockNXDomain, BlockNoData, BlockRefused:
+		return &blockResponse{mode: s}, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("invalid block-response " + s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &blockResponse{mode: s, ip4: ip4}, nil
+	}
+	return &blockResponse{mode: s, ip6: ip}, nil
+}
+
+func (b *blockResponse) reply(query *Message) *Message {
+	reply := NewReply(query)
+	if len(query.Questions) == 0 {
+		reply.Rcode = RcodeFormatError
+		return reply
+	}
+	q := query.Questions[0]
+	switch b.mode {
+	case BlockRefused:
+		reply.Rcode = RcodeRefused
+		return reply
+	case BlockNXDomain:
+		reply.Rcode = RcodeNameError
+	}
+	var ip net.IP
+	switch q.Type {
+	case TypeA:
+		ip = b.ip4
+	case TypeAAAA:
+		ip = b.ip6
+	}
+	if ip != nil {
+		reply.Answers = append(reply.Answers, NewIPRR(q.Name, ip, blockTTL))
+		return reply
+	}
+	reply.Authorities = append(reply.Authorities, negativeSOA(q.Name))
+	return reply
+}
+
+// negativeSOA make SOA record for negative answer of name, its minimum
+// is used by client as negative cache ttl.
+func negativeSOA(name string) RR {
+	return RR{Name: name, Type: TypeSOA, Class: ClassINET, TTL: blockTTL, Data: &SOAData{
+		MName:   blockSOAMName,
+		RName:   blockSOARName,
+		Serial:  1,
+		Refresh: blockTTL,
+		Retry:   blockTTL,
+		Expire:  blockTTL,
+		Minimum: blockTTL,
+	}}
+}
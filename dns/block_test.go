@@ -0,0 +1,67 @@
+package dns
+
+import (
+	"testing"
+
+	"snet/domaintrie"
+	"snet/logger"
+)
+
+func TestBlockResponse(t *testing.T) {
+	m := domaintrie.NewMatcher()
+	if err := m.Add("+.ads.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		mode    string
+		qtype   RType
+		rcode   uint8
+		answer  string
+		withSOA bool
+	}{
+		{"", TypeA, RcodeSuccess, "0.0.0.0", false},
+		{"zero", TypeAAAA, RcodeSuccess, "::", false},
+		{"zero", TypeMX, RcodeSuccess, "", true},
+		{"nxdomain", TypeA, RcodeNameError, "", true},
+		{"nodata", TypeAAAA, RcodeSuccess, "", true},
+		{"refused", TypeA, RcodeRefused, "", false},
+		{"10.0.0.1", TypeA, RcodeSuccess, "10.0.0.1", false},
+		{"10.0.0.1", TypeAAAA, RcodeSuccess, "", true},
+	} {
+		b, err := parseBlockResponse(c.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &DNS{blockHosts: m, blockResp: b, l: logger.NewLogger(logger.ERROR)}
+		resp, err := s.handle("127.0.0.1", GetDNSQuery("x.ads.com", c.qtype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := ParseMessage(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Rcode != c.rcode {
+			t.Error("unexpected rcode", c.mode, c.qtype, msg.Rcode)
+		}
+		if c.answer == "" && len(msg.Answers) != 0 || c.answer != "" && (len(msg.Answers) != 1 || msg.Answers[0].Data.String() != c.answer) {
+			t.Error("unexpected answers", c.mode, c.qtype, msg.Answers)
+		}
+		if !c.withSOA {
+			if len(msg.Authorities) != 0 {
+				t.Error("unexpected authorities", c.mode, c.qtype, msg.Authorities)
+			}
+			continue
+		}
+		if len(msg.Authorities) != 1 {
+			t.Fatal("SOA is expected", c.mode, c.qtype)
+		}
+		soa, ok := msg.Authorities[0].Data.(*SOAData)
+		if !ok || soa.Minimum != blockTTL {
+			t.Error("unexpected SOA", c.mode, c.qtype, msg.Authorities[0])
+		}
+	}
+	if _, err := parseBlockResponse("127.0.0"); err == nil {
+		t.Error("should fail for invalid ip")
+	}
+}
@@ -0,0 +1,208 @@
+package dns
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"snet/cache"
+	"snet/config"
+)
+
+const (
+	// ttl of stale answers, RFC 8767 recommends 30 seconds
+	staleTTL = 30
+	// stale answer is served if upstream doesn't answer in time, RFC 8767
+	// recommends 1.8 seconds
+	staleAnswerTimeout = 1800 * time.Millisecond
+)
+
+// UseCache apply cache size, stale window and per qtype partitions of
+// config to c and use it, cache of last server is kept on config reload.
+func (s *DNS) UseCache(c *cache.LRU) error {
+	if err := c.SetCapacity(s.cacheSize); err != nil {
+		return err
+	}
+	c.SetMaxStale(s.maxStale)
+	for qtype, p := range s.cachePolicies {
+		if p.Size > 0 {
+			if err := c.SetPartition(qtype, p.Size); err != nil {
+				return err
+			}
+		}
+	}
+	s.Cache = c
+	return nil
+}
+
+func normalizePolicies(policies map[string]config.QTypePolicy) map[string]config.QTypePolicy {
+	m := make(map[string]config.QTypePolicy, len(policies))
+	for qtype, p := range policies {
+		m[strings.ToUpper(qtype)] = p
+	}
+	return m
+}
+
+// ttlRange return ttl limit of qtype
+func (s *DNS) ttlRange(qtype RType) (minTTL, maxTTL uint32) {
+	minTTL, maxTTL = s.minTTL, s.maxTTL
+	p := s.cachePolicies[qtype.String()]
+	if p.MinTTL > 0 {
+		minTTL = p.MinTTL
+	}
+	if p.MaxTTL > 0 {
+		maxTTL = p.MaxTTL
+	}
+	return
+}
+
+// clampTTL limit ttl to [minTTL, maxTTL]
+func clampTTL(ttl, minTTL, maxTTL uint32) uint32 {
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// negativeTTL return ttl of negative answer(NXDOMAIN or NODATA), it's the
+// smaller one of SOA's ttl and minimum, RFC 2308. ok is false if there's no
+// SOA, such answer should not be cached.
+func negativeTTL(m *Message) (ttl uint32, ok bool) {
+	for _, rr := range m.Authorities {
+		if soa, isSOA := rr.Data.(*SOAData); isSOA {
+			ttl = rr.TTL
+			if soa.Minimum < ttl {
+				ttl = soa.Minimum
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// cached answer is stored with offsets of its ttls, so ttls are patched in
+// place when it's served instead of parsing and packing the message:
+//
+//	count(2) | offset(2) * count | message
+func packCached(raw []byte, f func(ttl uint32) uint32) ([]byte, error) {
+	offsets, err := ttlOffsets(raw)
+	if err != nil {
+		return nil, err
+	}
+	head := 2 + 2*len(offsets)
+	v := make([]byte, head+len(raw))
+	binary.BigEndian.PutUint16(v, uint16(len(offsets)))
+	for i, off := range offsets {
+		binary.BigEndian.PutUint16(v[2+2*i:], uint16(off))
+	}
+	copy(v[head:], raw)
+	return patchTTL(v, binary.BigEndian.Uint16(raw), f)
+}
+
+// unpackCached return message of cached answer v with dns id set to id and
+// ttl of records set by f
+func unpackCached(v []byte, id uint16, f func(ttl uint32) uint32) ([]byte, error) {
+	if len(v) < 2 || len(v) < 2+2*int(binary.BigEndian.Uint16(v))+headerLen {
+		return nil, errShortMsg
+	}
+	v, err := patchTTL(v, id, f)
+	if err != nil {
+		return nil, err
+	}
+	return v[2+2*int(binary.BigEndian.Uint16(v)):], nil
+}
+
+// patchTTL return copy of cached answer v with id and ttls set
+func patchTTL(v []byte, id uint16, f func(ttl uint32) uint32) ([]byte, error) {
+	n := int(binary.BigEndian.Uint16(v))
+	head := 2 + 2*n
+	p := make([]byte, len(v))
+	copy(p, v)
+	binary.BigEndian.PutUint16(p[head:], id)
+	for i := 0; i < n; i++ {
+		off := head + int(binary.BigEndian.Uint16(v[2+2*i:]))
+		if off+4 > len(p) {
+			return nil, errShortMsg
+		}
+		binary.BigEndian.PutUint32(p[off:], f(binary.BigEndian.Uint32(p[off:])))
+	}
+	return p, nil
+}
+
+// addCache cache upstream response, ttl of records are clamped, so
+// they can be decremented by elapsed time when served from cache.
+// Answers of qtype with its own size are added to partition of qtype.
+func (s *DNS) addCache(key string, raw []byte, msg *DNSMsg) {
+	if s.Cache == nil || len(raw) <= 2 || msg == nil {
+		return
+	}
+	ttl, ok := s.getCacheTime(msg)
+	if !ok {
+		return
+	}
+	minTTL, maxTTL := s.ttlRange(msg.QType)
+	v, err := packCached(raw, func(ttl uint32) uint32 {
+		return clampTTL(ttl, minTTL, maxTTL)
+	})
+	if err != nil {
+		s.l.Error("failed to cache dns response:", err)
+		return
+	}
+	s.Cache.AddTo(msg.QType.String(), key, v, ttl)
+}
+
+// getCache return cached response with decremented ttl for query data,
+// ttl of stale response is staleTTL. nil is returned on cache miss.
+func (s *DNS) getCache(key string, data []byte) (resp []byte, stale bool) {
+	if s.Cache == nil {
+		return nil, false
+	}
+	v, age, stale := s.Cache.GetStale(key)
+	cached, _ := v.([]byte)
+	if len(cached) <= 2 {
+		return nil, false
+	}
+	elapsed := uint32(age / time.Second)
+	id := uint16(data[0])<<8 | uint16(data[1])
+	resp, err := unpackCached(cached, id, func(ttl uint32) uint32 {
+		switch {
+		case stale:
+			return staleTTL
+		case ttl > elapsed:
+			return ttl - elapsed
+		}
+		return 0
+	})
+	if err != nil {
+		s.l.Error("invalid cached data", key, err)
+		return nil, false
+	}
+	return resp, stale
+}
+
+// getCacheTime return how long msg should be cached, ok is false if it
+// should not be cached: SERVFAIL and other errors, negative answers
+// without SOA, and qtype with no-cache policy.
+func (s *DNS) getCacheTime(msg *DNSMsg) (ttl time.Duration, ok bool) {
+	if s.cachePolicies[msg.QType.String()].NoCache || msg.Msg == nil {
+		return 0, false
+	}
+	var t uint32
+	switch msg.Msg.Rcode {
+	case RcodeSuccess:
+		if t, ok = msg.MinTTL(); !ok {
+			// NODATA
+			t, ok = negativeTTL(msg.Msg)
+		}
+	case RcodeNameError:
+		t, ok = negativeTTL(msg.Msg)
+	}
+	if !ok {
+		return 0, false
+	}
+	minTTL, maxTTL := s.ttlRange(msg.QType)
+	return time.Duration(clampTTL(t, minTTL, maxTTL)) * time.Second, true
+}
@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"snet/cache"
+	"snet/cidradix"
+	"snet/config"
+	"snet/logger"
+)
+
+// flakyUpstream answer with 1.2.3.4 after delay unless it's down
+type flakyUpstream struct {
+	down  bool
+	delay time.Duration
+}
+
+func (u *flakyUpstream) Exchange(data []byte) ([]byte, error) {
+	time.Sleep(u.delay)
+	if u.down {
+		return nil, errors.New("upstream is down")
+	}
+	return fakeAnswer(data), nil
+}
+
+func (u *flakyUpstream) String() string {
+	return "flaky"
+}
+
+func answerTTL(t *testing.T, resp []byte) uint32 {
+	m, err := ParseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) != 1 {
+		t.Fatal("unexpected answers", m.Answers)
+	}
+	return m.Answers[0].TTL
+}
+
+func TestServeStale(t *testing.T) {
+	tree, _ := cidradix.NewTreeFromCIDRs([]string{"1.2.3.0/24"})
+	c, _ := cache.NewLRU(10)
+	c.SetMaxStale(time.Hour)
+	u := &flakyUpstream{}
+	s := &DNS{cnUpstream: u, chnroutesTree: tree, Cache: c, maxTTL: 2, Stats: NewQueryStats(), l: logger.NewLogger(logger.ERROR)}
+	query := GetDNSQuery("a.com", TypeA)
+	resp, err := s.handle("127.0.0.1", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := answerTTL(t, resp); ttl != defaultAnswerTTL {
+		t.Error("ttl of upstream answer should not be changed", ttl)
+	}
+	u.down = true
+	time.Sleep(1100 * time.Millisecond)
+	resp, err = s.handle("127.0.0.1", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := answerTTL(t, resp); ttl != 1 {
+		t.Error("ttl should be clamped and decremented", ttl)
+	}
+	time.Sleep(time.Second)
+	resp, err = s.handle("127.0.0.1", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := answerTTL(t, resp); ttl != staleTTL {
+		t.Error("stale answer should be served", ttl)
+	}
+	u.down = false
+	resp, err = s.handle("127.0.0.1", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := answerTTL(t, resp); ttl != defaultAnswerTTL {
+		t.Error("fresh answer should be served when upstream is up", ttl)
+	}
+	// one reason is recorded per query
+	m := s.Stats.Snapshot(10, c.Len())
+	if m.Queries != 4 || m.Reasons[reasonCNNoCache] != 2 || m.Reasons[reasonCached] != 1 || m.Reasons[reasonStale] != 1 {
+		t.Error("unexpected reasons", m.Queries, m.Reasons)
+	}
+}
+
+func TestServeStaleSlowUpstream(t *testing.T) {
+	tree, _ := cidradix.NewTreeFromCIDRs([]string{"1.2.3.0/24"})
+	c, _ := cache.NewLRU(10)
+	c.SetMaxStale(time.Hour)
+	u := &flakyUpstream{}
+	s := &DNS{cnUpstream: u, chnroutesTree: tree, Cache: c, maxTTL: 1, Stats: NewQueryStats(), l: logger.NewLogger(logger.ERROR)}
+	query := GetDNSQuery("a.com", TypeA)
+	if _, err := s.handle("127.0.0.1", query); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	u.delay = staleAnswerTimeout + 500*time.Millisecond
+	start := time.Now()
+	resp, err := s.handle("127.0.0.1", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := answerTTL(t, resp); ttl != staleTTL {
+		t.Error("stale answer should be served", ttl)
+	}
+	if d := time.Since(start); d > staleAnswerTimeout+300*time.Millisecond {
+		t.Error("stale answer should not wait for upstream", d)
+	}
+	// refreshed in background
+	time.Sleep(time.Second)
+	qmsg, err := s.parse(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, stale := s.getCache(qmsg.CacheKey(), query); resp == nil || stale {
+		t.Error("answer should be refreshed in background")
+	}
+}
+
+func TestCacheTime(t *testing.T) {
+	s := &DNS{minTTL: 60, maxTTL: 3600, cachePolicies: normalizePolicies(map[string]config.QTypePolicy{
+		"txt": {NoCache: true},
+		"mx":  {MaxTTL: 120},
+	})}
+	soa := negativeSOA("a.com")
+	soa.TTL = 900
+	for _, c := range []struct {
+		qtype   RType
+		rcode   uint8
+		answers []RR
+		soa     bool
+		ttl     time.Duration
+		ok      bool
+	}{
+		{TypeA, RcodeSuccess, []RR{NewIPRR("a.com", net.ParseIP("1.1.1.1"), 10)}, false, 60, true},
+		{TypeA, RcodeSuccess, []RR{NewIPRR("a.com", net.ParseIP("1.1.1.1"), 86400)}, false, 3600, true},
+		{TypeAAAA, RcodeSuccess, nil, true, 900, true},
+		{TypeAAAA, RcodeSuccess, nil, false, 0, false},
+		{TypeA, RcodeNameError, nil, true, 900, true},
+		{TypeA, RcodeServerFailure, nil, true, 0, false},
+		{TypeTXT, RcodeSuccess, []RR{{Name: "a.com", Type: TypeTXT, Class: ClassINET, TTL: 300, Data: &TXTData{Texts: []string{"x"}}}}, false, 0, false},
+		{TypeMX, RcodeNameError, nil, true, 120, true},
+	} {
+		m := &Message{Header: Header{Response: true, Rcode: c.rcode}, Questions: []Question{{Name: "a.com", Type: c.qtype, Class: ClassINET}}, Answers: c.answers}
+		if c.soa {
+			m.Authorities = []RR{soa}
+		}
+		raw, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := NewDNSMsg(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ttl, ok := s.getCacheTime(msg)
+		if ok != c.ok || ttl != c.ttl*time.Second {
+			t.Error("unexpected cache time", c.qtype, c.rcode, ttl, ok)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package dns
+
+const (
+	// udp payload size without EDNS0, RFC 1035
+	minUDPSize = 512
+	// udp payload size advertised by snet and used as read buffer
+	ednsUDPSize = 4096
+	headerLen   = 12
+	flagTC      = 0x02 // truncated bit in the 3rd byte of header
+)
+
+// UDPPayloadSize return max udp response size client can accept,
+// advertised by OPT record in query, 512 if not present.
+func UDPPayloadSize(query []byte) int {
+	m, err := ParseMessage(query)
+	if err != nil {
+		return minUDPSize
+	}
+	return m.UDPSize()
+}
+
+// IsTruncated check TC bit of dns message
+func IsTruncated(msg []byte) bool {
+	return len(msg) > 2 && msg[2]&flagTC != 0
+}
+
+// Truncate return header and question of msg with TC bit set
+// if msg is larger than size, client should retry over tcp.
+func Truncate(msg []byte, size int) []byte {
+	if len(msg) <= size {
+		return msg
+	}
+	if m, err := ParseMessage(msg); err == nil {
+		t := &Message{Header: m.Header, Questions: m.Questions}
+		t.Truncated = true
+		if resp, err := t.Pack(); err == nil && len(resp) <= size {
+			return resp
+		}
+	}
+	// question is dropped too
+	resp := make([]byte, headerLen)
+	copy(resp, msg)
+	resp[2] |= flagTC
+	for i := 4; i < headerLen; i++ {
+		resp[i] = 0
+	}
+	return resp
+}
@@ -0,0 +1,87 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"snet/logger"
+)
+
+func TestUDPPayloadSize(t *testing.T) {
+	// baidu.com A query with OPT record, udp payload size 4096
+	query := []byte{
+		25, 190, 1, 32, 0, 1, 0, 0, 0, 0, 0, 1, 5, 98, 97, 105, 100, 117, 3, 99, 111, 109, 0, 0, 1, 0, 1, 0, 0, 41, 16, 0, 0, 0, 0, 0, 0, 12, 0, 10, 0, 8, 153, 50, 127, 128, 9, 66, 231, 17,
+	}
+	if size := UDPPayloadSize(query); size != 4096 {
+		t.Error("unexpected udp payload size", size)
+	}
+	if size := UDPPayloadSize(GetDNSQuery("baidu.com", RType(1))); size != minUDPSize {
+		t.Error("query without OPT should use 512, got", size)
+	}
+	if size := UDPPayloadSize(query[:30]); size != minUDPSize {
+		t.Error("bad query should use 512, got", size)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	query := GetDNSQuery("baidu.com", RType(1))
+	resp := GetDNSResp(query, "baidu.com", "1.2.3.4")
+	if got := Truncate(resp, minUDPSize); len(got) != len(resp) || IsTruncated(got) {
+		t.Error("small msg should not be truncated")
+	}
+	got := Truncate(resp, len(resp)-1)
+	if !IsTruncated(got) {
+		t.Fatal("TC bit should be set")
+	}
+	if IsTruncated(resp) {
+		t.Error("original msg should not be modified")
+	}
+	msg, err := NewDNSMsg(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.QDomain != "baidu.com" || msg.ANCount != 0 {
+		t.Error("truncated msg should keep question only", msg)
+	}
+}
+
+func TestServeTCP(t *testing.T) {
+	hostMap, _ := NewHostMap(map[string][]string{"a.com": {"1.2.3.4"}})
+	s := &DNS{hostMap: hostMap, l: logger.NewLogger(logger.ERROR)}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.serveTCP(ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	// multiple queries on one connection
+	for i := 0; i < 2; i++ {
+		if err := writeTCPMsg(conn, GetDNSQuery("a.com", RType(1))); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := NewDNSMsg(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.ARecords) != 1 || msg.ARecords[0].IP.String() != "1.2.3.4" {
+			t.Error("unexpected answer", msg)
+		}
+	}
+}
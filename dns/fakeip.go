@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// FakeIPPool allocate fake ipv4 addresses from a reserved range for
+// domains, and keep bidirectional mapping between them. When pool is
+// exhausted, ip of least recently used domain is recycled.
+type FakeIPPool struct {
+	ipnet   *net.IPNet
+	first   uint32 // first usable ip
+	size    uint32 // number of usable ips
+	next    uint32 // offset of next never allocated ip
+	deque   *list.List
+	domains map[string]*list.Element
+	ips     map[uint32]*list.Element
+	lock    sync.Mutex
+}
+
+type fakeIPEntry struct {
+	domain string
+	ip     uint32
+}
+
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ipnet.IP.To4() == nil {
+		return nil, errors.New("fake ip range should be ipv4: " + cidr)
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones < 2 || bits-ones > 24 {
+		return nil, errors.New("fake ip range should between /8 and /30: " + cidr)
+	}
+	return &FakeIPPool{
+		ipnet: ipnet,
+		// skip network and broadcast address
+		first:   binary.BigEndian.Uint32(ipnet.IP.To4()) + 1,
+		size:    1<<uint(bits-ones) - 2,
+		deque:   list.New(),
+		domains: make(map[string]*list.Element),
+		ips:     make(map[uint32]*list.Element),
+	}, nil
+}
+
+// Range return cidr of pool
+func (p *FakeIPPool) Range() string {
+	return p.ipnet.String()
+}
+
+// Contains check whether ip is in fake ip range
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	return p != nil && ip != nil && p.ipnet.Contains(ip)
+}
+
+// Get return fake ip of domain, allocate one if not exists
+func (p *FakeIPPool) Get(domain string) net.IP {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.domains[domain]; ok {
+		p.deque.MoveToFront(e)
+		return uint32ToIP(e.Value.(*fakeIPEntry).ip)
+	}
+	var ip uint32
+	if p.next < p.size {
+		ip = p.first + p.next
+		p.next++
+	} else {
+		// recycle least recently used one
+		e := p.deque.Back()
+		ent := e.Value.(*fakeIPEntry)
+		p.deque.Remove(e)
+		delete(p.domains, ent.domain)
+		delete(p.ips, ent.ip)
+		ip = ent.ip
+	}
+	e := p.deque.PushFront(&fakeIPEntry{domain: domain, ip: ip})
+	p.domains[domain] = e
+	p.ips[ip] = e
+	return uint32ToIP(ip)
+}
+
+// Lookup return domain of fake ip, empty if it's not allocated
+func (p *FakeIPPool) Lookup(ip net.IP) string {
+	if !p.Contains(ip) {
+		return ""
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.ips[binary.BigEndian.Uint32(ip.To4())]; ok {
+		p.deque.MoveToFront(e)
+		return e.Value.(*fakeIPEntry).domain
+	}
+	return ""
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
@@ -0,0 +1,50 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	if _, err := NewFakeIPPool("2001:db8::/64"); err == nil {
+		t.Error("ipv6 range should fail")
+	}
+	if _, err := NewFakeIPPool("198.18.0.0/31"); err == nil {
+		t.Error("too small range should fail")
+	}
+	// 2 usable ips: 198.18.0.1, 198.18.0.2
+	p, err := NewFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := p.Get("a.com")
+	b := p.Get("b.com")
+	if a.String() != "198.18.0.1" || b.String() != "198.18.0.2" {
+		t.Fatal("unexpected fake ip", a, b)
+	}
+	if !p.Get("a.com").Equal(a) {
+		t.Error("same domain should get same ip")
+	}
+	if p.Lookup(a) != "a.com" || p.Lookup(b) != "b.com" {
+		t.Error("lookup fake ip failed")
+	}
+	// a.com is used recently, b.com should be recycled
+	p.Lookup(a)
+	c := p.Get("c.com")
+	if !c.Equal(b) {
+		t.Error("least recently used ip should be recycled, got", c)
+	}
+	if p.Lookup(b) != "c.com" {
+		t.Error("recycled ip should map to new domain")
+	}
+	if !p.Contains(net.ParseIP("198.18.0.3")) || p.Contains(net.ParseIP("198.19.0.1")) {
+		t.Error("contains check failed")
+	}
+	if p.Lookup(net.ParseIP("198.18.0.3")) != "" {
+		t.Error("unallocated ip should have no domain")
+	}
+	var nilPool *FakeIPPool
+	if nilPool.Contains(a) {
+		t.Error("nil pool should contain nothing")
+	}
+}
@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+// max cname hops followed inside host map
+const maxCNAMEChain = 8
+
+// HostEntry is answers of a mapped host, either ips or a cname target
+type HostEntry struct {
+	IPv4  []net.IP
+	IPv6  []net.IP
+	CNAME string
+}
+
+// IPs return addresses answer qtype, nil for qtype other than A and AAAA
+func (e *HostEntry) IPs(qtype RType) []net.IP {
+	switch qtype {
+	case TypeA:
+		return e.IPv4
+	case TypeAAAA:
+		return e.IPv6
+	}
+	return nil
+}
+
+type wildcardHost struct {
+	suffix string // with leading dot
+	entry  *HostEntry
+}
+
+// HostMap answer dns query with static records, key is domain or wildcard
+// pattern like *.corp.local, which matches all subdomains of corp.local.
+// Exact domain is preferred, then the longest wildcard.
+type HostMap struct {
+	hosts     map[string]*HostEntry
+	wildcards []wildcardHost
+}
+
+// NewHostMap build host map, value of each domain is a list of ips or
+// a single cname target.
+func NewHostMap(m map[string][]string) (*HostMap, error) {
+	h := &HostMap{hosts: make(map[string]*HostEntry)}
+	for domain, values := range m {
+		entry, err := newHostEntry(values)
+		if err != nil {
+			return nil, errors.New("invalid host-map entry " + domain + ": " + err.Error())
+		}
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if strings.HasPrefix(domain, "*.") {
+			h.wildcards = append(h.wildcards, wildcardHost{suffix: domain[1:], entry: entry})
+			continue
+		}
+		if strings.Contains(domain, "*") || domain == "" {
+			return nil, errors.New("invalid host-map domain " + domain)
+		}
+		h.hosts[domain] = entry
+	}
+	sort.Slice(h.wildcards, func(i, j int) bool {
+		return len(h.wildcards[i].suffix) > len(h.wildcards[j].suffix)
+	})
+	return h, nil
+}
+
+func newHostEntry(values []string) (*HostEntry, error) {
+	if len(values) == 0 {
+		return nil, errors.New("empty value")
+	}
+	e := new(HostEntry)
+	for _, v := range values {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			if len(values) > 1 {
+				return nil, errors.New("cname can't be mixed with other values")
+			}
+			e.CNAME = strings.ToLower(strings.TrimSuffix(v, "."))
+		} else if ip4 := ip.To4(); ip4 != nil {
+			e.IPv4 = append(e.IPv4, ip4)
+		} else {
+			e.IPv6 = append(e.IPv6, ip)
+		}
+	}
+	return e, nil
+}
+
+// Lookup return entry of domain, nil if not mapped
+func (h *HostMap) Lookup(domain string) *HostEntry {
+	if h == nil {
+		return nil
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if e, ok := h.hosts[domain]; ok {
+		return e
+	}
+	for _, w := range h.wildcards {
+		if strings.HasSuffix(domain, w.suffix) {
+			return w.entry
+		}
+	}
+	return nil
+}
+
+// Answer follow cname chain in host map from domain, return records for
+// qtype and the last cname target which is not mapped, target is empty if
+// the chain ends in host map.
+func (h *HostMap) Answer(domain string, qtype RType) (answers []RR, target string, err error) {
+	name := domain
+	for i := 0; i < maxCNAMEChain; i++ {
+		e := h.Lookup(name)
+		if e == nil {
+			return answers, name, nil
+		}
+		if e.CNAME == "" {
+			for _, ip := range e.IPs(qtype) {
+				answers = append(answers, NewIPRR(name, ip, defaultAnswerTTL))
+			}
+			return answers, "", nil
+		}
+		answers = append(answers, RR{Name: name, Type: TypeCNAME, Class: ClassINET, TTL: defaultAnswerTTL, Data: &CNAMEData{Target: e.CNAME}})
+		if qtype == TypeCNAME {
+			return answers, "", nil
+		}
+		name = e.CNAME
+	}
+	return nil, "", errors.New("cname chain too long in host-map for " + domain)
+}
@@ -0,0 +1,102 @@
+package dns
+
+import (
+	"testing"
+
+	"snet/logger"
+)
+
+func TestHostMap(t *testing.T) {
+	h, err := NewHostMap(map[string][]string{
+		"a.com":          {"1.1.1.1", "2.2.2.2", "2001:db8::1"},
+		"*.corp.local":   {"10.0.0.1"},
+		"*.b.corp.local": {"10.0.0.2"},
+		"c.corp.local":   {"10.0.0.3"},
+		"alias.com":      {"a.com"},
+		"loop1.com":      {"loop2.com"},
+		"loop2.com":      {"loop1.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]string{
+		"A.com.":         "1.1.1.1",
+		"x.corp.local":   "10.0.0.1",
+		"x.y.corp.local": "10.0.0.1",
+		"x.b.corp.local": "10.0.0.2",
+		"c.corp.local":   "10.0.0.3",
+	} {
+		e := h.Lookup(domain)
+		if e == nil || e.IPv4[0].String() != want {
+			t.Error("unexpected entry for", domain, e)
+		}
+	}
+	if h.Lookup("corp.local") != nil || h.Lookup("b.com") != nil {
+		t.Error("should not match")
+	}
+
+	answers, target, err := h.Answer("a.com", TypeA)
+	if err != nil || target != "" || len(answers) != 2 {
+		t.Error("unexpected A answers", answers, target, err)
+	}
+	answers, _, _ = h.Answer("a.com", TypeAAAA)
+	if len(answers) != 1 || answers[0].Type != TypeAAAA || answers[0].Data.String() != "2001:db8::1" {
+		t.Error("unexpected AAAA answers", answers)
+	}
+	if answers, _, _ = h.Answer("a.com", TypeMX); len(answers) != 0 {
+		t.Error("MX query should get empty answer", answers)
+	}
+	answers, _, _ = h.Answer("alias.com", TypeA)
+	if len(answers) != 3 || answers[0].Type != TypeCNAME || answers[1].Name != "a.com" {
+		t.Error("cname should be followed", answers)
+	}
+	if _, _, err := h.Answer("loop1.com", TypeA); err == nil {
+		t.Error("cname loop should fail")
+	}
+
+	for _, bad := range []map[string][]string{
+		{"a.com": {}},
+		{"a.com": {"b.com", "1.1.1.1"}},
+		{"a.*.com": {"1.1.1.1"}},
+	} {
+		if _, err := NewHostMap(bad); err == nil {
+			t.Error("should fail for", bad)
+		}
+	}
+}
+
+func TestHandleHostMap(t *testing.T) {
+	h, _ := NewHostMap(map[string][]string{
+		"a.com":     {"1.1.1.1", "2001:db8::1"},
+		"alias.com": {"b.com"},
+		"b.com":     {"2.2.2.2"},
+	})
+	s := &DNS{hostMap: h, l: logger.NewLogger(logger.ERROR)}
+	for _, c := range []struct {
+		domain string
+		qtype  RType
+		want   []string
+	}{
+		{"a.com", TypeA, []string{"1.1.1.1"}},
+		{"a.com", TypeAAAA, []string{"2001:db8::1"}},
+		{"alias.com", TypeA, []string{"b.com", "2.2.2.2"}},
+		{"alias.com", TypeAAAA, []string{"b.com"}},
+	} {
+		resp, err := s.handle("127.0.0.1", GetDNSQuery(c.domain, c.qtype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ParseMessage(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Answers) != len(c.want) {
+			t.Fatal("unexpected answers for", c.domain, c.qtype, m.Answers)
+		}
+		for i, rr := range m.Answers {
+			if rr.Data.String() != c.want[i] {
+				t.Error("unexpected answer", &rr)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"net"
+	"time"
+
+	"snet/cache"
+)
+
+const (
+	ipDomainMapSize = 20000
+	// clients may cache answer longer than its ttl, keep mapping at least this long
+	ipDomainMinTTL = 10 * time.Minute
+)
+
+// IPDomainMap record ip to domain mapping from dns answers served to
+// clients, so connection to an ip can be routed by domain.
+// If multiple domains resolve to same ip, the latest one wins.
+type IPDomainMap struct {
+	lru *cache.LRU
+}
+
+func NewIPDomainMap() *IPDomainMap {
+	lru, _ := cache.NewLRU(ipDomainMapSize)
+	return &IPDomainMap{lru: lru}
+}
+
+func (m *IPDomainMap) Add(ip net.IP, domain string, ttl time.Duration) {
+	if m == nil || ip == nil || domain == "" {
+		return
+	}
+	if ttl < ipDomainMinTTL {
+		ttl = ipDomainMinTTL
+	}
+	m.lru.Add(ip.String(), domain, ttl)
+}
+
+// AddAnswer record all A/AAAA records in dns answer
+func (m *IPDomainMap) AddAnswer(msg *DNSMsg) {
+	if m == nil || msg == nil {
+		return
+	}
+	for _, r := range msg.ARecords {
+		m.Add(r.IP, msg.QDomain, time.Duration(r.TTL)*time.Second)
+	}
+}
+
+// Lookup return domain resolved to ip, empty if unknown
+func (m *IPDomainMap) Lookup(ip net.IP) string {
+	if m == nil || ip == nil {
+		return ""
+	}
+	if v := m.lru.Get(ip.String()); v != nil {
+		return v.(string)
+	}
+	return ""
+}
@@ -0,0 +1,27 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPDomainMap(t *testing.T) {
+	m := NewIPDomainMap()
+	m.AddAnswer(&DNSMsg{QDomain: "example.com", ARecords: []*ARecord{
+		{IP: net.ParseIP("1.1.1.1"), TTL: 1},
+		{IP: net.ParseIP("2001:db8::1"), TTL: 60},
+	}})
+	for _, ip := range []string{"1.1.1.1", "2001:db8::1"} {
+		if d := m.Lookup(net.ParseIP(ip)); d != "example.com" {
+			t.Error("unexpected domain for", ip, d)
+		}
+	}
+	if d := m.Lookup(net.ParseIP("1.1.1.2")); d != "" {
+		t.Error("unknown ip should have no domain, got", d)
+	}
+	var nilMap *IPDomainMap
+	nilMap.Add(net.ParseIP("1.1.1.1"), "example.com", 0)
+	if nilMap.Lookup(net.ParseIP("1.1.1.1")) != "" {
+		t.Error("nil map should return empty domain")
+	}
+}
@@ -0,0 +1,702 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	TypeA     RType = 1
+	TypeNS    RType = 2
+	TypeCNAME RType = 5
+	TypeSOA   RType = 6
+	TypePTR   RType = 12
+	TypeMX    RType = 15
+	TypeTXT   RType = 16
+	TypeAAAA  RType = 28
+	TypeSRV   RType = 33
+	TypeOPT   RType = 41
+)
+
+const ClassINET = 1
+
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3 // NXDOMAIN
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+const (
+	maxNameLen = 255
+	maxLabel   = 63
+	// a name can't have more labels than this, used to stop pointer loop
+	maxPointers = maxNameLen / 2
+)
+
+var (
+	errShortMsg   = errors.New("dns message too short")
+	errBadLabel   = errors.New("bad dns label")
+	errLongName   = errors.New("dns name too long")
+	errPtrLoop    = errors.New("too many dns name pointers")
+	errRDataRange = errors.New("dns rdata out of range")
+)
+
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
+	Rcode              uint8
+}
+
+func (h *Header) flags() uint16 {
+	f := uint16(h.Opcode&0xF)<<11 | uint16(h.Rcode&0xF)
+	for _, b := range []struct {
+		set bool
+		bit uint16
+	}{
+		{h.Response, 1 << 15}, {h.Authoritative, 1 << 10}, {h.Truncated, 1 << 9},
+		{h.RecursionDesired, 1 << 8}, {h.RecursionAvailable, 1 << 7},
+		{h.AuthenticData, 1 << 5}, {h.CheckingDisabled, 1 << 4},
+	} {
+		if b.set {
+			f |= b.bit
+		}
+	}
+	return f
+}
+
+func (h *Header) setFlags(f uint16) {
+	h.Response = f&(1<<15) != 0
+	h.Opcode = uint8(f>>11) & 0xF
+	h.Authoritative = f&(1<<10) != 0
+	h.Truncated = f&(1<<9) != 0
+	h.RecursionDesired = f&(1<<8) != 0
+	h.RecursionAvailable = f&(1<<7) != 0
+	h.AuthenticData = f&(1<<5) != 0
+	h.CheckingDisabled = f&(1<<4) != 0
+	h.Rcode = uint8(f & 0xF)
+}
+
+type Question struct {
+	Name  string
+	Type  RType
+	Class uint16
+}
+
+// RR is a resource record. For OPT record, Class is udp payload size
+// and TTL holds extended rcode and flags.
+type RR struct {
+	Name  string
+	Type  RType
+	Class uint16
+	TTL   uint32
+	Data  RData
+}
+
+func (r *RR) String() string {
+	return fmt.Sprintf("%s %d %s %s", r.Name, r.TTL, r.Type, r.Data)
+}
+
+// RData is parsed rdata of a resource record
+type RData interface {
+	pack(b *builder) error
+	String() string
+}
+
+type AData struct{ IP net.IP }
+type AAAAData struct{ IP net.IP }
+type CNAMEData struct{ Target string }
+type NSData struct{ Host string }
+type PTRData struct{ Ptr string }
+type MXData struct {
+	Preference uint16
+	Exchange   string
+}
+type TXTData struct{ Texts []string }
+type SRVData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+type SOAData struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+type OPTData struct{ Options []EDNSOption }
+
+// RawData hold rdata of unknown type as it is
+type RawData struct{ Data []byte }
+
+func (d *AData) String() string     { return d.IP.String() }
+func (d *AAAAData) String() string  { return d.IP.String() }
+func (d *CNAMEData) String() string { return d.Target }
+func (d *NSData) String() string    { return d.Host }
+func (d *PTRData) String() string   { return d.Ptr }
+func (d *MXData) String() string    { return fmt.Sprintf("%d %s", d.Preference, d.Exchange) }
+func (d *TXTData) String() string   { return strings.Join(d.Texts, " ") }
+func (d *SRVData) String() string {
+	return fmt.Sprintf("%d %d %d %s", d.Priority, d.Weight, d.Port, d.Target)
+}
+func (d *SOAData) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", d.MName, d.RName, d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum)
+}
+func (d *OPTData) String() string { return fmt.Sprintf("%d options", len(d.Options)) }
+func (d *RawData) String() string { return fmt.Sprintf("%x", d.Data) }
+
+type Message struct {
+	Header
+	Questions   []Question
+	Answers     []RR
+	Authorities []RR
+	Additionals []RR
+}
+
+// NewIPRR create A or AAAA record by ip's family
+func NewIPRR(name string, ip net.IP, ttl uint32) RR {
+	if ip4 := ip.To4(); ip4 != nil {
+		return RR{Name: name, Type: TypeA, Class: ClassINET, TTL: ttl, Data: &AData{IP: ip4}}
+	}
+	return RR{Name: name, Type: TypeAAAA, Class: ClassINET, TTL: ttl, Data: &AAAAData{IP: ip.To16()}}
+}
+
+// NewReply create an empty response for query, OPT record is added
+// if query support EDNS0.
+func NewReply(query *Message) *Message {
+	m := &Message{Header: Header{
+		ID:                 query.ID,
+		Response:           true,
+		Opcode:             query.Opcode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		CheckingDisabled:   query.CheckingDisabled,
+	}}
+	m.Questions = append(m.Questions, query.Questions...)
+	if query.EDNS() != nil {
+		m.SetEDNS0(ednsUDPSize)
+	}
+	return m
+}
+
+// EDNS return OPT record in additional section, nil if not present
+func (m *Message) EDNS() *RR {
+	for i := range m.Additionals {
+		if m.Additionals[i].Type == TypeOPT {
+			return &m.Additionals[i]
+		}
+	}
+	return nil
+}
+
+// SetEDNS0 add or update OPT record with udp payload size
+func (m *Message) SetEDNS0(size uint16) {
+	if opt := m.EDNS(); opt != nil {
+		opt.Class = size
+		return
+	}
+	m.Additionals = append(m.Additionals, RR{Name: "", Type: TypeOPT, Class: size, Data: &OPTData{}})
+}
+
+// UDPSize return max udp payload size advertised by EDNS0, 512 if not present
+func (m *Message) UDPSize() int {
+	if opt := m.EDNS(); opt != nil && int(opt.Class) > minUDPSize {
+		return int(opt.Class)
+	}
+	return minUDPSize
+}
+
+// ParseMessage parse wire format dns message, malformed message
+// returns error.
+func ParseMessage(msg []byte) (*Message, error) {
+	if len(msg) < headerLen {
+		return nil, errShortMsg
+	}
+	m := new(Message)
+	m.ID = binary.BigEndian.Uint16(msg[0:2])
+	m.setFlags(binary.BigEndian.Uint16(msg[2:4]))
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+	off := headerLen
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, errShortMsg
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  RType(binary.BigEndian.Uint16(msg[next:])),
+			Class: binary.BigEndian.Uint16(msg[next+2:]),
+		})
+		off = next + 4
+	}
+	sections := []*[]RR{&m.Answers, &m.Authorities, &m.Additionals}
+	for i, section := range sections {
+		for j := 0; j < counts[i+1]; j++ {
+			rr, next, err := readRR(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			*section = append(*section, rr)
+			off = next
+		}
+	}
+	return m, nil
+}
+
+// readName read a possibly compressed name at off, return name and
+// offset after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	next := -1
+	ptrs := 0
+	nameLen := 0
+	for {
+		if off >= len(msg) {
+			return "", 0, errShortMsg
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return sb.String(), next, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, errShortMsg
+			}
+			nameLen += c + 1
+			if nameLen > maxNameLen {
+				return "", 0, errLongName
+			}
+			label := msg[off+1 : off+1+c]
+			if bytes.IndexByte(label, '.') >= 0 {
+				// can't be told from label separator in name
+				return "", 0, errBadLabel
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.Write(label)
+			off += 1 + c
+		case 0xC0:
+			if off+2 > len(msg) {
+				return "", 0, errShortMsg
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			ptrs++
+			if ptrs > maxPointers {
+				return "", 0, errPtrLoop
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			return "", 0, errBadLabel
+		}
+	}
+}
+
+func readRR(msg []byte, off int) (RR, int, error) {
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return RR{}, 0, err
+	}
+	// type(2) + class(2) + ttl(4) + rdlength(2)
+	if off+10 > len(msg) {
+		return RR{}, 0, errShortMsg
+	}
+	rr := RR{
+		Name:  name,
+		Type:  RType(binary.BigEndian.Uint16(msg[off:])),
+		Class: binary.BigEndian.Uint16(msg[off+2:]),
+		TTL:   binary.BigEndian.Uint32(msg[off+4:]),
+	}
+	rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	end := off + rdlen
+	if end > len(msg) {
+		return RR{}, 0, errShortMsg
+	}
+	if rr.Data, err = readRData(msg, off, end, rr.Type); err != nil {
+		return RR{}, 0, err
+	}
+	return rr, end, nil
+}
+
+// skipName return offset after name at off without decoding it
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errShortMsg
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				return off + 1, nil
+			}
+			off += 1 + c
+		case 0xC0:
+			if off+2 > len(msg) {
+				return 0, errShortMsg
+			}
+			return off + 2, nil
+		default:
+			return 0, errBadLabel
+		}
+	}
+}
+
+// ttlOffsets return offsets of ttl of all records except OPT in msg
+func ttlOffsets(msg []byte) ([]int, error) {
+	if len(msg) < headerLen {
+		return nil, errShortMsg
+	}
+	off := headerLen
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		next, err := skipName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+	var offsets []int
+	for i := 1; i < 4; i++ {
+		for j := 0; j < int(binary.BigEndian.Uint16(msg[4+2*i:])); j++ {
+			next, err := skipName(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			if next+10 > len(msg) {
+				return nil, errShortMsg
+			}
+			if RType(binary.BigEndian.Uint16(msg[next:])) != TypeOPT {
+				offsets = append(offsets, next+4)
+			}
+			off = next + 10 + int(binary.BigEndian.Uint16(msg[next+8:]))
+		}
+	}
+	if off > len(msg) {
+		return nil, errShortMsg
+	}
+	return offsets, nil
+}
+
+// readRData parse rdata in msg[off:end], names in rdata may point to
+// anywhere before in msg.
+func readRData(msg []byte, off, end int, t RType) (RData, error) {
+	rdata := msg[off:end]
+	// name read from rdata, should not cross rdata boundary
+	name := func() (string, error) {
+		n, next, err := readName(msg[:end], off)
+		if err != nil {
+			return "", errRDataRange
+		}
+		off = next
+		return n, nil
+	}
+	u16 := func() (uint16, error) {
+		if off+2 > end {
+			return 0, errRDataRange
+		}
+		off += 2
+		return binary.BigEndian.Uint16(msg[off-2:]), nil
+	}
+	u32 := func() (uint32, error) {
+		if off+4 > end {
+			return 0, errRDataRange
+		}
+		off += 4
+		return binary.BigEndian.Uint32(msg[off-4:]), nil
+	}
+	var d RData
+	var err error
+	switch t {
+	case TypeA:
+		if len(rdata) != net.IPv4len {
+			return nil, errRDataRange
+		}
+		d = &AData{IP: net.IP(append([]byte(nil), rdata...))}
+	case TypeAAAA:
+		if len(rdata) != net.IPv6len {
+			return nil, errRDataRange
+		}
+		d = &AAAAData{IP: net.IP(append([]byte(nil), rdata...))}
+	case TypeCNAME:
+		r := new(CNAMEData)
+		r.Target, err = name()
+		d = r
+	case TypeNS:
+		r := new(NSData)
+		r.Host, err = name()
+		d = r
+	case TypePTR:
+		r := new(PTRData)
+		r.Ptr, err = name()
+		d = r
+	case TypeMX:
+		r := new(MXData)
+		if r.Preference, err = u16(); err == nil {
+			r.Exchange, err = name()
+		}
+		d = r
+	case TypeTXT:
+		r := new(TXTData)
+		for off < end {
+			l := int(msg[off])
+			if off+1+l > end {
+				return nil, errRDataRange
+			}
+			r.Texts = append(r.Texts, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+		d = r
+	case TypeSRV:
+		r := new(SRVData)
+		for _, f := range []*uint16{&r.Priority, &r.Weight, &r.Port} {
+			if *f, err = u16(); err != nil {
+				return nil, err
+			}
+		}
+		r.Target, err = name()
+		d = r
+	case TypeSOA:
+		r := new(SOAData)
+		if r.MName, err = name(); err != nil {
+			return nil, err
+		}
+		if r.RName, err = name(); err != nil {
+			return nil, err
+		}
+		for _, f := range []*uint32{&r.Serial, &r.Refresh, &r.Retry, &r.Expire, &r.Minimum} {
+			if *f, err = u32(); err != nil {
+				return nil, err
+			}
+		}
+		d = r
+	case TypeOPT:
+		r := new(OPTData)
+		for off < end {
+			code, err := u16()
+			if err != nil {
+				return nil, err
+			}
+			l, err := u16()
+			if err != nil {
+				return nil, err
+			}
+			if off+int(l) > end {
+				return nil, errRDataRange
+			}
+			r.Options = append(r.Options, EDNSOption{Code: code, Data: append([]byte(nil), msg[off:off+int(l)]...)})
+			off += int(l)
+		}
+		d = r
+	default:
+		return &RawData{Data: append([]byte(nil), rdata...)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// builder encode message with name compression
+type builder struct {
+	buf   []byte
+	names map[string]int
+}
+
+func (b *builder) u16(v uint16) {
+	b.buf = append(b.buf, byte(v>>8), byte(v))
+}
+
+func (b *builder) u32(v uint32) {
+	b.buf = append(b.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (b *builder) name(name string) error {
+	return b.writeName(name, true)
+}
+
+// writeName encode name, compress it by pointing to same suffix written before
+func (b *builder) writeName(name string, compress bool) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > maxNameLen-2 {
+		return errLongName
+	}
+	for name != "" {
+		key := strings.ToLower(name)
+		if off, ok := b.names[key]; ok && compress {
+			b.u16(0xC000 | uint16(off))
+			return nil
+		}
+		if len(b.buf) < 0x3FFF {
+			b.names[key] = len(b.buf)
+		}
+		label := name
+		name = ""
+		if i := strings.IndexByte(label, '.'); i >= 0 {
+			label, name = label[:i], label[i+1:]
+		}
+		if len(label) == 0 || len(label) > maxLabel {
+			return errBadLabel
+		}
+		b.buf = append(b.buf, byte(len(label)))
+		b.buf = append(b.buf, label...)
+	}
+	b.buf = append(b.buf, 0)
+	return nil
+}
+
+func (b *builder) rr(r *RR) error {
+	if err := b.name(r.Name); err != nil {
+		return err
+	}
+	b.u16(uint16(r.Type))
+	b.u16(r.Class)
+	b.u32(r.TTL)
+	lenOff := len(b.buf)
+	b.u16(0)
+	if r.Data != nil {
+		if err := r.Data.pack(b); err != nil {
+			return err
+		}
+	}
+	rdlen := len(b.buf) - lenOff - 2
+	if rdlen > 0xFFFF {
+		return errRDataRange
+	}
+	binary.BigEndian.PutUint16(b.buf[lenOff:], uint16(rdlen))
+	return nil
+}
+
+func (d *AData) pack(b *builder) error {
+	ip := d.IP.To4()
+	if ip == nil {
+		return errors.New("invalid ipv4 address " + d.IP.String())
+	}
+	b.buf = append(b.buf, ip...)
+	return nil
+}
+
+func (d *AAAAData) pack(b *builder) error {
+	ip := d.IP.To16()
+	if ip == nil {
+		return errors.New("invalid ipv6 address " + d.IP.String())
+	}
+	b.buf = append(b.buf, ip...)
+	return nil
+}
+
+func (d *CNAMEData) pack(b *builder) error { return b.name(d.Target) }
+func (d *NSData) pack(b *builder) error    { return b.name(d.Host) }
+func (d *PTRData) pack(b *builder) error   { return b.name(d.Ptr) }
+
+func (d *MXData) pack(b *builder) error {
+	b.u16(d.Preference)
+	return b.name(d.Exchange)
+}
+
+func (d *TXTData) pack(b *builder) error {
+	for _, t := range d.Texts {
+		if len(t) > 255 {
+			return errors.New("txt string too long")
+		}
+		b.buf = append(b.buf, byte(len(t)))
+		b.buf = append(b.buf, t...)
+	}
+	return nil
+}
+
+func (d *SRVData) pack(b *builder) error {
+	b.u16(d.Priority)
+	b.u16(d.Weight)
+	b.u16(d.Port)
+	// RFC 2782: target name must not be compressed
+	return b.writeName(d.Target, false)
+}
+
+func (d *SOAData) pack(b *builder) error {
+	if err := b.name(d.MName); err != nil {
+		return err
+	}
+	if err := b.name(d.RName); err != nil {
+		return err
+	}
+	for _, v := range []uint32{d.Serial, d.Refresh, d.Retry, d.Expire, d.Minimum} {
+		b.u32(v)
+	}
+	return nil
+}
+
+func (d *OPTData) pack(b *builder) error {
+	for _, o := range d.Options {
+		b.u16(o.Code)
+		b.u16(uint16(len(o.Data)))
+		b.buf = append(b.buf, o.Data...)
+	}
+	return nil
+}
+
+func (d *RawData) pack(b *builder) error {
+	b.buf = append(b.buf, d.Data...)
+	return nil
+}
+
+// Pack encode message to wire format with name compression
+func (m *Message) Pack() ([]byte, error) {
+	b := &builder{buf: make([]byte, headerLen, 512), names: make(map[string]int)}
+	binary.BigEndian.PutUint16(b.buf[0:], m.ID)
+	binary.BigEndian.PutUint16(b.buf[2:], m.flags())
+	for i, n := range []int{len(m.Questions), len(m.Answers), len(m.Authorities), len(m.Additionals)} {
+		if n > 0xFFFF {
+			return nil, errors.New("too many dns records")
+		}
+		binary.BigEndian.PutUint16(b.buf[4+2*i:], uint16(n))
+	}
+	for _, q := range m.Questions {
+		if err := b.name(q.Name); err != nil {
+			return nil, err
+		}
+		b.u16(uint16(q.Type))
+		b.u16(q.Class)
+	}
+	for _, section := range [][]RR{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			if err := b.rr(&section[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b.buf, nil
+}
@@ -0,0 +1,230 @@
+package dns
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func testMessage() *Message {
+	return &Message{
+		Header: Header{ID: 0x1234, Response: true, RecursionDesired: true, RecursionAvailable: true},
+		Questions: []Question{
+			{Name: "www.example.com", Type: TypeA, Class: ClassINET},
+		},
+		Answers: []RR{
+			{Name: "www.example.com", Type: TypeCNAME, Class: ClassINET, TTL: 60, Data: &CNAMEData{Target: "cdn.example.com"}},
+			{Name: "cdn.example.com", Type: TypeA, Class: ClassINET, TTL: 30, Data: &AData{IP: net.IP{1, 2, 3, 4}}},
+			{Name: "cdn.example.com", Type: TypeAAAA, Class: ClassINET, TTL: 30, Data: &AAAAData{IP: net.ParseIP("2001:db8::1")}},
+			{Name: "example.com", Type: TypeMX, Class: ClassINET, TTL: 300, Data: &MXData{Preference: 10, Exchange: "mail.example.com"}},
+			{Name: "example.com", Type: TypeTXT, Class: ClassINET, TTL: 300, Data: &TXTData{Texts: []string{"v=spf1 -all", ""}}},
+			{Name: "_sip._tcp.example.com", Type: TypeSRV, Class: ClassINET, TTL: 300, Data: &SRVData{Priority: 1, Weight: 2, Port: 5060, Target: "sip.example.com"}},
+			{Name: "4.3.2.1.in-addr.arpa", Type: TypePTR, Class: ClassINET, TTL: 300, Data: &PTRData{Ptr: "cdn.example.com"}},
+			{Name: "example.com", Type: RType(99), Class: ClassINET, TTL: 300, Data: &RawData{Data: []byte{1, 2, 3}}},
+		},
+		Authorities: []RR{
+			{Name: "example.com", Type: TypeNS, Class: ClassINET, TTL: 3600, Data: &NSData{Host: "ns1.example.com"}},
+			{Name: "example.com", Type: TypeSOA, Class: ClassINET, TTL: 3600, Data: &SOAData{
+				MName: "ns1.example.com", RName: "admin.example.com",
+				Serial: 2020010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 600,
+			}},
+		},
+		Additionals: []RR{
+			{Name: "", Type: TypeOPT, Class: 4096, Data: &OPTData{Options: []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}}}},
+		},
+	}
+}
+
+func TestMessagePackParse(t *testing.T) {
+	m := testMessage()
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Header, got.Header) || !reflect.DeepEqual(m.Questions, got.Questions) {
+		t.Error("header or question not match", got.Header, got.Questions)
+	}
+	for _, s := range [][2][]RR{{m.Answers, got.Answers}, {m.Authorities, got.Authorities}, {m.Additionals, got.Additionals}} {
+		if len(s[0]) != len(s[1]) {
+			t.Fatal("records number not match", s[1])
+		}
+		for i := range s[0] {
+			want, have := s[0][i], s[1][i]
+			if want.Name != have.Name || want.Type != have.Type || want.Class != have.Class || want.TTL != have.TTL {
+				t.Error("record not match", &want, &have)
+			}
+			if want.Data.String() != have.Data.String() {
+				t.Error("rdata not match", want.Data, have.Data)
+			}
+		}
+	}
+	if got.UDPSize() != 4096 {
+		t.Error("unexpected udp size", got.UDPSize())
+	}
+}
+
+func TestMessageCompression(t *testing.T) {
+	m := testMessage()
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := 0
+	for _, rrs := range [][]RR{m.Answers, m.Authorities, m.Additionals} {
+		for _, rr := range rrs {
+			size += len(rr.Name) + 2 + 10 + 20
+		}
+	}
+	if len(data) >= size {
+		t.Error("names should be compressed, size:", len(data))
+	}
+	// name should be case insensitive when compressed
+	m = &Message{Questions: []Question{{Name: "Example.COM", Type: TypeA, Class: ClassINET}},
+		Answers: []RR{{Name: "example.com", Type: TypeA, Class: ClassINET, Data: &AData{IP: net.IP{1, 1, 1, 1}}}}}
+	data, err = m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header + question(13 + 4) + answer(2 + 10 + 4)
+	if len(data) != headerLen+17+16 {
+		t.Error("unexpected compressed size", len(data))
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	data, err := testMessage().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every truncated message should fail rather than panic
+	for i := 0; i < len(data); i++ {
+		if _, err := ParseMessage(data[:i]); err == nil {
+			t.Error("truncated message should fail at", i)
+		}
+	}
+	cases := map[string][]byte{
+		"pointer loop": {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 1, 0, 1},
+		"bad label":    {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x80, 0, 0, 1, 0, 1},
+		"pointer out":  {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 0xff, 0, 1, 0, 1},
+		"dot in label": {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 3, 'a', '.', 'b', 0, 0, 1, 0, 1},
+		"bad A rdata": {0, 0, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0,
+			0, 0, 1, 0, 1, 0, 0, 0, 1, 0, 3, 1, 2, 3},
+		"cname out of rdata": {0, 0, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0,
+			0, 0, 5, 0, 1, 0, 0, 0, 1, 0, 2, 1, 'a', 0},
+	}
+	for name, b := range cases {
+		if _, err := ParseMessage(b); err == nil {
+			t.Error("should fail for", name)
+		}
+	}
+}
+
+func TestParseRandom(t *testing.T) {
+	data, err := testMessage().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	b := make([]byte, len(data))
+	for i := 0; i < 20000; i++ {
+		copy(b, data)
+		for j := r.Intn(8); j >= 0; j-- {
+			b[r.Intn(len(b))] = byte(r.Intn(256))
+		}
+		m, err := ParseMessage(b[:r.Intn(len(b)+1)])
+		if err != nil {
+			continue
+		}
+		if packed, err := m.Pack(); err == nil {
+			if _, err := ParseMessage(packed); err != nil {
+				t.Fatal("failed to parse packed message", err)
+			}
+		}
+	}
+}
+
+func TestMultiQuestion(t *testing.T) {
+	m := &Message{Questions: []Question{
+		{Name: "a.com", Type: TypeA, Class: ClassINET},
+		{Name: "b.com", Type: TypeAAAA, Class: ClassINET},
+	}}
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewDNSMsg(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.QDCount != 2 || msg.QDomain != "a.com" || msg.QType != TypeA {
+		t.Error("first question should be used", msg)
+	}
+}
+
+func TestGetDNSResp(t *testing.T) {
+	for _, c := range []struct {
+		qtype RType
+		ip    string
+		n     int
+	}{
+		{TypeA, "1.2.3.4", 1},
+		{TypeAAAA, "2001:db8::1", 1},
+		{TypeAAAA, "1.2.3.4", 0},
+		{TypeMX, "1.2.3.4", 0},
+	} {
+		resp := GetDNSResp(GetDNSQuery("a.com", c.qtype), "a.com", c.ip)
+		m, err := ParseMessage(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.Response || m.Rcode != RcodeSuccess || len(m.Answers) != c.n {
+			t.Error("unexpected response for", c.qtype, c.ip, m.Answers)
+		}
+		if c.n > 0 && (m.Answers[0].Type != c.qtype || m.Answers[0].Data.String() != c.ip) {
+			t.Error("unexpected answer", &m.Answers[0])
+		}
+	}
+	if m, err := ParseMessage(GetDNSResp([]byte{1, 2, 3}, "a.com", "1.2.3.4")); err != nil || m.Rcode != RcodeFormatError || m.ID != 0x0102 {
+		t.Error("bad query should get FORMERR", err)
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	data, err := testMessage().Pack()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add(GetDNSQuery("www.example.com", TypeA))
+	f.Add(GetDNSResp(GetDNSQuery("www.example.com", TypeA), "www.example.com", "1.2.3.4"))
+	f.Add([]byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 1, 0, 1})
+	f.Add([]byte{0, 0, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 5, 0, 1, 0, 0, 0, 1, 0, 2, 1, 'a', 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		NewDNSMsg(data)
+		UDPPayloadSize(data)
+		Truncate(data, minUDPSize)
+		m, err := ParseMessage(data)
+		if err != nil {
+			return
+		}
+		packed, err := m.Pack()
+		if err != nil {
+			return
+		}
+		m2, err := ParseMessage(packed)
+		if err != nil {
+			t.Fatal("failed to parse packed message", err)
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Errorf("round trip changed message\n%+v\n%+v", m, m2)
+		}
+		if _, err := ttlOffsets(packed); err != nil {
+			t.Error("failed to find ttl of packed message", err)
+		}
+	})
+}
@@ -6,12 +6,13 @@ import (
 	"fmt"
 	"net"
 	"reflect"
-	"runtime/debug"
-	"strings"
 )
 
 type RType uint16
 
+// ttl of answers made by GetDNSResp
+const defaultAnswerTTL = 100
+
 func (t RType) String() string {
 	switch t {
 	case 1:
@@ -33,6 +34,8 @@ func (t RType) String() string {
 		return "AAAA"
 	case 33:
 		return "SRV"
+	case 41:
+		return "OPT"
 	default:
 		return fmt.Sprintf("UNKNOWN %d", t)
 	}
@@ -47,8 +50,12 @@ func (a *ARecord) String() string {
 	return fmt.Sprintf("ip: %v, ttl: %d", a.IP, a.TTL)
 }
 
+// NewARecord create record for A(4 bytes ip) or AAAA(16 bytes ip) answer
 func NewARecord(ip []byte, ttl uint32) *ARecord {
-	return &ARecord{net.IPv4(ip[0], ip[1], ip[2], ip[3]), ttl}
+	if len(ip) == net.IPv4len {
+		return &ARecord{net.IPv4(ip[0], ip[1], ip[2], ip[3]), ttl}
+	}
+	return &ARecord{net.IP(append([]byte(nil), ip...)), ttl}
 }
 
 type DNSMsg struct {
@@ -59,7 +66,8 @@ type DNSMsg struct {
 	QDomain  string // query domain
 	QType    RType  // query type
 	QClass   uint16
-	ARecords []*ARecord // returned A record list
+	ARecords []*ARecord // returned A and AAAA record list
+	Msg      *Message   // the whole parsed message
 }
 
 func (m *DNSMsg) String() string {
@@ -71,69 +79,60 @@ func (m *DNSMsg) String() string {
 		t, m.ID, m.QDCount, m.ANCount, m.QDomain, m.QType, m.QClass, m.ARecords)
 }
 
+// GetEmptyDNSResp return a response without any answer for query
 func GetEmptyDNSResp(qdata []byte) []byte {
-	resp := qdata
-	// modify header to convert query to response
-	resp[2] = 0x81 // set QR bit to 1, means it's a response
-	resp[3] = 0x80
-	return resp
+	query, err := ParseMessage(qdata)
+	if err != nil {
+		return formatError(qdata)
+	}
+	return packReply(NewReply(query), qdata)
 }
 
+// GetDNSResp return a response with ip as the answer for query, the answer
+// is added only if ip's family matches query type(A for ipv4, AAAA for ipv6),
+// otherwise the response is empty.
 func GetDNSResp(qdata []byte, qdomain string, ip string) []byte {
-	labelLen := len(encodeDomain(qdomain))
-	answerOffset := 12 + labelLen + 4
-	// 16 is length of a single answer field: name pointer + type + class + ttl + len + ip
-	resp := make([]byte, answerOffset+16)
-	copy(resp, qdata[:answerOffset])
-	// modify header to convert query to response
-	resp[2] = 0x81 // set QR bit to 1, means it's a response
-	resp[3] = 0x80
-	resp[7] = 0x01  // set answer count field to 1
-	resp[9] = 0x00  // set authority rrs to 0
-	resp[11] = 0x00 // set additional rrs to 0
-	// make name pointer ref name in query field
-	resp[answerOffset] = 0xc0
-	resp[answerOffset+1] = 0x0c
-	// type A
-	resp[answerOffset+3] = 0x01
-	// class 1
-	resp[answerOffset+5] = 0x01
-	// tll 100
-	resp[answerOffset+9] = 0x64
-	// data len
-	resp[answerOffset+11] = 0x4
-	// ip addr
-	ipbytes := net.ParseIP(ip)
-	// for ipv4, net.IP use bytes 12-15
-	copy(resp[answerOffset+12:], ipbytes[12:])
+	query, err := ParseMessage(qdata)
+	if err != nil {
+		return formatError(qdata)
+	}
+	reply := NewReply(query)
+	if addr := net.ParseIP(ip); addr != nil && len(query.Questions) > 0 {
+		rr := NewIPRR(qdomain, addr, defaultAnswerTTL)
+		if rr.Type == query.Questions[0].Type {
+			reply.Answers = append(reply.Answers, rr)
+		}
+	}
+	return packReply(reply, qdata)
+}
+
+func packReply(reply *Message, qdata []byte) []byte {
+	resp, err := reply.Pack()
+	if err != nil {
+		return formatError(qdata)
+	}
 	return resp
 }
 
-func encodeDomain(qdomain string) []byte {
-	data := make([]byte, 0, len(qdomain))
-	for _, label := range strings.Split(qdomain, ".") {
-		data = append(data, byte(len(label)))
-		data = append(data, []byte(label)...)
+// formatError return header only response with FORMERR rcode
+func formatError(qdata []byte) []byte {
+	h := Header{Response: true, RecursionAvailable: true, Rcode: RcodeFormatError}
+	if len(qdata) >= 2 {
+		h.ID = binary.BigEndian.Uint16(qdata)
 	}
-	data = append(data, 0x00) // domain should endswith 0x00
-	return data
+	resp, _ := (&Message{Header: h}).Pack()
+	return resp
 }
 
 func GetDNSQuery(qdomain string, qtype RType) []byte {
-	d := encodeDomain(qdomain)
-	data := []byte{
-		0x25, 0x01, // id
-		0x01, 0x00, // flags, only set `do query recursively`
-		0x00, 0x01, // questions
-		0x00, 0x00, // answer rrs
-		0x00, 0x00, // authority rrs
-		0x00, 0x00, // additional rrs
+	m := &Message{
+		Header:    Header{ID: 0x2501, RecursionDesired: true},
+		Questions: []Question{{Name: qdomain, Type: qtype, Class: ClassINET}},
+	}
+	data, err := m.Pack()
+	if err != nil {
+		return nil
 	}
-	data = append(data, d...)
-	record := make([]byte, 2)
-	binary.BigEndian.PutUint16(record, uint16(qtype))
-	data = append(data, record...)
-	data = append(data, []byte{0x00, 0x01}...) // class IN
 	return data
 }
 
@@ -183,124 +182,49 @@ func (m *DNSMsg) CacheKey() string {
 	return fmt.Sprintf("%s:%d", m.QDomain, m.QType)
 }
 
-func NewDNSMsg(data []byte) (msg *DNSMsg, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Println("Recoverd in dns handle:\n", string(debug.Stack()))
-			fmt.Println("error:", r, "data:", data)
-			var ok bool
-			err, ok = r.(error)
-			if !ok {
-				err = fmt.Errorf("dns msg parse error: %v", r)
+// NewDNSMsg parse dns message, only the first question is used if there
+// are many.
+func NewDNSMsg(data []byte) (*DNSMsg, error) {
+	m, err := ParseMessage(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns msg: %v", err)
+	}
+	if len(m.Questions) == 0 {
+		return nil, errors.New("no question in dns msg")
+	}
+	msg := &DNSMsg{
+		ID:       m.ID,
+		QDCount:  uint16(len(m.Questions)),
+		ANCount:  uint16(len(m.Answers)),
+		QDomain:  m.Questions[0].Name,
+		QType:    m.Questions[0].Type,
+		QClass:   m.Questions[0].Class,
+		ARecords: []*ARecord{},
+		Msg:      m,
+	}
+	if m.Response {
+		msg.qr = 1
+		for _, rr := range m.Answers {
+			switch d := rr.Data.(type) {
+			case *AData:
+				msg.ARecords = append(msg.ARecords, NewARecord(d.IP, rr.TTL))
+			case *AAAAData:
+				msg.ARecords = append(msg.ARecords, NewARecord(d.IP, rr.TTL))
 			}
 		}
-	}()
-	if len(data) < 12 {
-		return nil, fmt.Errorf("invalid dns msg: %v", data)
 	}
-	id := binary.BigEndian.Uint16(data[:2])
-	isAnswer := false
-	if data[2]&0x80 == 0x80 {
-		isAnswer = true
-	}
-	qdcount := binary.BigEndian.Uint16(data[4:6])
-	// multi query is allowed(qdcount >1), but I didn't see this in real life(just don't handle it)!
-	if qdcount > 1 {
-		return nil, errors.New("mutil query in a dns message found")
-	}
-	ancount := binary.BigEndian.Uint16(data[6:8])
-	body := data[12:]
-	if len(body) == 0 {
-		return nil, errors.New("bad dns msg")
-	}
-	queryDomainLabels := []string{}
-	var qtype uint16
-	var qclass uint16
-	for {
-		// parse question
-		offset := 0
-		labelLen := int(body[0])
-		offset++ // 1 byte label length
-		label := body[offset : offset+labelLen]
-		offset += labelLen
-		queryDomainLabels = append(queryDomainLabels, string(label))
-		if body[offset+1] == 0x0 {
-			// finish parse question domain
-			body = body[offset+1:]
-			qtype = binary.BigEndian.Uint16(body[:2])
-			body = body[2:]
-			qclass = binary.BigEndian.Uint16(body[:2])
-			body = body[2:]
-			break
-		}
-		// continue to next label
-		body = body[offset:]
+	return msg, nil
+}
+
+// MinTTL return the minimum ttl of answers, ok is false if there is no answer
+func (m *DNSMsg) MinTTL() (ttl uint32, ok bool) {
+	if m.Msg == nil {
+		return 0, false
 	}
-	queryDomain := strings.Join(queryDomainLabels, ".")
-	arecords := []*ARecord{}
-	if isAnswer {
-		if len(body) == 0 {
-			return &DNSMsg{ID: id, QDCount: qdcount, ANCount: ancount, qr: 1,
-				QDomain: queryDomain, QType: RType(qtype), QClass: qclass, ARecords: arecords}, nil
+	for i, rr := range m.Msg.Answers {
+		if i == 0 || rr.TTL < ttl {
+			ttl = rr.TTL
 		}
-		// parse answer
-		if len(body) < 12 {
-			// at least Pointer(2) + Type(2) + Class(2) + TTL(4) + RLEN(2) = 12
-			return nil, errors.New("Bad answer message")
-		}
-		for i := 0; i < int(ancount); i++ {
-			if len(body) == 0 {
-				continue
-			}
-			// check leading two bits, should be '00' or '11'
-			switch body[0] & 0xC0 {
-			case 0x0:
-				// skip uncompressed domain labels, useless in answer
-				for {
-					if body[0]&0xC0 == 0xC0 {
-						body = body[2:]
-						continue
-					}
-					if body[0] == 0x0 {
-						break
-					}
-					c1 := body[0]
-					body = body[int(c1)+1:]
-				}
-			case 0xC0:
-				body = body[2:] // leading '11' bits means it's a pointer to existing label
-			default:
-				// 0x80 and 0x40 are reversed bits, shouldn't appear here
-				return nil, errors.New("bad message")
-			}
-			atype := RType(binary.BigEndian.Uint16(body[:2]))
-			body = body[4:] // skip TYPE + CLASS
-			ttl := binary.BigEndian.Uint32(body[:4])
-			body = body[4:] // skip ttl
-			rdLen := binary.BigEndian.Uint16(body[:2])
-			body = body[2:] // skip rdLen
-			if atype.String() != "A" {
-				// skip bad msg
-				if int(rdLen) >= len(body) {
-					continue
-				}
-				// only intereseted in A type, skip left rdata for other records
-				body = body[rdLen:]
-				continue
-			}
-			rdata := body[:rdLen]
-			arecords = append(arecords, NewARecord(rdata, ttl))
-			body = body[rdLen:] // skip rdata
-		}
-	}
-	qr := 0
-	if isAnswer {
-		qr = 1
 	}
-	return &DNSMsg{
-		ID: id, QDCount: qdcount, ANCount: ancount,
-		qr:      qr,
-		QDomain: queryDomain,
-		QType:   RType(qtype), QClass: qclass,
-		ARecords: arecords}, err
+	return ttl, len(m.Msg.Answers) > 0
 }
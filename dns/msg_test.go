@@ -43,3 +43,23 @@ func TestDMSMsg(t *testing.T) {
 		t.Error("Invalid resp msg", err)
 	}
 }
+
+func TestDNSMsgAAAA(t *testing.T) {
+	// google.com's AAAA record response
+	resp := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0,
+		6, 'g', 'o', 'o', 'g', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 28, 0, 1,
+		0xc0, 0x0c, 0, 28, 0, 1, 0, 0, 1, 44, 0, 16,
+		0x24, 0x04, 0x68, 0x00, 0x40, 0x05, 0x08, 0x0a, 0, 0, 0, 0, 0, 0, 0x20, 0x0e,
+	}
+	msg, err := NewDNSMsg(resp)
+	if err != nil {
+		t.Fatal("Failed to parse resp msg", err)
+	}
+	if msg.QType.String() != "AAAA" {
+		t.Error("invalid qtype", msg.QType)
+	}
+	if len(msg.ARecords) != 1 || msg.ARecords[0].IP.String() != "2404:6800:4005:80a::200e" || msg.ARecords[0].TTL != 300 {
+		t.Error("invalid AAAA records", msg.ARecords)
+	}
+}
@@ -1,10 +1,11 @@
 package dns
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -13,43 +14,58 @@ import (
 	"sync"
 	"time"
 
-	"snet/bloomfilter"
 	"snet/cache"
 	"snet/cidradix"
 	"snet/config"
+	"snet/domaintrie"
 	"snet/logger"
+	"snet/rule"
 	"snet/utils"
 )
 
 const (
-	dnsPort              = 53
-	dnsTimeout           = 5
-	cacheSize            = 5000
-	defaultTTL           = 300 // used to cache empty A records
-	bloomfilterErrorRate = 0.00001
+	dnsPort        = 53
+	dnsTimeout     = 5
+	defaultTTL     = 300 // ttl of ip to domain mapping of host map answers
+	tcpIdleTimeout = 10  // close idle tcp client connection after seconds
 )
 
 type DNS struct {
-	udpAddr              *net.UDPAddr
-	udpListener          *net.UDPConn
-	cnDNS                string
-	fqDNS                string
-	enforceTTL           uint32
-	disableQTypes        []string
-	forceFQ              []string
-	hostMap              map[string]string
-	blockHostsBF         *bloomfilter.Bloomfilter
-	blockHosts           []string
-	additionalBlockHosts []string
-	chnroutesTree        *cidradix.Tree
-	prefetchEnable       bool
-	prefetchCount        int
-	prefetchInterval     int
-	dnsLoggingFile       string
-	dnsLogger            *log.Logger
-	Cache                *cache.LRU
-	ctx                  context.Context
-	l                    *logger.Logger
+	udpAddrs         []*net.UDPAddr
+	udpListeners     []*net.UDPConn
+	tcpListeners     []*net.TCPListener
+	cnDNS            string
+	fqDNS            string
+	cnUpstream       Upstream // DoH/DoT cn dns, nil for plain dns
+	fqUpstream       Upstream // DoH/DoT fq dns, nil for plain dns
+	minTTL           uint32   // ttl of cached answers are clamped to [minTTL, maxTTL]
+	maxTTL           uint32
+	maxStale         time.Duration
+	cacheSize        int
+	cachePolicies    map[string]config.QTypePolicy // key is upper case qtype
+	disableQTypes    []string
+	rules            *rule.Rules
+	hostMap          *HostMap
+	blockHostFile    string
+	blockHostRules   []string
+	blockHosts       *domaintrie.Matcher
+	blockLock        sync.RWMutex
+	blockResp        *blockResponse
+	chnroutesTree    *cidradix.Tree
+	prefetchEnable   bool
+	prefetchCount    int
+	prefetchInterval int
+	dnsLoggingFile   string
+	dnsLogger        *log.Logger
+	Cache            *cache.LRU
+	IPDomains        *IPDomainMap // record ip to domain mapping of served answers
+	FakeIPs          *FakeIPPool  // answer A query with fake ip if set
+	Stats            *QueryStats  // collect query statistics if set
+	ProxyDial        DialFunc     // dial DoH/DoT fq dns through proxy
+	DirectDial       DialFunc     // dial DoH/DoT cn dns bypass snet
+	ready            chan struct{}
+	ctx              context.Context
+	l                *logger.Logger
 }
 
 const (
@@ -57,86 +73,112 @@ const (
 	reasonDisabled  = "disabled"
 	reasonBlocked   = "blocked"
 	reasonCached    = "cached"
+	reasonStale     = "stale"
 	reasonCNNoCache = "cn-nocache"
 	reasonFQNoCache = "fq-nocache"
+	reasonFakeIP    = "fake-ip"
 )
 
-func NewServer(ctx context.Context, c *config.Config, dnsPort int, chnroutes []string, l *logger.Logger) (*DNS, error) {
-	laddr := fmt.Sprintf("%s:%d", c.LHost, dnsPort)
-	uaddr, err := net.ResolveUDPAddr("udp", laddr)
+func NewServer(ctx context.Context, c *config.Config, dnsPort int, chnroutes *cidradix.Tree, rules *rule.Rules, l *logger.Logger) (*DNS, error) {
+	var uaddrs []*net.UDPAddr
+	for _, host := range c.ListenHosts() {
+		uaddr, err := net.ResolveUDPAddr(utils.IPNetwork("udp", host), net.JoinHostPort(host, strconv.Itoa(dnsPort)))
+		if err != nil {
+			return nil, err
+		}
+		uaddrs = append(uaddrs, uaddr)
+	}
+	var err error
+	blockHosts, err := newBlockMatcher(c.BlockHostFile, c.BlockHosts, nil, l)
 	if err != nil {
 		return nil, err
 	}
-	var cl *cache.LRU
-	if c.EnableDNSCache {
-		cl, err = cache.NewLRU(cacheSize)
-		if err != nil {
+	blockResp, err := parseBlockResponse(c.BlockResponse)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string][]string, len(c.HostMap))
+	for domain, v := range c.HostMap {
+		hosts[domain] = v
+	}
+	hostMap, err := NewHostMap(hosts)
+	if err != nil {
+		return nil, err
+	}
+	s := &DNS{
+		ready:            make(chan struct{}),
+		udpAddrs:         uaddrs,
+		cnDNS:            c.CNDNS,
+		fqDNS:            c.FQDNS,
+		minTTL:           c.DNSMinTTL,
+		maxTTL:           c.DNSMaxTTL,
+		maxStale:         time.Duration(c.DNSMaxStale) * time.Second,
+		cacheSize:        c.DNSCacheSize,
+		cachePolicies:    normalizePolicies(c.DNSCachePolicy),
+		disableQTypes:    c.DisableQTypes,
+		rules:            rules,
+		hostMap:          hostMap,
+		blockHostFile:    c.BlockHostFile,
+		blockHostRules:   c.BlockHosts,
+		blockHosts:       blockHosts,
+		blockResp:        blockResp,
+		chnroutesTree:    chnroutes,
+		prefetchEnable:   c.DNSPrefetchEnable,
+		prefetchCount:    c.DNSPrefetchCount,
+		prefetchInterval: c.DNSPrefetchInterval,
+		dnsLoggingFile:   c.DNSLoggingFile,
+		ctx:              ctx,
+		l:                l,
+	}
+	// DoH/DoT upstream, cn dns is dialed directly, fq dns through proxy,
+	// which resolves host of fq dns by itself. Host of cn dns is resolved
+	// by bootstrap dns.
+	if !IsPlainDNS(c.CNDNS) {
+		if net.ParseIP(c.BootstrapDNS) == nil {
+			return nil, errors.New("bootstrap-dns should be an ip: " + c.BootstrapDNS)
+		}
+		dial := newBootstrapDialer(s.dialDirect, c.BootstrapDNS).Dial
+		if s.cnUpstream, err = NewUpstream(c.CNDNS, dial); err != nil {
 			return nil, err
 		}
 	}
-	var bf *bloomfilter.Bloomfilter
-	lines := []string{}
-	if c.BlockHostFile != "" {
-		f, err := os.Open(c.BlockHostFile)
-		if err != nil {
+	if !IsPlainDNS(c.FQDNS) {
+		if s.fqUpstream, err = NewUpstream(c.FQDNS, s.dialProxy); err != nil {
 			return nil, err
 		}
-		defer f.Close()
-		scanner := bufio.NewScanner(f)
-		now := time.Now()
-		for scanner.Scan() {
-			l := strings.TrimSpace(scanner.Text())
-			if strings.HasPrefix(l, "#") {
-				continue
-			}
-			lines = append(lines, l)
-		}
-		bf, err = bloomfilter.NewBloomfilter(len(lines), bloomfilterErrorRate)
+	}
+	if c.EnableDNSCache {
+		cl, err := cache.NewLRU(c.DNSCacheSize)
 		if err != nil {
 			return nil, err
 		}
-		l.Debugf("bloomfilter array size %dKB", bf.Size()/1024)
-		// init bf
-		count := 0
-		for _, line := range lines {
-			bf.Add([]byte(line))
-			count++
-		}
-		l.Debugf("load ad hosts %d lines, cost: %v", count, time.Now().Sub(now))
-	}
-	// build radix tree for cidr
-	tree := cidradix.NewTree()
-	for _, route := range chnroutes {
-		_, ipnet, err := net.ParseCIDR(route)
-		if err != nil {
+		if err := s.UseCache(cl); err != nil {
 			return nil, err
 		}
-		tree.AddCIDR(ipnet)
-	}
-	return &DNS{
-		udpAddr:              uaddr,
-		cnDNS:                c.CNDNS,
-		fqDNS:                c.FQDNS,
-		enforceTTL:           c.EnforceTTL,
-		disableQTypes:        c.DisableQTypes,
-		forceFQ:              c.ForceFQ,
-		hostMap:              c.HostMap,
-		blockHostsBF:         bf,
-		blockHosts:           lines,
-		additionalBlockHosts: c.BlockHosts,
-		chnroutesTree:        tree,
-		Cache:                cl,
-		prefetchEnable:       c.DNSPrefetchEnable,
-		prefetchCount:        c.DNSPrefetchCount,
-		prefetchInterval:     c.DNSPrefetchInterval,
-		dnsLoggingFile:       c.DNSLoggingFile,
-		ctx:                  ctx,
-		l:                    l,
-	}, nil
+	}
+	return s, nil
+}
+
+func (s *DNS) dialDirect(network, addr string) (net.Conn, error) {
+	if s.DirectDial != nil {
+		return s.DirectDial(network, addr)
+	}
+	return net.DialTimeout(network, addr, dnsTimeout*time.Second)
+}
+
+func (s *DNS) dialProxy(network, addr string) (net.Conn, error) {
+	if s.ProxyDial != nil {
+		return s.ProxyDial(network, addr)
+	}
+	return net.DialTimeout(network, addr, dnsTimeout*time.Second)
+}
+
+// Ready return a channel closed when Run is listening on all addresses
+func (s *DNS) Ready() <-chan struct{} {
+	return s.ready
 }
 
 func (s *DNS) Run() error {
-	var err error
 	if s.dnsLoggingFile != "" {
 		s.l.Info("dns query logged in ", s.dnsLoggingFile)
 		f, err := os.OpenFile(s.dnsLoggingFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
@@ -145,55 +187,167 @@ func (s *DNS) Run() error {
 		}
 		s.dnsLogger = log.New(f, "", log.LstdFlags)
 	}
-	s.udpListener, err = net.ListenUDP("udp", s.udpAddr)
-	if err != nil {
-		return err
+	for _, uaddr := range s.udpAddrs {
+		ln, err := net.ListenUDP(uaddr.Network(), uaddr)
+		if err != nil {
+			return err
+		}
+		s.l.Info("DNS server listen on udp:", uaddr)
+		defer ln.Close()
+		s.udpListeners = append(s.udpListeners, ln)
+		taddr := &net.TCPAddr{IP: uaddr.IP, Port: uaddr.Port, Zone: uaddr.Zone}
+		tln, err := net.ListenTCP(utils.IPNetwork("tcp", uaddr.IP.String()), taddr)
+		if err != nil {
+			return err
+		}
+		s.l.Info("DNS server listen on tcp:", taddr)
+		defer tln.Close()
+		s.tcpListeners = append(s.tcpListeners, tln)
 	}
-	s.l.Info("DNS server listen on udp:", s.udpAddr)
-	defer s.udpListener.Close()
+	close(s.ready)
 	if s.Cache != nil && s.prefetchEnable {
 		s.l.Info("Starting dns prefetch ticker")
 		go s.prefetchTicker()
 	}
+	errCh := make(chan error, len(s.udpListeners)+len(s.tcpListeners))
+	for _, ln := range s.udpListeners {
+		go func(ln *net.UDPConn) {
+			errCh <- s.serveUDP(ln)
+		}(ln)
+	}
+	for _, ln := range s.tcpListeners {
+		go func(ln *net.TCPListener) {
+			errCh <- s.serveTCP(ln)
+		}(ln)
+	}
+	return <-errCh
+}
+
+func (s *DNS) serveUDP(ln *net.UDPConn) error {
 	for {
-		b := make([]byte, 1024)
-		n, uaddr, err := s.udpListener.ReadFromUDP(b)
+		b := make([]byte, ednsUDPSize)
+		n, uaddr, err := ln.ReadFromUDP(b)
 		if err != nil {
 			return err
 		}
 		go func(uaddr *net.UDPAddr, data []byte) {
-			err := s.handle(uaddr, data)
+			resp, err := s.handle(uaddr.IP.String(), data)
 			if err != nil {
 				s.l.Error(err)
+				return
+			}
+			// answer larger than client's udp payload size is truncated,
+			// client should retry over tcp
+			resp = Truncate(resp, UDPPayloadSize(data))
+			if _, err := ln.WriteToUDP(resp, uaddr); err != nil {
+				s.l.Error(err)
 			}
 		}(uaddr, b[:n])
 	}
 }
 
+func (s *DNS) serveTCP(ln *net.TCPListener) error {
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return err
+		}
+		go func(conn *net.TCPConn) {
+			defer conn.Close()
+			src := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+			b := make([]byte, 2)
+			for {
+				// client may send multiple queries on one connection
+				conn.SetDeadline(time.Now().Add(tcpIdleTimeout * time.Second))
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+				data := make([]byte, binary.BigEndian.Uint16(b))
+				if _, err := io.ReadFull(conn, data); err != nil {
+					return
+				}
+				resp, err := s.handle(src, data)
+				if err != nil {
+					s.l.Error(err)
+					return
+				}
+				if err := writeTCPMsg(conn, resp); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
 func (s *DNS) Shutdown() error {
-	if err := s.udpListener.Close(); err != nil {
-		return err
+	for _, ln := range s.udpListeners {
+		if err := ln.Close(); err != nil {
+			return err
+		}
+	}
+	for _, ln := range s.tcpListeners {
+		if err := ln.Close(); err != nil {
+			return err
+		}
 	}
 	s.l.Info("dns server shutdown")
 	return nil
 }
 
 func (s *DNS) badDomain(domain string) bool {
-	if utils.DomainMatch(domain, s.additionalBlockHosts) {
-		return true
+	s.blockLock.RLock()
+	defer s.blockLock.RUnlock()
+	return s.blockHosts.Match(domain)
+}
+
+// SetBlockLists rebuild blocked hosts with extra lists(eg: downloaded from
+// remote), patterns from block-host-file and block-hosts are kept.
+func (s *DNS) SetBlockLists(lists [][]byte) error {
+	m, err := newBlockMatcher(s.blockHostFile, s.blockHostRules, lists, s.l)
+	if err != nil {
+		return err
 	}
-	// For good domain, bloomfilter can reduce lookup time
-	// from 80us -> 1us. For bad domain, lookup time will increase
-	// about 1us, worth the effort.
-	if s.blockHostsBF != nil && s.blockHostsBF.Has([]byte(domain)) {
-		// fallback to full scan, since bloomfilter has error rate
-		for _, host := range s.blockHosts {
-			if host == domain {
-				return true
-			}
+	s.blockLock.Lock()
+	s.blockHosts = m
+	s.blockLock.Unlock()
+	return nil
+}
+
+// newBlockMatcher load block-host-file, lists and block-hosts patterns
+func newBlockMatcher(file string, patterns []string, lists [][]byte, l *logger.Logger) (*domaintrie.Matcher, error) {
+	m := domaintrie.NewMatcher()
+	now := time.Now()
+	total, totalSkipped := 0, 0
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		added, skipped, err := m.LoadList(f)
+		if err != nil {
+			return nil, err
 		}
+		total += added
+		totalSkipped += skipped
 	}
-	return false
+	for _, list := range lists {
+		added, skipped, err := m.LoadList(bytes.NewReader(list))
+		if err != nil {
+			return nil, err
+		}
+		total += added
+		totalSkipped += skipped
+	}
+	for _, p := range patterns {
+		if err := m.Add(p); err != nil {
+			return nil, err
+		}
+	}
+	if total > 0 {
+		l.Debugf("load block hosts %d, skipped %d, trie nodes %d, cost: %v", total, totalSkipped, m.Nodes(), time.Now().Sub(now))
+	}
+	return m, nil
 }
 
 func (s *DNS) isCNIP(ip net.IP) bool {
@@ -206,91 +360,170 @@ func (s *DNS) isCNIP(ip net.IP) bool {
 	return false
 }
 
-func (s *DNS) handle(reqUaddr *net.UDPAddr, data []byte) error {
-
+// handle return response for dns query data, src is client ip. Each
+// client query is recorded once, with the reason of how it's answered.
+func (s *DNS) handle(src string, data []byte) ([]byte, error) {
 	dnsQuery, err := s.parse(data)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	resp, reason, err := s.answer(src, data, dnsQuery)
+	if err != nil {
+		return nil, err
 	}
+	s.log(src, dnsQuery.QDomain, reason)
+	return resp, nil
+}
+
+// answer return response for dns query and the reason of how it's answered
+func (s *DNS) answer(src string, data []byte, dnsQuery *DNSMsg) ([]byte, string, error) {
 	for _, t := range s.disableQTypes {
 		if strings.ToLower(t) == strings.ToLower(dnsQuery.QType.String()) {
-			s.log(reqUaddr.IP.String(), dnsQuery.QDomain, reasonDisabled)
-			resp := GetEmptyDNSResp(data)
-			if _, err := s.udpListener.WriteToUDP(resp, reqUaddr); err != nil {
-				return err
-			}
-			return nil
+			return GetEmptyDNSResp(data), reasonDisabled, nil
 		}
 	}
-	if ip, ok := s.hostMap[dnsQuery.QDomain]; ok {
-		s.log(reqUaddr.IP.String(), dnsQuery.QDomain, reasonMapped)
-		resp := GetDNSResp(data, dnsQuery.QDomain, ip)
-		if _, err := s.udpListener.WriteToUDP(resp, reqUaddr); err != nil {
-			return err
-		}
-		return nil
+	if s.hostMap.Lookup(dnsQuery.QDomain) != nil {
+		resp, err := s.answerMapped(src, data, dnsQuery)
+		return resp, reasonMapped, err
 	}
 
-	if s.badDomain(dnsQuery.QDomain) {
-		s.l.Debug("block ad host", dnsQuery.QDomain)
-		s.log(reqUaddr.IP.String(), dnsQuery.QDomain, reasonBlocked)
-		// return 127.0.0.1 for this host
-		resp := GetDNSResp(data, dnsQuery.QDomain, "127.0.0.1")
-		if _, err := s.udpListener.WriteToUDP(resp, reqUaddr); err != nil {
-			return err
+	matched := s.rules.MatchDomain(dnsQuery.QDomain)
+	if s.badDomain(dnsQuery.QDomain) || (matched != nil && matched.Action.Type == rule.ActionReject) {
+		s.l.Debug("block host", dnsQuery.QDomain)
+		return packReply(s.blockResp.reply(dnsQuery.Msg), data), reasonBlocked, nil
+	}
+	if s.FakeIPs != nil && (matched == nil || matched.Action.Type != rule.ActionDirect) {
+		// domains matched direct rule are resolved normally
+		switch dnsQuery.QType.String() {
+		case "A":
+			return GetDNSResp(data, dnsQuery.QDomain, s.FakeIPs.Get(dnsQuery.QDomain).String()), reasonFakeIP, nil
+		case "AAAA":
+			// fake ip is ipv4 only, make client fallback to A record
+			return GetEmptyDNSResp(data), reasonFakeIP, nil
 		}
-		return nil
 	}
+	cached, stale := s.getCache(dnsQuery.CacheKey(), data)
 	if s.Cache != nil {
-		cachedData := s.Cache.Get(dnsQuery.CacheKey())
-		if cachedData != nil {
-			s.l.Debug("dns cache hit:", dnsQuery.QDomain)
-			s.log(reqUaddr.IP.String(), dnsQuery.QDomain, reasonCached)
-			resp := cachedData.([]byte)
-			if len(resp) <= 2 {
-				s.l.Error("invalid cached data", resp, dnsQuery.QDomain, dnsQuery.QType.String())
-			} else {
-				// rewrite first 2 bytes(dns id)
-				resp[0] = data[0]
-				resp[1] = data[1]
-				if _, err := s.udpListener.WriteToUDP(resp, reqUaddr); err != nil {
-					return err
-				}
-				return nil
-			}
+		s.Stats.cacheLookup(cached != nil && !stale)
+	}
+	if cached != nil && !stale {
+		s.l.Debug("dns cache hit:", dnsQuery.QDomain)
+		s.addCachedAnswer(cached)
+		return cached, reasonCached, nil
+	}
+	if cached != nil {
+		raw, reason := s.queryStale(data, dnsQuery, matched, cached)
+		if reason == reasonStale {
+			s.addCachedAnswer(raw)
 		}
+		return raw, reason, nil
 	}
-	raw, msg, err := s.doQuery(reqUaddr.IP.String(), data, dnsQuery)
+	raw, msg, reason, err := s.doQuery(data, dnsQuery, matched)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
+	s.IPDomains.AddAnswer(msg)
+	s.addCache(dnsQuery.CacheKey(), raw, msg)
+	return raw, reason, nil
+}
 
-	if _, err := s.udpListener.WriteToUDP(raw, reqUaddr); err != nil {
-		return err
-	}
-	if s.Cache != nil && len(raw) > 0 {
-		ttl := s.getCacheTime(msg)
-		// add to dns cache
-		s.Cache.Add(dnsQuery.CacheKey(), raw, ttl)
+// queryStale query upstream for query whose cached answer is stale, the
+// stale answer is returned if upstream failed or doesn't answer within
+// staleAnswerTimeout, RFC 8767. Upstream answer is cached even if it
+// comes late.
+func (s *DNS) queryStale(data []byte, dnsQuery *DNSMsg, matched *rule.Rule, stale []byte) (resp []byte, reason string) {
+	type result struct {
+		raw    []byte
+		reason string
+		err    error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		raw, msg, reason, err := s.doQuery(data, dnsQuery, matched)
+		if upstreamFailed(msg, err) {
+			if err == nil {
+				err = errors.New("upstream server failure")
+			}
+			ch <- result{err: err}
+			return
+		}
+		s.IPDomains.AddAnswer(msg)
+		s.addCache(dnsQuery.CacheKey(), raw, msg)
+		ch <- result{raw, reason, nil}
+	}()
+	timer := time.NewTimer(staleAnswerTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		if r.err == nil {
+			return r.raw, r.reason
+		}
+		s.l.Info("serve stale answer for", dnsQuery.QDomain, r.err)
+	case <-timer.C:
+		s.l.Info("serve stale answer for", dnsQuery.QDomain, "refresh in background")
 	}
+	return stale, reasonStale
+}
 
-	return nil
+// upstreamFailed check whether upstream failed to answer, msg is nil if
+// fq dns is unreachable
+func upstreamFailed(msg *DNSMsg, err error) bool {
+	return err != nil || msg == nil || msg.Msg.Rcode == RcodeServerFailure
 }
 
-func (s *DNS) log(src, domain, result string) {
-	if s.dnsLogger != nil {
-		s.dnsLogger.Printf("%s,%s,%s \n", src, domain, result)
+// addCachedAnswer record ip to domain mapping of cached answer, mapping
+// should exist before client connects
+func (s *DNS) addCachedAnswer(resp []byte) {
+	if s.IPDomains == nil {
+		return
+	}
+	if msg, err := s.parse(resp); err == nil {
+		s.IPDomains.AddAnswer(msg)
 	}
 }
 
-func (s *DNS) getCacheTime(msg *DNSMsg) time.Duration {
-	if s.enforceTTL > 0 {
-		return time.Duration(s.enforceTTL) * time.Second
+// answerMapped answer query by host map, cname target not in host map
+// is resolved as a normal query.
+func (s *DNS) answerMapped(src string, data []byte, dnsQuery *DNSMsg) ([]byte, error) {
+	answers, target, err := s.hostMap.Answer(dnsQuery.QDomain, dnsQuery.QType)
+	if err != nil {
+		return nil, err
 	}
-	if msg != nil && len(msg.ARecords) > 0 {
-		return time.Duration(msg.ARecords[0].TTL) * time.Second
+	reply := NewReply(dnsQuery.Msg)
+	if target != "" {
+		qdata := GetDNSQuery(target, dnsQuery.QType)
+		qmsg, err := s.parse(qdata)
+		if err != nil {
+			return nil, err
+		}
+		raw, _, err := s.answer(src, qdata, qmsg)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := ParseMessage(raw)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, msg.Answers...)
+		reply.Rcode = msg.Rcode
+	}
+	reply.Answers = answers
+	for _, rr := range answers {
+		switch d := rr.Data.(type) {
+		case *AData:
+			s.IPDomains.Add(d.IP, dnsQuery.QDomain, defaultTTL*time.Second)
+		case *AAAAData:
+			s.IPDomains.Add(d.IP, dnsQuery.QDomain, defaultTTL*time.Second)
+		}
+	}
+	return packReply(reply, data), nil
+}
+
+func (s *DNS) log(src, domain, result string) {
+	s.Stats.record(src, domain, result)
+	if s.dnsLogger != nil {
+		s.dnsLogger.Printf("%s,%s,%s \n", src, domain, result)
 	}
-	return defaultTTL * time.Second
 }
 
 func (s *DNS) parse(data []byte) (*DNSMsg, error) {
@@ -301,7 +534,24 @@ func (s *DNS) parse(data []byte) (*DNSMsg, error) {
 	return msg, nil
 }
 
-func (s *DNS) doQuery(srcIP string, data []byte, dnsQuery *DNSMsg) (raw []byte, msg *DNSMsg, err error) {
+// doQuery resolve by matched domain rule: direct only use cn dns, proxy only
+// use fq dns, otherwise query both and pick by whether result is a cn ip.
+// reason tells which upstream answered.
+func (s *DNS) doQuery(data []byte, dnsQuery *DNSMsg, matched *rule.Rule) (raw []byte, msg *DNSMsg, reason string, err error) {
+	if matched != nil && matched.Action.Type == rule.ActionDirect {
+		s.l.Debug("skip fq-dns for", dnsQuery.QDomain)
+		raw, err = s.queryCN(data)
+		if err != nil {
+			s.l.Error("failed to query CN dns:", dnsQuery, err)
+			return nil, nil, "", err
+		}
+		msg, err = s.parse(raw)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		reason = reasonCNNoCache
+		return
+	}
 	var wg sync.WaitGroup
 	var cnData, fqData []byte
 	var cnMsg, fqMsg *DNSMsg
@@ -319,26 +569,26 @@ func (s *DNS) doQuery(srcIP string, data []byte, dnsQuery *DNSMsg) (raw []byte,
 			s.l.Error("failed to parse resp from fq dns:", err)
 		}
 	}(data)
-	if !utils.DomainMatch(dnsQuery.QDomain, s.forceFQ) {
+	if matched == nil || matched.Action.Type != rule.ActionProxy {
 		var err error
 		cnData, err = s.queryCN(data)
 		if err != nil {
 			s.l.Error("failed to query CN dns:", dnsQuery, err)
-			return nil, nil, err
+			return nil, nil, "", err
 		}
 		cnMsg, err = s.parse(cnData)
 		if err != nil {
 			s.l.Error("failed to parse resp from cn dns:", err)
-			return nil, nil, err
+			return nil, nil, "", err
 		}
 		if len(cnMsg.ARecords) >= 1 && s.isCNIP(cnMsg.ARecords[0].IP) {
 			// if cn dns have response and it's an cn ip, we think it's a site in China
 			raw = cnData
 			msg = cnMsg
-			s.log(srcIP, dnsQuery.QDomain, reasonCNNoCache)
+			reason = reasonCNNoCache
 		} else {
 			wg.Wait()
-			s.log(srcIP, dnsQuery.QDomain, reasonFQNoCache)
+			reason = reasonFQNoCache
 			// use fq dns's response for all ip outside of China
 			raw = fqData
 			msg = fqMsg
@@ -346,14 +596,20 @@ func (s *DNS) doQuery(srcIP string, data []byte, dnsQuery *DNSMsg) (raw []byte,
 	} else {
 		s.l.Debug("skip cn-dns for", dnsQuery.QDomain)
 		wg.Wait()
+		reason = reasonFQNoCache
 		raw = fqData
 		msg = fqMsg
 	}
 	return
 }
 
-func (s *DNS) queryCN(data []byte) ([]byte, error) {
-	conn, err := net.Dial("udp", fmt.Sprintf("%s:%d", s.cnDNS, dnsPort))
+func (s *DNS) queryCN(data []byte) (resp []byte, err error) {
+	start := time.Now()
+	defer func() { s.Stats.observeUpstream(upstreamCN, time.Since(start), err) }()
+	if s.cnUpstream != nil {
+		return s.cnUpstream.Exchange(data)
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(s.cnDNS, strconv.Itoa(dnsPort)))
 	if err != nil {
 		return nil, err
 	}
@@ -364,40 +620,39 @@ func (s *DNS) queryCN(data []byte) ([]byte, error) {
 	if _, err = conn.Write(data); err != nil {
 		return nil, err
 	}
-	b := make([]byte, 1024)
+	b := make([]byte, ednsUDPSize)
 	n, err := conn.Read(b)
 	if err != nil {
 		return nil, err
 	}
+	if IsTruncated(b[:n]) {
+		// answer doesn't fit in udp, retry over tcp
+		s.l.Debug("truncated answer from cn dns, retry over tcp")
+		return s.queryTCP(s.dialDirect, s.cnDNS, data)
+	}
 	return b[0:n], nil
 }
 
-func (s *DNS) queryFQ(data []byte) ([]byte, error) {
+func (s *DNS) queryFQ(data []byte) (resp []byte, err error) {
+	start := time.Now()
+	defer func() { s.Stats.observeUpstream(upstreamFQ, time.Since(start), err) }()
+	if s.fqUpstream != nil {
+		return s.fqUpstream.Exchange(data)
+	}
 	// query fq dns by tcp, it will be captured by iptables and go out through ss
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", s.fqDNS, dnsPort))
+	return s.queryTCP(net.Dial, s.fqDNS, data)
+}
+
+func (s *DNS) queryTCP(dial DialFunc, host string, data []byte) ([]byte, error) {
+	conn, err := dial("tcp", net.JoinHostPort(host, strconv.Itoa(dnsPort)))
 	if err != nil {
 		return nil, err
 	}
-	if err := conn.SetReadDeadline(time.Now().Add(dnsTimeout * time.Second)); err != nil {
-		return nil, err
-	}
 	defer conn.Close()
-	b := make([]byte, 2) // used to hold dns data length
-	binary.BigEndian.PutUint16(b, uint16(len(data)))
-	if _, err = conn.Write(append(b, data...)); err != nil {
-		return nil, err
-	}
-	b = make([]byte, 2)
-	if _, err = conn.Read(b); err != nil {
-		return nil, err
-	}
-
-	_len := binary.BigEndian.Uint16(b)
-	b = make([]byte, _len)
-	if _, err = conn.Read(b); err != nil {
+	if err := conn.SetDeadline(time.Now().Add(dnsTimeout * time.Second)); err != nil {
 		return nil, err
 	}
-	return b, nil
+	return exchangeTCP(conn, data)
 }
 
 func decodeCacheKey(key string) (qdomain string, qtype RType) {
@@ -408,6 +663,38 @@ func decodeCacheKey(key string) (qdomain string, qtype RType) {
 	return
 }
 
+// Resolve return real ip of domain, bypass fake ip. Used by direct
+// connection and ip based rules when only domain is known.
+func (s *DNS) Resolve(domain string) (net.IP, error) {
+	qdata := GetDNSQuery(domain, RType(1))
+	qmsg, err := s.parse(qdata)
+	if err != nil {
+		return nil, err
+	}
+	raw, stale := s.getCache(qmsg.CacheKey(), qdata)
+	switch {
+	case raw == nil:
+		fresh, msg, _, err := s.doQuery(qdata, qmsg, s.rules.MatchDomain(domain))
+		if err != nil {
+			return nil, err
+		}
+		raw = fresh
+		s.addCache(qmsg.CacheKey(), raw, msg)
+	case stale:
+		raw, _ = s.queryStale(qdata, qmsg, s.rules.MatchDomain(domain), raw)
+	}
+	msg, err := s.parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range msg.ARecords {
+		if r.IP.To4() != nil {
+			return r.IP, nil
+		}
+	}
+	return nil, errors.New("no ip found for " + domain)
+}
+
 func (s *DNS) prefetchTicker() {
 	ticker := time.NewTicker(time.Duration(s.prefetchInterval) * time.Second)
 	defer ticker.Stop()
@@ -427,16 +714,12 @@ func (s *DNS) prefetchTicker() {
 					s.l.Error(err)
 					continue
 				}
-				raw, msg, err := s.doQuery("127.0.0.1", qdata, qmsg)
+				raw, msg, _, err := s.doQuery(qdata, qmsg, s.rules.MatchDomain(qdomain))
 				if err != nil {
 					s.l.Error(err)
 					continue
 				}
-				if len(raw) > 0 {
-					ttl := s.getCacheTime(msg)
-					s.Cache.Evict(qmsg.CacheKey())
-					s.Cache.Add(qmsg.CacheKey(), raw, ttl)
-				}
+				s.addCache(qmsg.CacheKey(), raw, msg)
 			}
 		}
 	}
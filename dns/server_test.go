@@ -0,0 +1,27 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+
+	"snet/domaintrie"
+)
+
+func TestBadDomain(t *testing.T) {
+	m := domaintrie.NewMatcher()
+	list := "doubleclick.net\n@@good.doubleclick.net\n*.hpplay.cn\n"
+	if _, _, err := m.LoadList(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	s := &DNS{blockHosts: m}
+	for _, d := range []string{"doubleclick.net", "ad.doubleclick.net", "x.hpplay.cn"} {
+		if !s.badDomain(d) {
+			t.Error("should be blocked", d)
+		}
+	}
+	for _, d := range []string{"good.doubleclick.net", "xdoubleclick.net", "example.com"} {
+		if s.badDomain(d) {
+			t.Error("should not be blocked", d)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package dns
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamCN = "cn"
+	upstreamFQ = "fq"
+	// domains tracked for top lists, counts are halved when it's full
+	maxTrackedDomains = 10000
+	// recent queries kept for query log
+	maxQueryLog = 1000
+)
+
+// upper bounds of latency buckets in milliseconds, the last bucket is +Inf
+var latencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// histogram of upstream latency, buckets are cumulative
+type histogram struct {
+	counts []uint64 // counts[i] is number of observations <= latencyBuckets[i]
+	count  uint64
+	sum    time.Duration
+	errors uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	for i, le := range latencyBuckets {
+		if ms <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+// topCounter count domains in bounded memory, counts are approximate
+// after it's full.
+type topCounter struct {
+	counts map[string]uint64
+}
+
+func (t *topCounter) add(domain string) {
+	if _, ok := t.counts[domain]; !ok && len(t.counts) >= maxTrackedDomains {
+		// decay, so domains queried recently can make it to top
+		for len(t.counts) >= maxTrackedDomains {
+			for d, c := range t.counts {
+				if c /= 2; c == 0 {
+					delete(t.counts, d)
+				} else {
+					t.counts[d] = c
+				}
+			}
+		}
+	}
+	t.counts[domain]++
+}
+
+func (t *topCounter) top(n int) []DomainCount {
+	if n <= 0 {
+		return nil
+	}
+	result := make([]DomainCount, 0, len(t.counts))
+	for d, c := range t.counts {
+		result = append(result, DomainCount{Domain: d, Count: c})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Domain < result[j].Domain
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// QueryStats collect statistics of dns queries, it's kept across config
+// reload like IPDomainMap. All methods are safe on nil.
+type QueryStats struct {
+	mu          sync.Mutex
+	start       time.Time
+	reasons     map[string]uint64
+	cacheHits   uint64
+	cacheMisses uint64
+	upstreams   map[string]*histogram
+	queried     topCounter
+	blocked     topCounter
+	queryLog    []QueryLogEntry // ring buffer, next is position to write
+	next        int
+}
+
+// QueryLogEntry is a query and how it's answered
+type QueryLogEntry struct {
+	Time   time.Time
+	Src    string
+	Domain string
+	Reason string
+}
+
+func NewQueryStats() *QueryStats {
+	return &QueryStats{
+		start:     time.Now(),
+		reasons:   make(map[string]uint64),
+		upstreams: map[string]*histogram{upstreamCN: newHistogram(), upstreamFQ: newHistogram()},
+		queried:   topCounter{counts: make(map[string]uint64)},
+		blocked:   topCounter{counts: make(map[string]uint64)},
+	}
+}
+
+// record a query of domain from src answered for reason
+func (st *QueryStats) record(src, domain, reason string) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	entry := QueryLogEntry{Time: time.Now(), Src: src, Domain: domain, Reason: reason}
+	if len(st.queryLog) < maxQueryLog {
+		st.queryLog = append(st.queryLog, entry)
+	} else {
+		st.queryLog[st.next] = entry
+	}
+	st.next = (st.next + 1) % maxQueryLog
+	st.reasons[reason]++
+	st.queried.add(domain)
+	if reason == reasonBlocked {
+		st.blocked.add(domain)
+	}
+}
+
+func (st *QueryStats) cacheLookup(hit bool) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if hit {
+		st.cacheHits++
+	} else {
+		st.cacheMisses++
+	}
+}
+
+// observeUpstream record latency of a query to upstream, failed queries
+// are only counted.
+func (st *QueryStats) observeUpstream(upstream string, d time.Duration, err error) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	h := st.upstreams[upstream]
+	if err != nil {
+		h.errors++
+		return
+	}
+	h.observe(d)
+}
+
+type DomainCount struct {
+	Domain string
+	Count  uint64
+}
+
+type LatencyBucket struct {
+	LE    float64 // upper bound in milliseconds, 0 for +Inf
+	Count uint64
+}
+
+type UpstreamStats struct {
+	Count   uint64
+	Errors  uint64
+	SumMs   float64
+	AvgMs   float64
+	Buckets []LatencyBucket
+}
+
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	HitRatio float64
+	Size     int
+}
+
+type DNSStatsModel struct {
+	Uptime     string
+	Queries    uint64
+	Reasons    map[string]uint64
+	Cache      CacheStats
+	Upstreams  map[string]*UpstreamStats
+	TopQueried []DomainCount
+	TopBlocked []DomainCount
+}
+
+// Snapshot return current statistics with top n domains, cacheSize is
+// number of entries in dns cache.
+func (st *QueryStats) Snapshot(n, cacheSize int) *DNSStatsModel {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m := &DNSStatsModel{
+		Uptime:     time.Since(st.start).Truncate(time.Second).String(),
+		Reasons:    make(map[string]uint64, len(st.reasons)),
+		Cache:      CacheStats{Hits: st.cacheHits, Misses: st.cacheMisses, Size: cacheSize},
+		Upstreams:  make(map[string]*UpstreamStats, len(st.upstreams)),
+		TopQueried: st.queried.top(n),
+		TopBlocked: st.blocked.top(n),
+	}
+	for reason, c := range st.reasons {
+		m.Reasons[reason] = c
+		m.Queries += c
+	}
+	if total := st.cacheHits + st.cacheMisses; total > 0 {
+		m.Cache.HitRatio = float64(st.cacheHits) / float64(total)
+	}
+	for name, h := range st.upstreams {
+		u := &UpstreamStats{Count: h.count, Errors: h.errors, SumMs: float64(h.sum) / float64(time.Millisecond)}
+		if h.count > 0 {
+			u.AvgMs = u.SumMs / float64(h.count)
+		}
+		for i, le := range latencyBuckets {
+			u.Buckets = append(u.Buckets, LatencyBucket{LE: le, Count: h.counts[i]})
+		}
+		u.Buckets = append(u.Buckets, LatencyBucket{Count: h.count})
+		m.Upstreams[name] = u
+	}
+	return m
+}
+
+// QueryLog return last n queries, newest first
+func (st *QueryStats) QueryLog(n int) []QueryLogEntry {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if n > len(st.queryLog) {
+		n = len(st.queryLog)
+	}
+	result := make([]QueryLogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		result = append(result, st.queryLog[(st.next-i+maxQueryLog)%maxQueryLog])
+	}
+	return result
+}
+
+// StatsSnapshot return query statistics with top n domains, nil if stats
+// is not collected.
+func (s *DNS) StatsSnapshot(n int) *DNSStatsModel {
+	if s.Stats == nil {
+		return nil
+	}
+	size := 0
+	if s.Cache != nil {
+		size = s.Cache.Len()
+	}
+	return s.Stats.Snapshot(n, size)
+}
@@ -0,0 +1,88 @@
+package dns
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQueryStats(t *testing.T) {
+	st := NewQueryStats()
+	for i := 0; i < 3; i++ {
+		st.record("127.0.0.1", "a.com", reasonCached)
+	}
+	st.record("127.0.0.1", "b.com", reasonCNNoCache)
+	st.record("127.0.0.1", "ads.com", reasonBlocked)
+	st.cacheLookup(true)
+	st.cacheLookup(true)
+	st.cacheLookup(false)
+	st.observeUpstream(upstreamCN, 3*time.Millisecond, nil)
+	st.observeUpstream(upstreamCN, 30*time.Millisecond, nil)
+	st.observeUpstream(upstreamFQ, 0, errors.New("timeout"))
+
+	m := st.Snapshot(2, 10)
+	if m.Queries != 5 || m.Reasons[reasonCached] != 3 || m.Reasons[reasonBlocked] != 1 {
+		t.Error("unexpected reasons", m.Queries, m.Reasons)
+	}
+	if m.Cache.Hits != 2 || m.Cache.Misses != 1 || m.Cache.Size != 10 || m.Cache.HitRatio < 0.66 || m.Cache.HitRatio > 0.67 {
+		t.Error("unexpected cache stats", m.Cache)
+	}
+	if len(m.TopQueried) != 2 || m.TopQueried[0] != (DomainCount{"a.com", 3}) || m.TopQueried[1] != (DomainCount{"ads.com", 1}) {
+		t.Error("unexpected top queried", m.TopQueried)
+	}
+	if len(m.TopBlocked) != 1 || m.TopBlocked[0].Domain != "ads.com" {
+		t.Error("unexpected top blocked", m.TopBlocked)
+	}
+	cn := m.Upstreams[upstreamCN]
+	if cn.Count != 2 || cn.AvgMs != 16.5 {
+		t.Error("unexpected cn latency", cn)
+	}
+	// 3ms in every bucket, 30ms from 50ms bucket
+	for _, b := range cn.Buckets {
+		want := uint64(2)
+		if b.LE != 0 && b.LE < 30 {
+			want = 1
+		}
+		if b.Count != want {
+			t.Error("unexpected bucket", b)
+		}
+	}
+	if fq := m.Upstreams[upstreamFQ]; fq.Count != 0 || fq.Errors != 1 {
+		t.Error("unexpected fq latency", fq)
+	}
+
+	var nilStats *QueryStats
+	nilStats.record("127.0.0.1", "a.com", reasonCached)
+	nilStats.cacheLookup(true)
+}
+
+func TestTopCounterBounded(t *testing.T) {
+	st := NewQueryStats()
+	for i := 0; i < 10; i++ {
+		st.record("127.0.0.1", "popular.com", reasonCached)
+	}
+	for i := 0; i < maxTrackedDomains*2; i++ {
+		st.record("127.0.0.1", strconv.Itoa(i)+".com", reasonCached)
+	}
+	if n := len(st.queried.counts); n > maxTrackedDomains {
+		t.Error("too many domains tracked", n)
+	}
+	if top := st.queried.top(1); top[0].Domain != "popular.com" {
+		t.Error("popular domain should be kept", top)
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	st := NewQueryStats()
+	for i := 0; i < maxQueryLog+5; i++ {
+		st.record("192.168.1.2", strconv.Itoa(i)+".com", reasonCached)
+	}
+	log := st.QueryLog(3)
+	if len(log) != 3 || log[0].Domain != strconv.Itoa(maxQueryLog+4)+".com" || log[2].Domain != strconv.Itoa(maxQueryLog+2)+".com" {
+		t.Error("unexpected query log", log)
+	}
+	if n := len(st.QueryLog(maxQueryLog * 2)); n != maxQueryLog {
+		t.Error("unexpected query log size", n)
+	}
+}
@@ -0,0 +1,283 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dotPort         = 853
+	dotMaxIdleConns = 4
+	dnsMsgMaxSize   = 65535
+	dohContentType  = "application/dns-message"
+)
+
+// DialFunc dial tcp connection to addr(host:port)
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// Upstream send dns query to remote dns server and return the answer
+type Upstream interface {
+	Exchange(data []byte) ([]byte, error)
+	String() string
+}
+
+// IsPlainDNS check whether addr is a plain dns server ip rather than an
+// url of DNS-over-HTTPS(https://) or DNS-over-TLS(tls://) server.
+func IsPlainDNS(addr string) bool {
+	return !strings.Contains(addr, "://")
+}
+
+// NewUpstream create DNS-over-HTTPS or DNS-over-TLS upstream by url,
+// connections to server are created by dial and reused. Host of url is
+// passed to dial as it is, and used as tls server name.
+func NewUpstream(addr string, dial DialFunc) (Upstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host in dns url " + addr)
+	}
+	switch u.Scheme {
+	case "https":
+		return newDoHUpstream(u, dial), nil
+	case "tls":
+		port := dotPort
+		if u.Port() != "" {
+			if port, err = strconv.Atoi(u.Port()); err != nil {
+				return nil, err
+			}
+		}
+		return newDoTUpstream(net.JoinHostPort(u.Hostname(), strconv.Itoa(port)), &tls.Config{ServerName: u.Hostname()}, dial), nil
+	}
+	return nil, errors.New("unsupported dns url " + addr)
+}
+
+// bootstrapDialer resolve host of addr by plain dns server before dialing,
+// system resolver can't be used as it points to snet itself. Resolved ips
+// are kept until dialing to them fails.
+type bootstrapDialer struct {
+	dial   DialFunc
+	server string // host:port of plain dns server
+	lock   sync.Mutex
+	ips    map[string]string
+}
+
+func newBootstrapDialer(dial DialFunc, server string) *bootstrapDialer {
+	return &bootstrapDialer{dial: dial, server: net.JoinHostPort(server, strconv.Itoa(dnsPort)), ips: make(map[string]string)}
+}
+
+func (d *bootstrapDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dial(network, addr)
+	}
+	ip, err := d.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dial(network, net.JoinHostPort(ip, port))
+	if err != nil {
+		d.lock.Lock()
+		delete(d.ips, host)
+		d.lock.Unlock()
+	}
+	return conn, err
+}
+
+func (d *bootstrapDialer) resolve(host string) (string, error) {
+	d.lock.Lock()
+	ip, ok := d.ips[host]
+	d.lock.Unlock()
+	if ok {
+		return ip, nil
+	}
+	conn, err := d.dial("tcp", d.server)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(dnsTimeout * time.Second)); err != nil {
+		return "", err
+	}
+	resp, err := exchangeTCP(conn, GetDNSQuery(host, TypeA))
+	if err != nil {
+		return "", err
+	}
+	msg, err := NewDNSMsg(resp)
+	if err != nil {
+		return "", err
+	}
+	if len(msg.ARecords) == 0 {
+		return "", errors.New("no ip found for " + host + " from bootstrap dns " + d.server)
+	}
+	ip = msg.ARecords[0].IP.String()
+	d.lock.Lock()
+	d.ips[host] = ip
+	d.lock.Unlock()
+	return ip, nil
+}
+
+// dohUpstream is RFC 8484 client, query is sent by POST
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(u *url.URL, dial DialFunc) *dohUpstream {
+	transport := &http.Transport{
+		Dial:                dial,
+		TLSHandshakeTimeout: dnsTimeout * time.Second,
+		MaxIdleConnsPerHost: dotMaxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+	return &dohUpstream{
+		url:    u.String(),
+		client: &http.Client{Transport: transport, Timeout: dnsTimeout * time.Second},
+	}
+}
+
+func (u *dohUpstream) Exchange(data []byte) ([]byte, error) {
+	// RFC 8484 recommend id 0 for http cache friendliness
+	query := make([]byte, len(data))
+	copy(query, data)
+	query[0], query[1] = 0, 0
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("bad doh response status %d from %s", resp.StatusCode, u.url)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dnsMsgMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < 12 {
+		return nil, errors.New("short doh response from " + u.url)
+	}
+	body[0], body[1] = data[0], data[1]
+	return body, nil
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+// dotUpstream is RFC 7858 client, idle connections are kept for reuse
+type dotUpstream struct {
+	addr string
+	cfg  *tls.Config
+	dial DialFunc
+	idle chan *tls.Conn
+}
+
+func newDoTUpstream(addr string, cfg *tls.Config, dial DialFunc) *dotUpstream {
+	return &dotUpstream{addr: addr, cfg: cfg, dial: dial, idle: make(chan *tls.Conn, dotMaxIdleConns)}
+}
+
+func (u *dotUpstream) Exchange(data []byte) ([]byte, error) {
+	select {
+	case conn := <-u.idle:
+		resp, err := u.exchange(conn, data)
+		if err == nil {
+			return resp, nil
+		}
+		// server may close idle connection, retry with new one
+		conn.Close()
+	default:
+	}
+	conn, err := u.connect()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.exchange(conn, data)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (u *dotUpstream) connect() (*tls.Conn, error) {
+	rawConn, err := u.dial("tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, u.cfg)
+	conn.SetDeadline(time.Now().Add(dnsTimeout * time.Second))
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// exchange send query on conn, and put it back to idle pool on success
+func (u *dotUpstream) exchange(conn *tls.Conn, data []byte) ([]byte, error) {
+	if err := conn.SetDeadline(time.Now().Add(dnsTimeout * time.Second)); err != nil {
+		return nil, err
+	}
+	resp, err := exchangeTCP(conn, data)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return resp, nil
+}
+
+func (u *dotUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+// writeTCPMsg write dns message with 2 bytes length prefix
+func writeTCPMsg(conn net.Conn, data []byte) error {
+	b := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+	_, err := conn.Write(append(b, data...))
+	return err
+}
+
+// exchangeTCP send length prefixed dns query and read the answer
+func exchangeTCP(conn net.Conn, data []byte) ([]byte, error) {
+	if err := writeTCPMsg(conn, data); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,207 @@
+package dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"snet/logger"
+)
+
+// fakeAnswer answer every query with 1.2.3.4
+func fakeAnswer(query []byte) []byte {
+	msg, err := NewDNSMsg(query)
+	if err != nil {
+		return nil
+	}
+	return GetDNSResp(query, msg.QDomain, "1.2.3.4")
+}
+
+func checkAnswer(t *testing.T, query, resp []byte) {
+	msg, err := NewDNSMsg(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != query[0] || resp[1] != query[1] {
+		t.Error("dns id not match")
+	}
+	if len(msg.ARecords) != 1 || msg.ARecords[0].IP.String() != "1.2.3.4" {
+		t.Error("unexpected answer", msg)
+	}
+}
+
+// countDial count tcp connections dialed
+func countDial(n *int32) DialFunc {
+	return func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(n, 1)
+		return net.Dial(network, addr)
+	}
+}
+
+func TestDoHUpstream(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		if query[0] != 0 || query[1] != 0 {
+			t.Error("doh query id should be 0")
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(fakeAnswer(query))
+	}))
+	defer ts.Close()
+
+	var dials int32
+	u, err := NewUpstream(ts.URL+"/dns-query", countDial(&dials))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	doh := u.(*dohUpstream)
+	doh.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+	for i := 0; i < 3; i++ {
+		query := GetDNSQuery("example.com", RType(1))
+		resp, err := u.Exchange(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnswer(t, query, resp)
+	}
+	if dials != 1 {
+		t.Error("connection should be reused, dialed:", dials)
+	}
+}
+
+func TestDoTUpstream(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	ts.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					b := make([]byte, 2)
+					if _, err := io.ReadFull(conn, b); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(b))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := fakeAnswer(query)
+					binary.BigEndian.PutUint16(b, uint16(len(resp)))
+					conn.Write(append(b, resp...))
+				}
+			}(conn)
+		}
+	}()
+
+	var dials int32
+	u, err := NewUpstream("tls://"+ln.Addr().String(), countDial(&dials))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	dot := u.(*dotUpstream)
+	dot.cfg = &tls.Config{RootCAs: pool, ServerName: "example.com"}
+	for i := 0; i < 3; i++ {
+		query := GetDNSQuery("example.com", RType(1))
+		resp, err := u.Exchange(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnswer(t, query, resp)
+	}
+	if dials != 1 {
+		t.Error("connection should be reused, dialed:", dials)
+	}
+}
+
+func TestNewUpstream(t *testing.T) {
+	if !IsPlainDNS("8.8.8.8") || IsPlainDNS("tls://8.8.8.8") {
+		t.Error("plain dns check failed")
+	}
+	u, err := NewUpstream("tls://8.8.8.8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "tls://8.8.8.8:853" {
+		t.Error("default dot port should be 853, got", u)
+	}
+	if _, err := NewUpstream("https://dns.google/dns-query", nil); err != nil {
+		t.Error("host name should be allowed", err)
+	}
+	for _, addr := range []string{"udp://8.8.8.8", "https:///dns-query", "tls://:853"} {
+		if _, err := NewUpstream(addr, nil); err == nil {
+			t.Error("should fail for", addr)
+		}
+	}
+}
+
+func TestBootstrapDialer(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Host, "example.com:") {
+			t.Error("unexpected host", r.Host)
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(fakeAnswer(query))
+	}))
+	defer ts.Close()
+	// bootstrap dns resolve example.com to 127.0.0.1
+	hostMap, _ := NewHostMap(map[string][]string{"example.com": {"127.0.0.1"}})
+	bootstrap := &DNS{hostMap: hostMap, l: logger.NewLogger(logger.ERROR)}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go bootstrap.serveTCP(ln)
+
+	var dials int32
+	d := newBootstrapDialer(countDial(&dials), "127.0.0.1")
+	d.server = ln.Addr().String()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	u, err := NewUpstream("https://example.com:"+port+"/dns-query", d.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	doh := u.(*dohUpstream)
+	doh.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+	for i := 0; i < 2; i++ {
+		query := GetDNSQuery("a.com", TypeA)
+		resp, err := u.Exchange(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnswer(t, query, resp)
+	}
+	// one for bootstrap query, one for doh connection
+	if dials != 2 {
+		t.Error("host should be resolved once, dialed:", dials)
+	}
+}
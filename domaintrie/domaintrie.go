@@ -0,0 +1,291 @@
+// Package domaintrie store domains in a trie keyed by labels in reverse
+// order(com -> google -> www), so a domain and all its subdomains can be
+// matched by walking down from the root once.
+//
+// Patterns accepted by Matcher:
+//
+//	google.com       exact domain
+//	+.google.com     google.com and all its subdomains
+//	*.google.com     same as +.google.com
+//	ad*.google.com   wildcard, * matches any characters
+//	/^ad\d+\./       regular expression
+//	@@pattern        exception, domains matched are never blocked
+package domaintrie
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	flagExact  = 1 << iota // node is end of an exact domain
+	flagSuffix             // node and all its children matched
+)
+
+type node struct {
+	label    string
+	children []*node // sorted by label
+	flags    uint8
+}
+
+// valueKey locate value of an entry, values are stored out of nodes
+// since most entries have value 0, which saves memory of large lists.
+type valueKey struct {
+	n    *node
+	flag uint8
+}
+
+func (n *node) child(label string) *node {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].label >= label })
+	if i < len(n.children) && n.children[i].label == label {
+		return n.children[i]
+	}
+	return nil
+}
+
+// addChild return child of label, created is true if it's new
+func (n *node) addChild(label string) (c *node, created bool) {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].label >= label })
+	if i < len(n.children) && n.children[i].label == label {
+		return n.children[i], false
+	}
+	c = &node{label: label}
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = c
+	return c, true
+}
+
+// Trie map domain or domain suffix to an int value
+type Trie struct {
+	root   *node
+	values map[valueKey]int
+	size   int
+	nodes  int
+}
+
+func New() *Trie {
+	return &Trie{root: new(node), values: make(map[valueKey]int)}
+}
+
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
+
+// Insert add domain with value v(>= 0), domain's subdomains are matched
+// too if suffix is true. Smaller value is kept if domain exists.
+func (t *Trie) Insert(domain string, suffix bool, v int) {
+	domain = normalize(domain)
+	if domain == "" || v < 0 {
+		return
+	}
+	n := t.root
+	for end := len(domain); end > 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		var created bool
+		if n, created = n.addChild(domain[start:end]); created {
+			t.nodes++
+		}
+		end = start - 1
+	}
+	flag := uint8(flagExact)
+	if suffix {
+		flag = flagSuffix
+	}
+	if n.flags&flag == 0 {
+		t.size++
+		n.flags |= flag
+	} else if v >= t.value(n, flag) {
+		return
+	}
+	if v == 0 {
+		delete(t.values, valueKey{n, flag})
+	} else {
+		t.values[valueKey{n, flag}] = v
+	}
+}
+
+func (t *Trie) value(n *node, flag uint8) int {
+	return t.values[valueKey{n, flag}]
+}
+
+// Lookup return the smallest value of entries matching domain, ok is false
+// if nothing matched.
+func (t *Trie) Lookup(domain string) (v int, ok bool) {
+	if t == nil {
+		return 0, false
+	}
+	domain = normalize(domain)
+	n := t.root
+	v = -1
+	for end := len(domain); end > 0 && n != nil; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		if n = n.child(domain[start:end]); n == nil {
+			break
+		}
+		if n.flags&flagSuffix != 0 {
+			if sv := t.value(n, flagSuffix); v < 0 || sv < v {
+				v = sv
+			}
+		}
+		if start == 0 && n.flags&flagExact != 0 {
+			if ev := t.value(n, flagExact); v < 0 || ev < v {
+				v = ev
+			}
+		}
+		end = start - 1
+	}
+	return v, v >= 0
+}
+
+// Match check whether domain is in trie
+func (t *Trie) Match(domain string) bool {
+	_, ok := t.Lookup(domain)
+	return ok
+}
+
+// Len return number of entries
+func (t *Trie) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+// Kind of pattern
+type Kind int
+
+const (
+	KindExact Kind = iota
+	KindSuffix
+	KindRegex
+)
+
+// ParsePattern parse pattern(see package doc) without exception prefix,
+// value is domain for exact and suffix kind, and regexp for regex kind.
+func ParsePattern(p string) (kind Kind, value string, err error) {
+	p = strings.TrimSpace(p)
+	switch {
+	case p == "":
+		return 0, "", errors.New("empty domain pattern")
+	case len(p) > 2 && p[0] == '/' && p[len(p)-1] == '/':
+		value = p[1 : len(p)-1]
+		if _, err := regexp.Compile(value); err != nil {
+			return 0, "", err
+		}
+		return KindRegex, value, nil
+	case strings.HasPrefix(p, "+.") || strings.HasPrefix(p, "*."):
+		if value = normalize(p[2:]); !validDomain(value, false) {
+			break
+		}
+		return KindSuffix, value, nil
+	case strings.Contains(p, "*"):
+		if !validDomain(normalize(p), true) {
+			break
+		}
+		parts := strings.Split(normalize(p), "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		return KindRegex, "^" + strings.Join(parts, ".*") + "$", nil
+	default:
+		if value = normalize(p); !validDomain(value, false) {
+			break
+		}
+		return KindExact, value, nil
+	}
+	return 0, "", errors.New("invalid domain pattern " + p)
+}
+
+// validDomain check characters of domain, * is allowed for wildcard
+func validDomain(domain string, wildcard bool) bool {
+	if domain == "" {
+		return false
+	}
+	for _, c := range domain {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		case c == '*' && wildcard:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type set struct {
+	trie    *Trie
+	regexps []*regexp.Regexp
+}
+
+func (s *set) add(p string) error {
+	kind, value, err := ParsePattern(p)
+	if err != nil {
+		return err
+	}
+	if kind == KindRegex {
+		s.regexps = append(s.regexps, regexp.MustCompile(value))
+		return nil
+	}
+	s.trie.Insert(value, kind == KindSuffix, 0)
+	return nil
+}
+
+func (s *set) match(domain string) bool {
+	if s.trie.Match(domain) {
+		return true
+	}
+	for _, re := range s.regexps {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matcher match domain against patterns, exceptions(@@ prefixed) override
+// others.
+type Matcher struct {
+	deny  set
+	allow set
+}
+
+func NewMatcher() *Matcher {
+	return &Matcher{deny: set{trie: New()}, allow: set{trie: New()}}
+}
+
+// Add add a pattern, see package doc for syntax
+func (m *Matcher) Add(pattern string) error {
+	pattern = strings.TrimSpace(pattern)
+	if strings.HasPrefix(pattern, "@@") {
+		return m.allow.add(pattern[2:])
+	}
+	return m.deny.add(pattern)
+}
+
+// Match check whether domain is matched by patterns and not excepted
+func (m *Matcher) Match(domain string) bool {
+	if m == nil {
+		return false
+	}
+	domain = normalize(domain)
+	return m.deny.match(domain) && !m.allow.match(domain)
+}
+
+// Len return number of patterns
+func (m *Matcher) Len() int {
+	if m == nil {
+		return 0
+	}
+	return m.deny.trie.Len() + len(m.deny.regexps) + m.allow.trie.Len() + len(m.allow.regexps)
+}
+
+// Nodes return number of trie nodes, each costs about 48 bytes
+func (m *Matcher) Nodes() int {
+	if m == nil {
+		return 0
+	}
+	return m.deny.trie.nodes + m.allow.trie.nodes
+}
@@ -0,0 +1,83 @@
+package domaintrie
+
+import (
+	"testing"
+)
+
+func TestTrie(t *testing.T) {
+	trie := New()
+	trie.Insert("google.com", true, 2)
+	trie.Insert("www.google.com", false, 1)
+	trie.Insert("Baidu.com.", false, 0)
+	trie.Insert("google.com", true, 3)
+	for domain, want := range map[string]int{
+		"google.com":       2,
+		"a.b.google.com":   2,
+		"WWW.google.com":   1,
+		"baidu.com":        0,
+		"www.google.com.":  1,
+		"x.www.google.com": 2,
+	} {
+		if v, ok := trie.Lookup(domain); !ok || v != want {
+			t.Error("unexpected value for", domain, v, ok)
+		}
+	}
+	for _, domain := range []string{"www.baidu.com", "xgoogle.com", "com", ""} {
+		if trie.Match(domain) {
+			t.Error("should not match", domain)
+		}
+	}
+	if trie.Len() != 3 {
+		t.Error("unexpected size", trie.Len())
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	for _, c := range []struct {
+		p     string
+		kind  Kind
+		value string
+	}{
+		{"Google.com", KindExact, "google.com"},
+		{"+.google.com", KindSuffix, "google.com"},
+		{"*.google.com", KindSuffix, "google.com"},
+		{"ad*.google.com", KindRegex, `^ad.*\.google\.com$`},
+		{`/^ad\d+\./`, KindRegex, `^ad\d+\.`},
+	} {
+		kind, value, err := ParsePattern(c.p)
+		if err != nil || kind != c.kind || value != c.value {
+			t.Error("unexpected result for", c.p, kind, value, err)
+		}
+	}
+	for _, p := range []string{"", "*.", "/(/"} {
+		if _, _, err := ParsePattern(p); err == nil {
+			t.Error("should fail for", p)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m := NewMatcher()
+	for _, p := range []string{"+.doubleclick.net", "ads.example.com", "*.hpplay.cn", "track*.example.org", `/^ad\d+\./`, "@@good.doubleclick.net"} {
+		if err := m.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{"doubleclick.net", "ad.doubleclick.net", "ads.example.com", "hpplay.cn", "x.hpplay.cn", "tracker.example.org", "ad12.foo.com"} {
+		if !m.Match(d) {
+			t.Error("should match", d)
+		}
+	}
+	for _, d := range []string{"good.doubleclick.net", "x.ads.example.com", "xhpplay.cn", "example.org", "ad.foo.com"} {
+		if m.Match(d) {
+			t.Error("should not match", d)
+		}
+	}
+	if m.Len() != 6 {
+		t.Error("unexpected size", m.Len())
+	}
+	var nilMatcher *Matcher
+	if nilMatcher.Match("a.com") {
+		t.Error("nil matcher should match nothing")
+	}
+}
@@ -0,0 +1,158 @@
+package domaintrie
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// names in hosts file which are not about blocking
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// ParseListLine parse a line of block list to patterns, format of each
+// line is detected separately:
+//
+//	hosts:    0.0.0.0 ads.example.com [more domains]
+//	dnsmasq:  address=/example.com/0.0.0.0 or server=/example.com/
+//	adblock:  ||example.com^ or @@||example.com^
+//	domain:   example.com or other patterns of Matcher
+//
+// Bare domain, dnsmasq and adblock entries match subdomains too, hosts
+// entries only match exact domain. Comments and lines not about blocking
+// domains(eg: cosmetic filter, dnsmasq forwarding) return nil patterns,
+// err is returned for malformed lines.
+func ParseListLine(line string) (patterns []string, err error) {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "", line[0] == '#', line[0] == '!', line[0] == '[':
+		return nil, nil
+	case strings.HasPrefix(line, "address="), strings.HasPrefix(line, "server="), strings.HasPrefix(line, "local="):
+		return parseDnsmasq(line)
+	case strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@||"), strings.HasPrefix(line, "|"):
+		return parseAdblock(line)
+	case strings.Contains(line, "##") || strings.Contains(line, "#@#"):
+		// cosmetic filter of adblock
+		return nil, nil
+	}
+	if i := strings.Index(line, " #"); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 || net.ParseIP(fields[0]) != nil {
+		return parseHosts(fields)
+	}
+	if strings.HasPrefix(line, "@@") {
+		return []string{line}, nil
+	}
+	if kind, _, err := ParsePattern(line); err == nil && kind == KindExact {
+		return []string{"+." + line}, nil
+	}
+	return []string{line}, nil
+}
+
+func parseHosts(fields []string) ([]string, error) {
+	if net.ParseIP(fields[0]) == nil {
+		return nil, errors.New("invalid hosts line, ip is expected: " + strings.Join(fields, " "))
+	}
+	var patterns []string
+	for _, f := range fields[1:] {
+		if hostsLocalNames[strings.ToLower(f)] {
+			continue
+		}
+		patterns = append(patterns, f)
+	}
+	return patterns, nil
+}
+
+// parseDnsmasq parse address=/a.com/b.com/[ip] and server=/a.com/[ip],
+// server line with an upstream address is forwarding rule, it's ignored.
+func parseDnsmasq(line string) ([]string, error) {
+	i := strings.IndexByte(line, '=')
+	option := line[:i]
+	parts := strings.Split(line[i+1:], "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, errors.New("invalid dnsmasq line: " + line)
+	}
+	if option != "address" && parts[len(parts)-1] != "" {
+		return nil, nil
+	}
+	var patterns []string
+	for _, d := range parts[1 : len(parts)-1] {
+		// "#" matches all domains, too dangerous for a block list
+		if d == "" || d == "#" {
+			continue
+		}
+		patterns = append(patterns, "+."+strings.TrimPrefix(d, "."))
+	}
+	return patterns, nil
+}
+
+// parseAdblock parse basic adblock rule ||domain^, rules with options
+// other than $important and url rules are ignored.
+func parseAdblock(line string) ([]string, error) {
+	exception := strings.HasPrefix(line, "@@")
+	rule := strings.TrimPrefix(line, "@@")
+	if !strings.HasPrefix(rule, "||") {
+		return nil, nil
+	}
+	rule = rule[2:]
+	if i := strings.IndexByte(rule, '$'); i >= 0 {
+		if rule[i+1:] != "important" {
+			return nil, nil
+		}
+		rule = rule[:i]
+	}
+	rule = strings.TrimSuffix(rule, "|")
+	if !strings.HasSuffix(rule, "^") {
+		// rule of url path
+		return nil, nil
+	}
+	domain := strings.TrimSuffix(rule, "^")
+	if domain == "" || strings.ContainsAny(domain, "/^|") {
+		return nil, errors.New("invalid adblock rule: " + line)
+	}
+	p := "+." + domain
+	if strings.Contains(domain, "*") {
+		p = domain
+	}
+	if exception {
+		p = "@@" + p
+	}
+	return []string{p}, nil
+}
+
+// LoadList read block list from r and add patterns to m, malformed lines
+// are skipped and counted, err is only returned for read failure.
+func (m *Matcher) LoadList(r io.Reader) (added, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		patterns, err := ParseListLine(scanner.Text())
+		if err != nil {
+			skipped++
+			continue
+		}
+		for _, p := range patterns {
+			if err := m.Add(p); err != nil {
+				skipped++
+				continue
+			}
+			added++
+		}
+	}
+	return added, skipped, scanner.Err()
+}
@@ -0,0 +1,124 @@
+package domaintrie
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseListLine(t *testing.T) {
+	for line, want := range map[string][]string{
+		"# comment":                            nil,
+		"! adblock comment":                    nil,
+		"[Adblock Plus 2.0]":                   nil,
+		"0.0.0.0 ads.com tracker.com # inline": {"ads.com", "tracker.com"},
+		"127.0.0.1 localhost":                  nil,
+		"::1 ip6-localhost ip6-loopback":       nil,
+		"address=/ads.com/0.0.0.0":             {"+.ads.com"},
+		"address=/a.com/.b.com/":               {"+.a.com", "+.b.com"},
+		"address=/#/0.0.0.0":                   nil,
+		"server=/ads.com/":                     {"+.ads.com"},
+		"server=/baidu.com/114.114.114.114":    nil,
+		"||ads.com^":                           {"+.ads.com"},
+		"||ads.com^$important":                 {"+.ads.com"},
+		"@@||good.ads.com^|":                   {"@@+.good.ads.com"},
+		"||ad*.example.com^":                   {"ad*.example.com"},
+		"||ads.com^$third-party":               nil,
+		"||example.com/banner.gif":             nil,
+		"|https://example.com^":                nil,
+		"example.com##.banner":                 nil,
+		"ads.com":                              {"+.ads.com"},
+		"+.ads.com":                            {"+.ads.com"},
+		"@@good.com":                           {"@@good.com"},
+		`/^ad\d+\./`:                           {`/^ad\d+\./`},
+	} {
+		got, err := ParseListLine(line)
+		if err != nil {
+			t.Error(line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: expected %v, got %v", line, want, got)
+		}
+	}
+	for _, line := range []string{"ads.com tracker.com", "address=ads.com", "||^"} {
+		if _, err := ParseListLine(line); err == nil {
+			t.Error("should fail for", line)
+		}
+	}
+}
+
+func TestLoadList(t *testing.T) {
+	list := `! mixed list
+0.0.0.0 exact.com
+||ads.com^
+@@||good.ads.com^
+address=/tracker.net/
+bad line here
+`
+	m := NewMatcher()
+	added, skipped, err := m.LoadList(strings.NewReader(list))
+	if err != nil || added != 4 || skipped != 1 {
+		t.Fatal("unexpected load result", added, skipped, err)
+	}
+	for _, d := range []string{"exact.com", "x.ads.com", "a.tracker.net"} {
+		if !m.Match(d) {
+			t.Error("should match", d)
+		}
+	}
+	for _, d := range []string{"x.exact.com", "good.ads.com", "a.good.ads.com"} {
+		if m.Match(d) {
+			t.Error("should not match", d)
+		}
+	}
+}
+
+// loadAdHosts load ad_hosts of repo root, benchmark is skipped without it
+func loadAdHosts(b *testing.B) []byte {
+	data, err := ioutil.ReadFile("../ad_hosts")
+	if err != nil {
+		b.Skip("ad_hosts not found:", err)
+	}
+	return data
+}
+
+// BenchmarkLoadAdHosts report heap bytes retained by matcher of ad_hosts
+func BenchmarkLoadAdHosts(b *testing.B) {
+	data := loadAdHosts(b)
+	b.ReportAllocs()
+	var retained uint64
+	var added int
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		m := NewMatcher()
+		n, _, err := m.LoadList(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retained += after.HeapAlloc - before.HeapAlloc
+		added = n
+		runtime.KeepAlive(m)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N), "heap-bytes")
+	b.ReportMetric(float64(added), "domains")
+}
+
+func BenchmarkMatchAdHosts(b *testing.B) {
+	m := NewMatcher()
+	if _, _, err := m.LoadList(bytes.NewReader(loadAdHosts(b))); err != nil {
+		b.Fatal(err)
+	}
+	domains := []string{"www.google.com", "a.b.c.doubleclick.net", "wizhumpgyros.com", "not-an-ad.example.org"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match(domains[i%len(domains)])
+	}
+}
@@ -1,7 +1,6 @@
 module snet
 
 require (
-	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da // indirect
 	github.com/gdamore/tcell v1.3.0
 	github.com/rivo/tview v0.0.0-20200528200248-fe953220389f
 	github.com/shadowsocks/go-shadowsocks2 v0.1.3
@@ -9,4 +8,16 @@ require (
 	golang.org/x/net v0.0.0-20200222125558-5a598a2470a0
 )
 
-go 1.13
+require (
+	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.0.3 // indirect
+	github.com/mattn/go-runewidth v0.0.8 // indirect
+	github.com/riobard/go-bloom v0.0.0-20200213042214-218e1707c495 // indirect
+	github.com/rivo/uniseg v0.1.0 // indirect
+	golang.org/x/crypto v0.0.0-20200128174031-69ecbb4d6d5d // indirect
+	golang.org/x/sys v0.0.0-20200212091648-12a6c2dcc1e4 // indirect
+	golang.org/x/text v0.3.2 // indirect
+)
+
+go 1.18
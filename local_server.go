@@ -1,18 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"snet/cache"
+	"snet/cidradix"
 	"snet/config"
 	"snet/dns"
+	"snet/domaintrie"
+	"snet/ratelimit"
 	"snet/redirector"
+	"snet/remotelist"
+	"snet/rule"
 	"snet/stats"
+	"snet/utils"
+)
+
+const (
+	// number of top domains returned by /dns/stats by default
+	defaultTopDomains = 20
+	// number of queries returned by /dns/log by default
+	defaultQueryLogSize = 100
+	// number of hosts or clients returned by /stats/top by default
+	defaultTopTraffic = 20
 )
 
 type LocalServer struct {
@@ -21,51 +42,100 @@ type LocalServer struct {
 	redir     redirector.Redirector
 	dnServer  *dns.DNS
 	server    *Server
-	stats     *stats.Stats
-	quit      bool
-	qlock     sync.Mutex
-	apiServer *http.Server
-	ctx       context.Context
+	udpServer *UDPServer
+	chnroutes *cidradix.Tree
+	// current chnroutes, may be refreshed from chnroutes-url
+	chnroutesList []string
+	updaterCancel context.CancelFunc
+	saverCancel   context.CancelFunc
+	rules         *rule.Rules
+	ipDomains     *dns.IPDomainMap
+	dnsStats      *dns.QueryStats
+	conns         *stats.ConnTable
+	history       *stats.History
+	historyLock   sync.Mutex // serialize saving of history
+	historySaved  uint64     // changes of history last saved
+	fakeIPs       *dns.FakeIPPool
+	stats         *stats.Stats
+	quit          bool
+	qlock         sync.Mutex
+	apiServer     *http.Server
+	ctx           context.Context
 }
 
 func (s *LocalServer) Clean() {
 	l.Info("cleanup redirector rules")
 	s.redir.CleanupRules(s.cfg.Mode, s.cfg.LHost, s.cfg.LPort, s.DNSPort())
+	if s.cfg.EnableUDPRelay {
+		s.redir.CleanupUDPRules(s.cfg.Mode)
+	}
 	s.redir.Destroy()
 }
 
+// hasIPv6Route check whether there's ipv6 cidr in routes
+func hasIPv6Route(routes []string) bool {
+	for _, r := range routes {
+		if strings.Contains(r, ":") {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *LocalServer) SetupRedirector() error {
 	// bypass logic
 	var bypassCidrs []string
 	var err error
 	if s.cfg.ProxyScope == config.ProxyScopeBypassCN {
-		bypassCidrs = Chnroutes
+		bypassCidrs = s.chnroutesList
+		if s.cfg.EnableIPv6 && !hasIPv6Route(bypassCidrs) {
+			l.Warn("no ipv6 route in chnroutes, ipv6 traffic to China is proxied, set chnroutes-url to apnic stats to fix it")
+		}
 	} else {
 		bypassCidrs = []string{}
 	}
+	bypassIPs := []string{}
 	for _, h := range s.cfg.BypassHosts {
 		ips, err := net.LookupIP(h)
 		if err != nil {
 			exitOnError(err, nil)
 		}
 		for _, ip := range ips {
-			bypassCidrs = append(bypassCidrs, ip.String())
+			bypassIPs = append(bypassIPs, ip.String())
 		}
 	}
 
-	s.redir, err = redirector.NewRedirector(bypassCidrs, s.cfg.BypassSrcIPs, s.cfg.ActiveEni, l)
+	s.redir, err = redirector.NewRedirector(bypassCidrs, s.cfg.BypassSrcIPs, s.cfg.ActiveEni, s.cfg.EnableIPv6, l)
 	exitOnError(err, nil)
-	proxyIP := s.server.proxy.GetProxyIP()
 	if err := s.redir.Init(); err != nil {
 		return err
 	}
-	if err := s.redir.ByPass(proxyIP.String()); err != nil {
-		return err
+	// bypass ips are kept when routes are refreshed
+	for _, ip := range bypassIPs {
+		if err := s.redir.ByPass(ip); err != nil {
+			return err
+		}
+	}
+	for _, proxyIP := range s.server.ProxyIPs() {
+		if err := s.redir.ByPass(proxyIP.String()); err != nil {
+			return err
+		}
 	}
-	if err := s.redir.SetupRules(s.cfg.Mode, s.cfg.LHost, s.cfg.LPort, s.DNSPort(), s.cfg.CNDNS); err != nil {
+	cnDNS := s.cfg.CNDNS
+	if !dns.IsPlainDNS(cnDNS) {
+		// DoH/DoT cn dns is dialed directly, no need to bypass
+		cnDNS = ""
+	}
+	if err := s.redir.SetupRules(s.cfg.Mode, s.cfg.LHost, s.cfg.LPort, s.DNSPort(), cnDNS); err != nil {
 		s.Clean()
 		return err
 	}
+	if s.cfg.EnableUDPRelay {
+		if err := s.redir.SetupUDPRules(s.cfg.Mode, s.cfg.LPort); err != nil {
+			s.Clean()
+			return err
+		}
+	}
 	return nil
 }
 
@@ -74,14 +144,204 @@ func (s *LocalServer) DNSPort() int {
 }
 
 func (s *LocalServer) SetupDNServer(dnsCache *cache.LRU) error {
-	dns, err := dns.NewServer(s.ctx, s.cfg, s.DNSPort(), Chnroutes, l)
+	dns, err := dns.NewServer(s.ctx, s.cfg, s.DNSPort(), s.chnroutes, s.rules, l)
 	if err != nil {
 		return err
 	}
 	s.dnServer = dns
-	if dnsCache != nil {
-		s.dnServer.Cache = dnsCache
+	if dnsCache != nil && s.dnServer.Cache != nil {
+		if err := s.dnServer.UseCache(dnsCache); err != nil {
+			return err
+		}
+	}
+	s.dnServer.IPDomains = s.ipDomains
+	if s.cfg.EnableStats {
+		s.dnServer.Stats = s.dnsStats
 	}
+	if s.cfg.EnableFakeIP {
+		s.dnServer.FakeIPs = s.fakeIPs
+	}
+	s.dnServer.ProxyDial = s.dialProxy
+	s.dnServer.DirectDial = s.dialDirect
+	return nil
+}
+
+// dialProxy dial addr(host:port) through default proxy
+func (s *LocalServer) dialProxy(network, addr string) (net.Conn, error) {
+	host, port, err := utils.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.server.getProxy("")
+	if err != nil {
+		return nil, err
+	}
+	return p.Dial(host, port)
+}
+
+// dialDirect dial addr(host:port) bypass snet
+func (s *LocalServer) dialDirect(network, addr string) (net.Conn, error) {
+	host, port, err := utils.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return redirector.DialDirect(network, host, port, time.Duration(s.cfg.ProxyTimeout)*time.Second)
+}
+
+// startListUpdater load cached remote lists and refresh them in background,
+// lists are downloaded directly first, then through default proxy.
+func (s *LocalServer) startListUpdater() {
+	// cancelled by Shutdown under qlock, updates of lists after that are
+	// dropped, they are for server of previous config
+	ctx, cancel := context.WithCancel(s.ctx)
+	var lists []*remotelist.List
+	if s.cfg.ChnroutesURL != "" {
+		lists = append(lists, &remotelist.List{URL: s.cfg.ChnroutesURL, Update: s.updateChnroutes})
+	}
+	blockLists := make(map[string][]byte)
+	for _, url := range s.cfg.BlockHostURLs {
+		url := url
+		lists = append(lists, &remotelist.List{URL: url, Update: func(data []byte) error {
+			added, _, err := domaintrie.NewMatcher().LoadList(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			if added == 0 {
+				return errors.New("no domain found in block list")
+			}
+			s.qlock.Lock()
+			defer s.qlock.Unlock()
+			if s.quit || ctx.Err() != nil {
+				return errors.New("server is shutdown")
+			}
+			blockLists[url] = data
+			all := make([][]byte, 0, len(blockLists))
+			for _, u := range s.cfg.BlockHostURLs {
+				if data, ok := blockLists[u]; ok {
+					all = append(all, data)
+				}
+			}
+			return s.dnServer.SetBlockLists(all)
+		}})
+	}
+	if len(lists) == 0 {
+		cancel()
+		return
+	}
+	updater := remotelist.NewUpdater(lists, s.cfg.ListCacheDir, time.Duration(s.cfg.ListRefreshInterval)*time.Second,
+		[]remotelist.DialFunc{s.dialDirect, s.dialProxy}, l)
+	stale := updater.LoadCache()
+	s.updaterCancel = cancel
+	go func() {
+		// hosts of lists may be resolved by snet dns, so downloading starts
+		// after it's listening
+		select {
+		case <-s.dnServer.Ready():
+			updater.Run(ctx, stale)
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// startDNSCacheSaver load dns cache snapshot if load is true, and save
+// cache every dns-cache-save-interval seconds.
+func (s *LocalServer) startDNSCacheSaver(load bool) {
+	c := s.dnServer.Cache
+	if c == nil || s.cfg.DNSCacheFile == "" {
+		return
+	}
+	if load {
+		n, err := c.LoadFile(s.cfg.DNSCacheFile)
+		if err != nil && !os.IsNotExist(err) {
+			l.Error("failed to load dns cache:", err)
+		} else if err == nil {
+			l.Infof("%d dns cache entries loaded", n)
+		}
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.saverCancel = cancel
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.cfg.DNSCacheSaveInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.saveDNSCache()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// startHistory load traffic history and save it every
+// stats-history-save-interval seconds, history is kept across config reload.
+func (s *LocalServer) startHistory() {
+	s.history = stats.NewHistory()
+	if err := s.history.LoadFile(s.cfg.StatsHistoryFile); err != nil && !os.IsNotExist(err) {
+		l.Error("failed to load traffic history:", err)
+	}
+	s.conns.SetHistory(s.history)
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.cfg.StatsHistorySaveInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.saveHistory()
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// saveHistory save traffic history if it changed since last save, to
+// reduce writes to flash of routers
+func (s *LocalServer) saveHistory() {
+	s.historyLock.Lock()
+	defer s.historyLock.Unlock()
+	s.conns.Flush()
+	changes := s.history.Changes()
+	if changes == s.historySaved {
+		return
+	}
+	if err := utils.WriteFileAtomic(s.cfg.StatsHistoryFile, 0600, s.history.Save); err != nil {
+		l.Error("failed to save traffic history:", err)
+		return
+	}
+	s.historySaved = changes
+}
+
+func (s *LocalServer) saveDNSCache() {
+	if err := utils.WriteFileAtomic(s.cfg.DNSCacheFile, 0600, s.dnServer.Cache.Save); err != nil {
+		l.Error("failed to save dns cache:", err)
+	}
+}
+
+// updateChnroutes swap chnroutes used by rules, dns and redirector
+func (s *LocalServer) updateChnroutes(data []byte) error {
+	routes, err := remotelist.ParseChnroutes(data)
+	if err != nil {
+		return err
+	}
+	tree, err := cidradix.NewTreeFromCIDRs(routes)
+	if err != nil {
+		return err
+	}
+	s.qlock.Lock()
+	defer s.qlock.Unlock()
+	if s.quit {
+		return errors.New("server is shutdown")
+	}
+	if s.cfg.ProxyScope == config.ProxyScopeBypassCN {
+		if err := s.redir.UpdateRoutes(routes); err != nil {
+			return err
+		}
+	}
+	s.chnroutes.Replace(tree)
+	s.chnroutesList = routes
+	l.Infof("chnroutes updated, %d cidrs", len(routes))
 	return nil
 }
 
@@ -91,8 +351,23 @@ func (s *LocalServer) Shutdown() {
 	if s.quit {
 		return
 	}
+	if s.updaterCancel != nil {
+		s.updaterCancel()
+		s.updaterCancel = nil
+	}
+	if s.saverCancel != nil {
+		s.saverCancel()
+		s.saverCancel = nil
+		s.saveDNSCache()
+	}
+	if s.history != nil {
+		s.saveHistory()
+	}
 	s.dnServer.Shutdown()
 	s.server.Shutdown()
+	if s.udpServer != nil {
+		s.udpServer.Shutdown()
+	}
 	if s.cfg.EnableStats {
 		s.apiServer.Shutdown(s.ctx)
 	}
@@ -103,10 +378,66 @@ func (s *LocalServer) Shutdown() {
 func (s *LocalServer) Run(dnsCache *cache.LRU) {
 	var err error
 	s.quit = false
-	s.server, err = NewServer(s.ctx, s.cfg)
+	if s.chnroutes == nil {
+		s.chnroutesList = Chnroutes
+		s.chnroutes, err = cidradix.NewTreeFromCIDRs(Chnroutes)
+		exitOnError(err, nil)
+	}
+	s.rules, err = rule.NewFromConfig(s.cfg, s.chnroutes)
 	exitOnError(err, nil)
+	s.server, err = NewServer(s.ctx, s.cfg, s.rules)
+	exitOnError(err, nil)
+	s.server.limiter, err = ratelimit.NewFromConfig(s.cfg, s.chnroutes)
+	exitOnError(err, nil)
+	if s.ipDomains == nil {
+		s.ipDomains = dns.NewIPDomainMap()
+	}
+	if s.dnsStats == nil {
+		s.dnsStats = dns.NewQueryStats()
+	}
+	// connections accepted before config reload are still tracked
+	if s.conns == nil {
+		s.conns = stats.NewConnTable()
+	}
+	// keep fake ip mapping across config reload, clients may cache answers
+	if s.cfg.EnableFakeIP && (s.fakeIPs == nil || s.fakeIPs.Range() != s.cfg.FakeIPRange) {
+		s.fakeIPs, err = dns.NewFakeIPPool(s.cfg.FakeIPRange)
+		exitOnError(err, nil)
+	}
+	targets := &targetResolver{ipDomains: s.ipDomains}
+	if s.cfg.EnableFakeIP {
+		targets.fakeIPs = s.fakeIPs
+	}
+	s.server.targets = targets
+	if s.cfg.EnableStats {
+		s.server.conns = s.conns
+		if s.history == nil {
+			s.startHistory()
+		}
+		// quota is checked against traffic history
+		s.server.limiter.SetUsage(func(client string) uint64 {
+			u := s.history.MonthUsage(client, time.Now())
+			return u.RxSize + u.TxSize
+		})
+	} else if len(s.cfg.ClientQuotas) > 0 {
+		l.Warn("client-quotas is ignored, enable-stats is required")
+	}
+	s.udpServer = nil
+	if s.cfg.EnableUDPRelay {
+		s.udpServer, err = NewUDPServer(s.ctx, s.cfg, s.server.proxies, s.server.defaultProxy, s.rules)
+		exitOnError(err, nil)
+		s.udpServer.targets = targets
+		s.udpServer.limiter = s.server.limiter
+		if s.cfg.EnableStats {
+			s.udpServer.conns = s.conns
+		}
+	}
 	exitOnError(s.SetupDNServer(dnsCache), nil)
+	// cache passed in is kept across config reload, only load snapshot on start
+	s.startDNSCacheSaver(dnsCache == nil)
+	targets.resolve = s.dnServer.Resolve
 	exitOnError(s.SetupRedirector(), nil)
+	s.startListUpdater()
 
 	go func() {
 		cfg := <-s.cfgChan
@@ -118,6 +449,9 @@ func (s *LocalServer) Run(dnsCache *cache.LRU) {
 
 	go s.dnServer.Run()
 	go s.server.Run()
+	if s.udpServer != nil {
+		go s.udpServer.Run()
+	}
 	if s.cfg.EnableStats {
 		go s.refreshTrafficRate()
 		go s.startApiServer()
@@ -133,11 +467,132 @@ func (s *LocalServer) startApiServer() {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(s.stats.ToJson())
 	})
+	mux.HandleFunc("/stats/history", s.serveHistory)
+	mux.HandleFunc("/stats/top", s.serveTopTraffic)
+	mux.HandleFunc("/proxies", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.server.ProxyGroupStates())
+	})
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/connections", s.serveConnections)
+	mux.HandleFunc("/connections/", s.serveConnection)
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.conns.Clients())
+	})
+	mux.HandleFunc("/clients/", func(w http.ResponseWriter, r *http.Request) {
+		// traffic of a client by destination
+		ip := strings.TrimPrefix(r.URL.Path, "/clients/")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.conns.Destinations(ip))
+	})
+	mux.HandleFunc("/dns/log", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil || n <= 0 {
+			n = defaultQueryLogSize
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.dnsStats.QueryLog(n))
+	})
+	mux.HandleFunc("/dns/stats", func(w http.ResponseWriter, r *http.Request) {
+		// number of top queried and blocked domains
+		top, err := strconv.Atoi(r.URL.Query().Get("top"))
+		if err != nil || top <= 0 {
+			top = defaultTopDomains
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.dnServer.StatsSnapshot(top))
+	})
 	s.apiServer = &http.Server{Addr: addr, Handler: mux}
 	l.Infof("api server listen on http://%s", addr)
 	s.apiServer.ListenAndServe()
 }
 
+// serveHistory return total traffic of last n minutes, hours, days or
+// months, by GET /stats/history?unit=hour&n=24
+func (s *LocalServer) serveHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	unit := q.Get("unit")
+	if unit == "" {
+		unit = stats.UnitHour
+	}
+	n, _ := strconv.Atoi(q.Get("n"))
+	points, err := s.history.Series(unit, n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(points)
+}
+
+// serveTopTraffic return traffic of current hour, day or month and its top
+// hosts or clients, by GET /stats/top?unit=month&by=host&n=20
+func (s *LocalServer) serveTopTraffic(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	unit, by := q.Get("unit"), q.Get("by")
+	if unit == "" {
+		unit = stats.UnitMonth
+	}
+	if by == "" {
+		by = "host"
+	}
+	n, err := strconv.Atoi(q.Get("n"))
+	if err != nil || n <= 0 {
+		n = defaultTopTraffic
+	}
+	// traffic of open connections is included
+	s.conns.Flush()
+	top, err := s.history.Top(unit, by, n, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(top)
+}
+
+// serveConnections list open connections, or close all connections to
+// host by DELETE /connections?host=xxx
+func (s *LocalServer) serveConnections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.conns.List())
+	case http.MethodDelete:
+		host := r.URL.Query().Get("host")
+		if host == "" {
+			http.Error(w, "host is required", http.StatusBadRequest)
+			return
+		}
+		n := s.conns.CloseHost(host)
+		l.Infof("%d connections to %s closed by api", n, host)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"Closed": n})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveConnection close a connection by DELETE /connections/{id}
+func (s *LocalServer) serveConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	if !s.conns.Close(id) {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	l.Info("connection closed by api:", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *LocalServer) refreshTrafficRate() {
 	ticker := time.Tick(1 * time.Second)
 	for {
@@ -148,6 +603,7 @@ func (s *LocalServer) refreshTrafficRate() {
 			s.stats.Record(s.server.HostRxBytesTotal.m, s.server.HostTxBytesTotal.m)
 			s.server.HostRxBytesTotal.RUnlock()
 			s.server.HostTxBytesTotal.RUnlock()
+			s.conns.Flush()
 		case <-s.ctx.Done():
 			l.Info("quit traffic stats refresh goroutine")
 			return
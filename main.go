@@ -74,7 +74,7 @@ func main() {
 		ctx, cancel := context.WithCancel(context.Background())
 		s := NewLocalServer(ctx, c)
 		if *clean {
-			s.server, err = NewServer(ctx, c)
+			s.server, err = NewServer(ctx, c, nil)
 			exitOnError(err, nil)
 			s.SetupRedirector()
 			s.Clean()
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+
+	"snet/metrics"
+)
+
+// serveMetrics write metrics in Prometheus text format
+func (s *LocalServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := metrics.NewWriter(w)
+	s.writeTrafficMetrics(mw)
+	mw.Gauge("snet_active_connections", "Number of tcp connections being relayed.", float64(s.server.ActiveConns()))
+	errs := s.server.DialErrors()
+	for _, upstream := range sortedKeys(errs) {
+		mw.Counter("snet_dial_errors_total", "Failed dials by upstream, direct or proxy name.", float64(errs[upstream]),
+			metrics.Label{Name: "upstream", Value: upstream})
+	}
+	s.writeDNSMetrics(mw)
+	mw.Flush()
+}
+
+func (s *LocalServer) writeTrafficMetrics(mw *metrics.Writer) {
+	for _, m := range []struct {
+		name, help string
+		hosts      *HostBytesMap
+	}{
+		{"snet_rx_bytes_total", "Bytes received from destination.", s.server.HostRxBytesTotal},
+		{"snet_tx_bytes_total", "Bytes sent to destination.", s.server.HostTxBytesTotal},
+	} {
+		m.hosts.RLock()
+		for _, hostPort := range sortedKeys(m.hosts.m) {
+			host, port, _ := net.SplitHostPort(hostPort)
+			mw.Counter(m.name, m.help, float64(m.hosts.m[hostPort]),
+				metrics.Label{Name: "host", Value: host}, metrics.Label{Name: "port", Value: port})
+		}
+		m.hosts.RUnlock()
+	}
+}
+
+func (s *LocalServer) writeDNSMetrics(mw *metrics.Writer) {
+	st := s.dnServer.StatsSnapshot(0)
+	if st == nil {
+		return
+	}
+	for _, reason := range sortedKeys(st.Reasons) {
+		mw.Counter("snet_dns_queries_total", "DNS queries by how they are answered.", float64(st.Reasons[reason]),
+			metrics.Label{Name: "reason", Value: reason})
+	}
+	mw.Counter("snet_dns_cache_hits_total", "DNS cache hits.", float64(st.Cache.Hits))
+	mw.Counter("snet_dns_cache_misses_total", "DNS cache misses.", float64(st.Cache.Misses))
+	mw.Gauge("snet_dns_cache_entries", "Entries in dns cache.", float64(st.Cache.Size))
+	upstreams := make([]string, 0, len(st.Upstreams))
+	for name := range st.Upstreams {
+		upstreams = append(upstreams, name)
+	}
+	sort.Strings(upstreams)
+	for _, name := range upstreams {
+		u := st.Upstreams[name]
+		buckets := make([]metrics.Bucket, 0, len(u.Buckets))
+		for _, b := range u.Buckets {
+			le := math.Inf(1)
+			if b.LE != 0 {
+				le = b.LE / 1000
+			}
+			buckets = append(buckets, metrics.Bucket{LE: le, Count: b.Count})
+		}
+		mw.Histogram("snet_dns_upstream_latency_seconds", "Latency of successful queries to upstream dns.",
+			buckets, u.Count, u.SumMs/1000, metrics.Label{Name: "upstream", Value: name})
+	}
+	for _, name := range upstreams {
+		mw.Counter("snet_dns_upstream_errors_total", "Failed queries to upstream dns.", float64(st.Upstreams[name].Errors),
+			metrics.Label{Name: "upstream", Value: name})
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
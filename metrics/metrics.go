@@ -0,0 +1,121 @@
+// Package metrics write metrics in Prometheus text exposition format,
+// samples of a metric should be written together.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Label of a sample
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Bucket of histogram, Count is cumulative, LE of +Inf bucket is math.Inf(1)
+type Bucket struct {
+	LE    float64
+	Count uint64
+}
+
+// Writer write samples, HELP and TYPE lines are written before the first
+// sample of each metric.
+type Writer struct {
+	w    *bufio.Writer
+	seen map[string]bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w), seen: make(map[string]bool)}
+}
+
+// Flush write buffered data to underlying writer
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+func (w *Writer) Counter(name, help string, v float64, labels ...Label) {
+	w.header(name, help, typeCounter)
+	w.sample(name, v, labels)
+}
+
+func (w *Writer) Gauge(name, help string, v float64, labels ...Label) {
+	w.header(name, help, typeGauge)
+	w.sample(name, v, labels)
+}
+
+// Histogram write buckets, sum and count, +Inf bucket is added if missing
+func (w *Writer) Histogram(name, help string, buckets []Bucket, count uint64, sum float64, labels ...Label) {
+	w.header(name, help, typeHistogram)
+	buckets = append([]Bucket(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].LE < buckets[j].LE })
+	if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].LE, 1) {
+		buckets = append(buckets, Bucket{LE: math.Inf(1), Count: count})
+	}
+	for _, b := range buckets {
+		le := append(labels[:len(labels):len(labels)], Label{"le", formatFloat(b.LE)})
+		w.sample(name+"_bucket", float64(b.Count), le)
+	}
+	w.sample(name+"_sum", sum, labels)
+	w.sample(name+"_count", float64(count), labels)
+}
+
+func (w *Writer) header(name, help, typ string) {
+	if w.seen[name] {
+		return
+	}
+	w.seen[name] = true
+	w.w.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	w.w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func (w *Writer) sample(name string, v float64, labels []Label) {
+	w.w.WriteString(name)
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			w.w.WriteString(l.Name + `="` + escapeLabel(l.Value) + `"`)
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
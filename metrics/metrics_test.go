@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Counter("snet_rx_bytes_total", "Bytes received.", 1024, Label{"host", "a.com"}, Label{"port", "443"})
+	w.Counter("snet_rx_bytes_total", "Bytes received.", 2e10, Label{"host", `b"\` + "\n"})
+	w.Gauge("snet_active_connections", "Active connections.", 3)
+	w.Histogram("snet_latency_seconds", "Latency.", []Bucket{{0.1, 2}, {0.01, 1}}, 3, 0.5, Label{"upstream", "cn"})
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP snet_rx_bytes_total Bytes received.
+# TYPE snet_rx_bytes_total counter
+snet_rx_bytes_total{host="a.com",port="443"} 1024
+snet_rx_bytes_total{host="b\"\\\n"} 2e+10
+# HELP snet_active_connections Active connections.
+# TYPE snet_active_connections gauge
+snet_active_connections 3
+# HELP snet_latency_seconds Latency.
+# TYPE snet_latency_seconds histogram
+snet_latency_seconds_bucket{upstream="cn",le="0.01"} 1
+snet_latency_seconds_bucket{upstream="cn",le="0.1"} 2
+snet_latency_seconds_bucket{upstream="cn",le="+Inf"} 3
+snet_latency_seconds_sum{upstream="cn"} 0.5
+snet_latency_seconds_count{upstream="cn"} 3
+`
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
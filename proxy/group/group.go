@@ -0,0 +1,372 @@
+// Package group implement proxy group, which select a healthy member proxy
+// to dial by strategy. Members are probed periodically by sending a http
+// request to check url through them.
+package group
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"snet/proxy"
+)
+
+const (
+	StrategyFailover      = "failover"
+	StrategyRoundRobin    = "round-robin"
+	StrategyLowestLatency = "lowest-latency"
+)
+
+const (
+	DefaultCheckURL      = "http://www.gstatic.com/generate_204"
+	DefaultCheckInterval = 60
+	DefaultCheckTimeout  = 5
+)
+
+type Config struct {
+	Strategy      string
+	CheckURL      string
+	CheckInterval int // seconds
+	CheckTimeout  int // seconds
+	Names         []string
+	Members       []proxy.Proxy
+}
+
+type member struct {
+	name      string
+	proxy     proxy.Proxy
+	up        bool
+	checked   bool
+	latency   time.Duration
+	lastCheck time.Time
+	lastErr   string
+}
+
+// MemberState is member's health check result exposed by stats api
+type MemberState struct {
+	Name      string    `json:"name"`
+	Up        bool      `json:"up"`
+	Checked   bool      `json:"checked"`
+	LatencyMs int64     `json:"latency_ms"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type State struct {
+	Strategy string         `json:"strategy"`
+	Current  string         `json:"current"`
+	Members  []*MemberState `json:"members"`
+}
+
+type Group struct {
+	strategy string
+	checkURL *url.URL
+	interval time.Duration
+	timeout  time.Duration
+	members  []*member
+	lock     sync.RWMutex
+	next     uint32 // round robin counter
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (g *Group) Init(c proxy.Config) error {
+	cfg := c.(*Config)
+	switch cfg.Strategy {
+	case "":
+		g.strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyLowestLatency:
+		g.strategy = cfg.Strategy
+	default:
+		return errors.New("invalid proxy group strategy " + cfg.Strategy)
+	}
+	if len(cfg.Members) == 0 || len(cfg.Members) != len(cfg.Names) {
+		return errors.New("proxy group requires members")
+	}
+	checkURL := cfg.CheckURL
+	if checkURL == "" {
+		checkURL = DefaultCheckURL
+	}
+	u, err := url.Parse(checkURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" {
+		return errors.New("only http check url is supported: " + checkURL)
+	}
+	g.checkURL = u
+	g.interval = time.Duration(cfg.CheckInterval) * time.Second
+	if g.interval <= 0 {
+		g.interval = DefaultCheckInterval * time.Second
+	}
+	g.timeout = time.Duration(cfg.CheckTimeout) * time.Second
+	if g.timeout <= 0 {
+		g.timeout = DefaultCheckTimeout * time.Second
+	}
+	g.members = make([]*member, 0, len(cfg.Members))
+	for i, p := range cfg.Members {
+		g.members = append(g.members, &member{name: cfg.Names[i], proxy: p})
+	}
+	g.done = make(chan struct{})
+	return nil
+}
+
+// GetProxyIP return current selected member's ip
+func (g *Group) GetProxyIP() net.IP {
+	candidates := g.order(false)
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[0].proxy.GetProxyIP()
+}
+
+func (g *Group) Dial(host string, port int) (net.Conn, error) {
+	var lastErr error
+	for _, m := range g.candidates() {
+		conn, err := m.proxy.Dial(host, port)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		g.markDown(m, err)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no proxy available in group")
+	}
+	return nil, lastErr
+}
+
+// DialUDP dial through members which support udp relay in the same order
+// as Dial, failed member is marked down and next one is tried.
+func (g *Group) DialUDP(host string, port int) (net.Conn, error) {
+	var lastErr error
+	for _, m := range g.candidates() {
+		up, ok := m.proxy.(proxy.UDPProxy)
+		if !ok {
+			continue
+		}
+		conn, err := up.DialUDP(host, port)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		g.markDown(m, err)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no proxy support udp relay in group")
+	}
+	return nil, lastErr
+}
+
+// Close stop health check
+func (g *Group) Close() error {
+	g.once.Do(func() { close(g.done) })
+	return nil
+}
+
+// Run check members' health periodically until ctx done or group closed
+func (g *Group) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		g.CheckAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll probe all members concurrently
+func (g *Group) CheckAll() {
+	var wg sync.WaitGroup
+	for _, m := range g.members {
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			start := time.Now()
+			err := g.check(m.proxy)
+			g.lock.Lock()
+			defer g.lock.Unlock()
+			m.checked = true
+			m.lastCheck = start
+			m.up = err == nil
+			if err != nil {
+				m.lastErr = err.Error()
+			} else {
+				m.lastErr = ""
+				m.latency = time.Since(start)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// check send a http HEAD request to check url through p
+func (g *Group) check(p proxy.Proxy) error {
+	host := g.checkURL.Hostname()
+	port := 80
+	if g.checkURL.Port() != "" {
+		var err error
+		if port, err = strconv.Atoi(g.checkURL.Port()); err != nil {
+			return err
+		}
+	}
+	conn, err := p.Dial(host, port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(g.timeout)); err != nil {
+		return err
+	}
+	req := fmt.Sprintf("HEAD %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", g.checkURL.RequestURI(), g.checkURL.Host)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("bad status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (g *Group) markDown(m *member, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	m.up = false
+	m.checked = true
+	m.lastErr = err.Error()
+}
+
+// candidates return members in the order they should be tried,
+// round robin position moves forward on every call.
+func (g *Group) candidates() []*member {
+	return g.order(true)
+}
+
+// order sort members by strategy. Members not known to be down are
+// preferred, down members are still tried at last, health check may
+// lag behind.
+func (g *Group) order(rotate bool) []*member {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	var alive, down []*member
+	for _, m := range g.members {
+		if m.checked && !m.up {
+			down = append(down, m)
+		} else {
+			alive = append(alive, m)
+		}
+	}
+	switch g.strategy {
+	case StrategyRoundRobin:
+		if len(alive) > 1 {
+			n := atomic.LoadUint32(&g.next)
+			if rotate {
+				n = atomic.AddUint32(&g.next, 1) - 1
+			}
+			i := int(n % uint32(len(alive)))
+			rotated := make([]*member, 0, len(alive))
+			alive = append(append(rotated, alive[i:]...), alive[:i]...)
+		}
+	case StrategyLowestLatency:
+		// insertion sort, unchecked members go last
+		for i := 1; i < len(alive); i++ {
+			for j := i; j > 0 && fasterThan(alive[j], alive[j-1]); j-- {
+				alive[j], alive[j-1] = alive[j-1], alive[j]
+			}
+		}
+	}
+	return append(alive, down...)
+}
+
+func fasterThan(a, b *member) bool {
+	if a.up != b.up {
+		return a.up
+	}
+	return a.latency < b.latency
+}
+
+// State return group's current state
+func (g *Group) State() *State {
+	candidates := g.order(false)
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	s := &State{Strategy: g.strategy, Members: make([]*MemberState, 0, len(g.members))}
+	if len(candidates) > 0 {
+		s.Current = candidates[0].name
+	}
+	for _, m := range g.members {
+		s.Members = append(s.Members, &MemberState{
+			Name:      m.name,
+			Up:        m.up,
+			Checked:   m.checked,
+			LatencyMs: int64(m.latency / time.Millisecond),
+			LastCheck: m.lastCheck,
+			LastError: m.lastErr,
+		})
+	}
+	return s
+}
+
+// SortGroups return group names in the order they should be built, a group
+// used as member of other groups comes before them. members is member names
+// of each group, names not in it are proxies. Cyclic reference is an error.
+func SortGroups(members map[string][]string) ([]string, error) {
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(members))
+	result := make([]string, 0, len(members))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return errors.New("cyclic proxy group: " + strings.Join(append(path, name), " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, m := range members[name] {
+			if _, ok := members[m]; !ok {
+				continue
+			}
+			if err := visit(m, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		result = append(result, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
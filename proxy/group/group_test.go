@@ -0,0 +1,222 @@
+package group
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"snet/proxy"
+)
+
+// fakeProxy dial target directly, or fail if down
+type fakeProxy struct {
+	ip    net.IP
+	down  bool
+	delay time.Duration
+	dials int
+}
+
+func (p *fakeProxy) Init(c proxy.Config) error { return nil }
+func (p *fakeProxy) GetProxyIP() net.IP        { return p.ip }
+func (p *fakeProxy) Close() error              { return nil }
+
+func (p *fakeProxy) Dial(host string, port int) (net.Conn, error) {
+	p.dials++
+	if p.down {
+		return nil, errors.New("proxy down")
+	}
+	time.Sleep(p.delay)
+	return net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func newGroup(t *testing.T, strategy, checkURL string, members ...*fakeProxy) *Group {
+	cfg := &Config{Strategy: strategy, CheckURL: checkURL}
+	for i, m := range members {
+		cfg.Names = append(cfg.Names, "p"+strconv.Itoa(i))
+		cfg.Members = append(cfg.Members, m)
+	}
+	g := new(Group)
+	if err := g.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestInit(t *testing.T) {
+	g := new(Group)
+	if err := g.Init(&Config{Strategy: "random", Names: []string{"a"}, Members: []proxy.Proxy{&fakeProxy{}}}); err == nil {
+		t.Error("invalid strategy should fail")
+	}
+	if err := g.Init(&Config{}); err == nil {
+		t.Error("empty group should fail")
+	}
+	if err := g.Init(&Config{CheckURL: "https://x.com", Names: []string{"a"}, Members: []proxy.Proxy{&fakeProxy{}}}); err == nil {
+		t.Error("https check url should fail")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
+	a := &fakeProxy{ip: net.ParseIP("1.1.1.1"), down: true}
+	b := &fakeProxy{ip: net.ParseIP("2.2.2.2")}
+	g := newGroup(t, StrategyFailover, "", a, b)
+	conn, err := g.Dial("127.0.0.1", addr.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if a.dials != 1 || b.dials != 1 {
+		t.Error("should try a then b, got", a.dials, b.dials)
+	}
+	if !g.GetProxyIP().Equal(b.ip) {
+		t.Error("down member should be skipped, current:", g.GetProxyIP())
+	}
+	if _, err := g.Dial("127.0.0.1", addr.Port); err != nil {
+		t.Fatal(err)
+	}
+	if a.dials != 1 || b.dials != 2 {
+		t.Error("down member should be tried last, got", a.dials, b.dials)
+	}
+	b.down = true
+	if _, err := g.Dial("127.0.0.1", addr.Port); err == nil {
+		t.Error("dial should fail if all members down")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	a := &fakeProxy{ip: net.ParseIP("1.1.1.1")}
+	b := &fakeProxy{ip: net.ParseIP("2.2.2.2")}
+	g := newGroup(t, StrategyRoundRobin, "", a, b)
+	first := g.candidates()[0]
+	second := g.candidates()[0]
+	if first == second {
+		t.Error("round robin should rotate members")
+	}
+	if g.order(false)[0] != g.order(false)[0] {
+		t.Error("order without rotate should be stable")
+	}
+}
+
+func TestCheckAll(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Error("unexpected method", r.Method)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	slow := &fakeProxy{ip: net.ParseIP("1.1.1.1"), delay: 50 * time.Millisecond}
+	fast := &fakeProxy{ip: net.ParseIP("2.2.2.2")}
+	down := &fakeProxy{ip: net.ParseIP("3.3.3.3"), down: true}
+	g := newGroup(t, StrategyLowestLatency, ts.URL+"/generate_204", slow, fast, down)
+	g.CheckAll()
+	state := g.State()
+	if state.Current != "p1" {
+		t.Error("fastest member should be selected, got", state.Current)
+	}
+	for i, up := range []bool{true, true, false} {
+		m := state.Members[i]
+		if !m.Checked || m.Up != up {
+			t.Errorf("unexpected state of %s: %+v", m.Name, m)
+		}
+	}
+	if state.Members[2].LastError == "" {
+		t.Error("down member should have error")
+	}
+}
+
+func TestNestedGroup(t *testing.T) {
+	members := map[string][]string{
+		"auto":   {"hk", "backup"},
+		"backup": {"us", "jp"},
+		"hk":     {"hk1", "hk2"},
+	}
+	order, err := SortGroups(members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := make(map[string]int)
+	for i, name := range order {
+		pos[name] = i
+	}
+	if len(order) != 3 || pos["auto"] < pos["backup"] || pos["auto"] < pos["hk"] {
+		t.Error("members should be built before group", order)
+	}
+	members["backup"] = []string{"us", "auto"}
+	if _, err := SortGroups(members); err == nil {
+		t.Error("cyclic groups should fail")
+	}
+	members["backup"] = []string{"backup"}
+	if _, err := SortGroups(members); err == nil {
+		t.Error("group of itself should fail")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a := &fakeProxy{ip: net.ParseIP("1.1.1.1"), down: true}
+	b := &fakeProxy{ip: net.ParseIP("2.2.2.2")}
+	inner := newGroup(t, StrategyFailover, "", a)
+	outer := new(Group)
+	if err := outer.Init(&Config{Names: []string{"inner", "b"}, Members: []proxy.Proxy{inner, b}}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := outer.Dial("127.0.0.1", ln.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if a.dials != 1 || b.dials != 1 {
+		t.Error("should fail over from inner group", a.dials, b.dials)
+	}
+}
+
+// fakeUDPProxy is fakeProxy with udp relay
+type fakeUDPProxy struct {
+	fakeProxy
+	udpDials int
+}
+
+func (p *fakeUDPProxy) DialUDP(host string, port int) (net.Conn, error) {
+	p.udpDials++
+	if p.down {
+		return nil, errors.New("proxy down")
+	}
+	return net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+func TestDialUDPFailover(t *testing.T) {
+	tcpOnly := &fakeProxy{ip: net.ParseIP("1.1.1.1")}
+	a := &fakeUDPProxy{fakeProxy: fakeProxy{ip: net.ParseIP("2.2.2.2"), down: true}}
+	b := &fakeUDPProxy{fakeProxy: fakeProxy{ip: net.ParseIP("3.3.3.3")}}
+	g := new(Group)
+	if err := g.Init(&Config{Names: []string{"tcp", "a", "b"}, Members: []proxy.Proxy{tcpOnly, a, b}}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := g.DialUDP("127.0.0.1", 53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if a.udpDials != 1 || b.udpDials != 1 {
+		t.Error("should fail over to b", a.udpDials, b.udpDials)
+	}
+	if _, err := g.DialUDP("127.0.0.1", 53); err != nil || a.udpDials != 1 || b.udpDials != 2 {
+		t.Error("down member should be tried last", err, a.udpDials, b.udpDials)
+	}
+	b.down = true
+	if _, err := g.DialUDP("127.0.0.1", 53); err == nil {
+		t.Error("dial should fail if all members down")
+	}
+}
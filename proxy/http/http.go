@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 
 	"snet/proxy"
 )
@@ -38,12 +39,12 @@ func (s *Server) GetProxyIP() net.IP {
 }
 
 func (s *Server) Dial(dstHost string, dstPort int) (net.Conn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", s.Host, s.Port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(s.Host.String(), strconv.Itoa(s.Port)))
 	if err != nil {
 		return nil, err
 	}
-	handshake := fmt.Sprintf("Connect %s:%d HTTP/1.1\r\nProxy-Authorization: Basic %s\r\n\r\n",
-		dstHost, dstPort, s.auth)
+	handshake := fmt.Sprintf("Connect %s HTTP/1.1\r\nProxy-Authorization: Basic %s\r\n\r\n",
+		net.JoinHostPort(dstHost, strconv.Itoa(dstPort)), s.auth)
 	_, err = conn.Write([]byte(handshake))
 	if err != nil {
 		return nil, err
@@ -65,5 +66,5 @@ func (s *Server) Close() error {
 }
 
 func init() {
-	proxy.Register("http", new(Server))
+	proxy.Register("http", func() proxy.Proxy { return new(Server) })
 }
@@ -14,19 +14,30 @@ type Proxy interface {
 	Close() error
 }
 
-var upstreams = map[string]Proxy{}
+// UDPProxy is implemented by proxies which can relay udp datagrams.
+// Returned conn is bound to dst, each Write sends a datagram to it,
+// each Read returns a datagram from it.
+type UDPProxy interface {
+	DialUDP(host string, port int) (net.Conn, error)
+}
+
+// Factory create a new proxy instance, every named upstream has its own one
+type Factory func() Proxy
+
+var upstreams = map[string]Factory{}
 
-func Register(name string, t Proxy) {
+func Register(name string, f Factory) {
 	if _, ok := upstreams[name]; !ok {
-		upstreams[name] = t
+		upstreams[name] = f
 	} else {
 		panic("Tunnel type " + name + " already existed")
 	}
 }
 
+// Get return a new uninitialized proxy of type name
 func Get(name string) (Proxy, error) {
-	if t, ok := upstreams[name]; ok {
-		return t, nil
+	if f, ok := upstreams[name]; ok {
+		return f(), nil
 	}
 	return nil, errors.New("unknow tunnel type:" + name)
 }
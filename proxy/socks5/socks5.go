@@ -1,8 +1,8 @@
 package socks5
 
 import (
-	"fmt"
 	"net"
+	"strconv"
 
 	xproxy "golang.org/x/net/proxy"
 
@@ -32,7 +32,7 @@ func (s *Server) Init(c proxy.Config) error {
 	if s.cfg.AuthUser != "" {
 		auth = &xproxy.Auth{User: s.cfg.AuthUser, Password: s.cfg.AuthPassword}
 	}
-	dial, err := xproxy.SOCKS5("tcp", fmt.Sprintf("%s:%d", s.Host, s.Port), auth, xproxy.Direct)
+	dial, err := xproxy.SOCKS5("tcp", net.JoinHostPort(s.Host.String(), strconv.Itoa(s.Port)), auth, xproxy.Direct)
 	if err != nil {
 		return err
 	}
@@ -45,7 +45,7 @@ func (s *Server) GetProxyIP() net.IP {
 }
 
 func (s *Server) Dial(dstHost string, dstPort int) (net.Conn, error) {
-	conn, err := s.dial.Dial("tcp", fmt.Sprintf("%s:%d", dstHost, dstPort))
+	conn, err := s.dial.Dial("tcp", net.JoinHostPort(dstHost, strconv.Itoa(dstPort)))
 	if err != nil {
 		return nil, err
 	}
@@ -57,5 +57,5 @@ func (s *Server) Close() error {
 }
 
 func init() {
-	proxy.Register("socks5", new(Server))
+	proxy.Register("socks5", func() proxy.Proxy { return new(Server) })
 }
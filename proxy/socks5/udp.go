@@ -0,0 +1,159 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	socks5Version    = 0x05
+	authNone         = 0x00
+	authPassword     = 0x02
+	cmdUDPAssociate  = 0x03
+	replySucceeded   = 0x00
+	udpHeaderReserve = 3 // RSV(2) + FRAG(1)
+)
+
+// DialUDP create a udp association on socks5 server, the tcp control
+// connection is kept open until returned conn is closed.
+func (s *Server) DialUDP(dstHost string, dstPort int) (net.Conn, error) {
+	dst := socks.ParseAddr(net.JoinHostPort(dstHost, strconv.Itoa(dstPort)))
+	if dst == nil {
+		return nil, fmt.Errorf("invalid udp target %s:%d", dstHost, dstPort)
+	}
+	ctrl, err := net.Dial("tcp", net.JoinHostPort(s.Host.String(), strconv.Itoa(s.Port)))
+	if err != nil {
+		return nil, err
+	}
+	relay, err := s.udpAssociate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return &udpConn{PacketConn: pc, ctrl: ctrl, raddr: relay, dst: dst}, nil
+}
+
+func (s *Server) udpAssociate(conn net.Conn) (*net.UDPAddr, error) {
+	method := byte(authNone)
+	if s.cfg.AuthUser != "" {
+		method = authPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	if b[0] != socks5Version || b[1] != method {
+		return nil, errors.New("socks5 server rejected auth method")
+	}
+	if method == authPassword {
+		req := []byte{0x01, byte(len(s.cfg.AuthUser))}
+		req = append(req, s.cfg.AuthUser...)
+		req = append(req, byte(len(s.cfg.AuthPassword)))
+		req = append(req, s.cfg.AuthPassword...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		if b[1] != replySucceeded {
+			return nil, errors.New("socks5 auth failed")
+		}
+	}
+	// client address is unknown before sending, use 0.0.0.0:0
+	req := append([]byte{socks5Version, cmdUDPAssociate, 0x00}, socks.ParseAddr("0.0.0.0:0")...)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	b = make([]byte, 3)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	if b[1] != replySucceeded {
+		return nil, fmt.Errorf("socks5 udp associate failed, reply: %d", b[1])
+	}
+	bnd, err := socks.ReadAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", bnd.String())
+	if err != nil {
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// server relay on the same address we connect to
+		relay.IP = s.Host
+	}
+	return relay, nil
+}
+
+// udpConn send datagrams to socks5 udp relay, every packet is
+// prefixed with RSV + FRAG + target address.
+type udpConn struct {
+	net.PacketConn
+	ctrl  net.Conn
+	raddr net.Addr
+	dst   socks.Addr
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	buf := make([]byte, 64*1024)
+	n, _, err := c.PacketConn.ReadFrom(buf)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := unpackUDP(buf[:n])
+	if err != nil {
+		return 0, err
+	}
+	return copy(b, payload), nil
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	if _, err := c.PacketConn.WriteTo(packUDP(c.dst, b), c.raddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *udpConn) Close() error {
+	c.ctrl.Close()
+	return c.PacketConn.Close()
+}
+
+func packUDP(dst socks.Addr, payload []byte) []byte {
+	pkt := make([]byte, udpHeaderReserve, udpHeaderReserve+len(dst)+len(payload))
+	pkt = append(pkt, dst...)
+	return append(pkt, payload...)
+}
+
+func unpackUDP(pkt []byte) ([]byte, error) {
+	if len(pkt) <= udpHeaderReserve {
+		return nil, errors.New("short socks5 udp packet")
+	}
+	if pkt[2] != 0 {
+		return nil, errors.New("fragmented socks5 udp packet is not supported")
+	}
+	addr := socks.SplitAddr(pkt[udpHeaderReserve:])
+	if addr == nil {
+		return nil, errors.New("invalid socks5 udp packet")
+	}
+	return pkt[udpHeaderReserve+len(addr):], nil
+}
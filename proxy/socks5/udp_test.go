@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// fakeUDPRelay accept one udp associate request and echo udp packets back
+func fakeUDPRelay(t *testing.T) (*net.TCPAddr, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 3)
+		io.ReadFull(conn, b)
+		conn.Write([]byte{socks5Version, authNone})
+		io.ReadFull(conn, b)
+		socks.ReadAddr(conn)
+		conn.Write(append([]byte{socks5Version, replySucceeded, 0}, socks.ParseAddr(pc.LocalAddr().String())...))
+		// keep control conn open until client close it
+		io.Copy(ioutil.Discard, conn)
+	}()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(b[:n], addr)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr), func() {
+		ln.Close()
+		pc.Close()
+	}
+}
+
+func TestDialUDP(t *testing.T) {
+	addr, stop := fakeUDPRelay(t)
+	defer stop()
+	s := new(Server)
+	if err := s.Init(&Config{Host: addr.IP, Port: addr.Port}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := s.DialUDP("1.1.1.1", 53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 100)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "hello" {
+		t.Error("unexpected udp payload:", string(b[:n]))
+	}
+}
+
+func TestUnpackUDP(t *testing.T) {
+	if _, err := unpackUDP([]byte{0, 0, 1}); err == nil {
+		t.Error("short packet should fail")
+	}
+	if _, err := unpackUDP(append([]byte{0, 0, 1}, packUDP(socks.ParseAddr("1.1.1.1:53"), []byte("x"))[3:]...)); err == nil {
+		t.Error("fragmented packet should fail")
+	}
+}
@@ -1,8 +1,8 @@
 package ss
 
 import (
-	"fmt"
 	"net"
+	"strconv"
 
 	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
 
@@ -40,8 +40,8 @@ func (s *Server) GetProxyIP() net.IP {
 }
 
 func (s *Server) Dial(dstHost string, dstPort int) (net.Conn, error) {
-	dst := fmt.Sprintf("%s:%d", dstHost, dstPort)
-	ssAddr := fmt.Sprintf("%s:%d", s.Host.String(), s.cfg.Port)
+	dst := net.JoinHostPort(dstHost, strconv.Itoa(dstPort))
+	ssAddr := net.JoinHostPort(s.Host.String(), strconv.Itoa(s.cfg.Port))
 	conn, err := ss.Dial(dst, ssAddr, s.cipher.Copy())
 	if err != nil {
 		return nil, err
@@ -54,5 +54,5 @@ func (s *Server) Close() error {
 }
 
 func init() {
-	proxy.Register("ss", new(Server))
+	proxy.Register("ss", func() proxy.Proxy { return new(Server) })
 }
@@ -2,8 +2,10 @@ package ss2
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/shadowsocks/go-shadowsocks2/core"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
@@ -50,8 +52,8 @@ func (s *Server) GetProxyIP() net.IP {
 }
 
 func (s *Server) Dial(dstHost string, dstPort int) (net.Conn, error) {
-	ssAddr := fmt.Sprintf("%s:%d", s.Host.String(), s.cfg.Port)
-	dst := socks.ParseAddr(fmt.Sprintf("%s:%d", dstHost, dstPort))
+	ssAddr := net.JoinHostPort(s.Host.String(), strconv.Itoa(s.cfg.Port))
+	dst := socks.ParseAddr(net.JoinHostPort(dstHost, strconv.Itoa(dstPort)))
 	rc, err := net.Dial("tcp", ssAddr)
 	if err != nil {
 		return nil, err
@@ -63,10 +65,68 @@ func (s *Server) Dial(dstHost string, dstPort int) (net.Conn, error) {
 	return rc, nil
 }
 
+func (s *Server) DialUDP(dstHost string, dstPort int) (net.Conn, error) {
+	dst := socks.ParseAddr(net.JoinHostPort(dstHost, strconv.Itoa(dstPort)))
+	if dst == nil {
+		return nil, fmt.Errorf("invalid udp target %s:%d", dstHost, dstPort)
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{
+		PacketConn: s.cipher.PacketConn(pc),
+		raddr:      &net.UDPAddr{IP: s.Host, Port: s.cfg.Port},
+		dst:        dst,
+		buf:        make([]byte, 64*1024),
+	}, nil
+}
+
+// udpConn wraps ss udp relay as a conn to a single target,
+// every packet is prefixed with target address.
+type udpConn struct {
+	net.PacketConn
+	raddr *net.UDPAddr
+	dst   socks.Addr
+	buf   []byte // read buffer, conn is read by a single goroutine
+}
+
+// Read a packet from ss server, packets from other addresses are dropped.
+func (c *udpConn) Read(b []byte) (int, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		if a, ok := from.(*net.UDPAddr); !ok || !a.IP.Equal(c.raddr.IP) || a.Port != c.raddr.Port {
+			continue
+		}
+		addr := socks.SplitAddr(c.buf[:n])
+		if addr == nil {
+			return 0, errors.New("invalid ss udp packet")
+		}
+		return copy(b, c.buf[len(addr):n]), nil
+	}
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	pkt := make([]byte, 0, len(c.dst)+len(b))
+	pkt = append(pkt, c.dst...)
+	pkt = append(pkt, b...)
+	if _, err := c.PacketConn.WriteTo(pkt, c.raddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
 func (s *Server) Close() error {
 	return nil
 }
 
 func init() {
-	proxy.Register("ss2", new(Server))
+	proxy.Register("ss2", func() proxy.Proxy { return new(Server) })
 }
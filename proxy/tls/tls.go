@@ -4,8 +4,8 @@ import (
 	_tls "crypto/tls"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
 
 	"snet/proxy"
 )
@@ -37,7 +37,7 @@ func (s *Server) GetProxyIP() net.IP {
 }
 
 func (s *Server) Dial(dstHost string, dstPort int) (net.Conn, error) {
-	conn, err := _tls.Dial("tcp", fmt.Sprintf("%s:%d", s.Host, s.Port), &_tls.Config{
+	conn, err := _tls.Dial("tcp", net.JoinHostPort(s.Host.String(), strconv.Itoa(s.Port)), &_tls.Config{
 		InsecureSkipVerify: true,
 	})
 	if err != nil {
@@ -78,5 +78,5 @@ func (s *Server) Close() error {
 }
 
 func init() {
-	proxy.Register("tls", new(Server))
+	proxy.Register("tls", func() proxy.Proxy { return new(Server) })
 }
@@ -0,0 +1,156 @@
+// Package ratelimit limit bandwidth of connections by token buckets, and
+// switch clients exceeded monthly quota to direct or reject.
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket of bytes, it's filled at rate per second and
+// holds at most one second of tokens. Taking more tokens than available is
+// allowed, the taker waits until the debt is paid.
+type Bucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket return bucket of rate bytes per second, nil if rate <= 0
+func NewBucket(rate int) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &Bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take n tokens at now, return how long to wait before sending n bytes
+func (b *Bucket) take(n int, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// idle return how long bucket is not taken at now
+func (b *Bucket) idle(now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return now.Sub(b.last)
+}
+
+// Limit is download and upload limit, nil bucket means unlimited
+type Limit struct {
+	Down *Bucket
+	Up   *Bucket
+}
+
+// idle return how long limit is not used at now, nil limit is always idle
+func (l *Limit) idle(now time.Time) time.Duration {
+	d := time.Duration(1<<63 - 1)
+	if l == nil {
+		return d
+	}
+	for _, b := range []*Bucket{l.Down, l.Up} {
+		if b != nil {
+			if i := b.idle(now); i < d {
+				d = i
+			}
+		}
+	}
+	return d
+}
+
+// NewLimit return limit of download and upload KB/s, nil if both are
+// unlimited.
+func NewLimit(downKB, upKB int) *Limit {
+	if downKB <= 0 && upKB <= 0 {
+		return nil
+	}
+	return &Limit{Down: NewBucket(downKB * 1024), Up: NewBucket(upKB * 1024)}
+}
+
+// wait until n bytes can pass all buckets, error of ctx is returned if it's
+// done before that.
+func wait(ctx context.Context, buckets []*Bucket, n int) error {
+	now := time.Now()
+	var d time.Duration
+	for _, b := range buckets {
+		if w := b.take(n, now); w > d {
+			d = w
+		}
+	}
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedConn limit reading by down buckets and writing by up buckets
+type limitedConn struct {
+	net.Conn
+	ctx  context.Context
+	down []*Bucket
+	up   []*Bucket
+}
+
+// Wrap return conn limited by limits, reading is download and writing is
+// upload, so it should wrap the remote side. nil limits are ignored.
+// Waiting for limits is stopped when ctx of the connection is done.
+func Wrap(ctx context.Context, conn net.Conn, limits ...*Limit) net.Conn {
+	lc := &limitedConn{Conn: conn, ctx: ctx}
+	for _, l := range limits {
+		if l == nil {
+			continue
+		}
+		if l.Down != nil {
+			lc.down = append(lc.down, l.Down)
+		}
+		if l.Up != nil {
+			lc.up = append(lc.up, l.Up)
+		}
+	}
+	if len(lc.down) == 0 && len(lc.up) == 0 {
+		return conn
+	}
+	return lc
+}
+
+func (lc *limitedConn) Read(b []byte) (int, error) {
+	n, err := lc.Conn.Read(b)
+	if n > 0 && len(lc.down) > 0 {
+		if werr := wait(lc.ctx, lc.down, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (lc *limitedConn) Write(b []byte) (int, error) {
+	if len(lc.up) > 0 {
+		if err := wait(lc.ctx, lc.up, len(b)); err != nil {
+			return 0, err
+		}
+	}
+	return lc.Conn.Write(b)
+}
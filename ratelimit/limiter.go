@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"snet/cidradix"
+	"snet/config"
+	"snet/rule"
+)
+
+const (
+	mb = 1024 * 1024
+	// limit of a client is removed if it's not used for this long
+	clientLimitIdle = 10 * time.Minute
+)
+
+// clientLimit is rate limit of each client ip in ipnet
+type clientLimit struct {
+	ipnet  *net.IPNet
+	downKB int
+	upKB   int
+	lock   sync.Mutex
+	limits map[string]*Limit // key is client ip
+	swept  time.Time
+}
+
+// get limit of client ip at now, idle limits are removed at most once per
+// clientLimitIdle.
+func (c *clientLimit) get(ip net.IP, now time.Time) *Limit {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.Sub(c.swept) > clientLimitIdle {
+		for key, l := range c.limits {
+			if l.idle(now) > clientLimitIdle {
+				delete(c.limits, key)
+			}
+		}
+		c.swept = now
+	}
+	key := ip.String()
+	l, ok := c.limits[key]
+	if !ok {
+		l = NewLimit(c.downKB, c.upKB)
+		c.limits[key] = l
+	}
+	return l
+}
+
+// dstLimit is rate limit shared by connections matched by rules
+type dstLimit struct {
+	rules *rule.Rules
+	limit *Limit
+}
+
+// quota is monthly traffic limit of each client ip in ipnet
+type quota struct {
+	ipnet  *net.IPNet
+	bytes  uint64
+	action rule.Action
+}
+
+// Limiter pick limits of a connection by global, client and destination
+// rate limits, and check monthly quota of clients.
+type Limiter struct {
+	global  *Limit
+	clients []*clientLimit // most specific first
+	dsts    []*dstLimit
+	quotas  []*quota // most specific first
+	usage   func(client string) uint64
+}
+
+func prefixLen(ipnet *net.IPNet) int {
+	n, _ := ipnet.Mask.Size()
+	return n
+}
+
+// NewFromConfig build limiter from rate-limit, client-rate-limits,
+// dst-rate-limits and client-quotas, chnroutes is used by geoip rules.
+func NewFromConfig(c *config.Config, chnroutes *cidradix.Tree) (*Limiter, error) {
+	lim := &Limiter{global: NewLimit(c.RateLimit.Download, c.RateLimit.Upload)}
+	for key, r := range c.ClientRateLimits {
+		ipnet, err := rule.ParseCIDR(key)
+		if err != nil {
+			return nil, err
+		}
+		lim.clients = append(lim.clients, &clientLimit{ipnet: ipnet, downKB: r.Download, upKB: r.Upload,
+			limits: make(map[string]*Limit)})
+	}
+	sort.Slice(lim.clients, func(i, j int) bool {
+		return prefixLen(lim.clients[i].ipnet) > prefixLen(lim.clients[j].ipnet)
+	})
+
+	geoip := map[string]*cidradix.Tree{"CN": chnroutes}
+	for _, d := range c.DstRateLimits {
+		rules, err := rule.New([]string{d.Match + "," + rule.ActionDirect}, geoip)
+		if err != nil {
+			return nil, err
+		}
+		lim.dsts = append(lim.dsts, &dstLimit{rules: rules, limit: NewLimit(d.Download, d.Upload)})
+	}
+
+	for key, q := range c.ClientQuotas {
+		ipnet, err := rule.ParseCIDR(key)
+		if err != nil {
+			return nil, err
+		}
+		action := rule.Action{Type: rule.ActionReject}
+		if q.Action != "" {
+			if action, err = rule.ParseAction(q.Action); err != nil {
+				return nil, err
+			}
+			if action.Type == rule.ActionProxy {
+				return nil, errors.New("quota action should be direct or reject")
+			}
+		}
+		lim.quotas = append(lim.quotas, &quota{ipnet: ipnet, bytes: q.MonthlyMB * mb, action: action})
+	}
+	sort.Slice(lim.quotas, func(i, j int) bool {
+		return prefixLen(lim.quotas[i].ipnet) > prefixLen(lim.quotas[j].ipnet)
+	})
+	return lim, nil
+}
+
+// Wrap limit conn to target t by global limit, limit of its client and
+// the first matched destination limit, ctx is context of the connection.
+func (lim *Limiter) Wrap(ctx context.Context, conn net.Conn, t *rule.Target) net.Conn {
+	if lim == nil {
+		return conn
+	}
+	limits := []*Limit{lim.global}
+	if t.SrcIP != nil {
+		for _, c := range lim.clients {
+			if c.ipnet.Contains(t.SrcIP) {
+				limits = append(limits, c.get(t.SrcIP, time.Now()))
+				break
+			}
+		}
+	}
+	for _, d := range lim.dsts {
+		if d.rules.Match(t) != nil {
+			limits = append(limits, d.limit)
+			break
+		}
+	}
+	return Wrap(ctx, conn, limits...)
+}
+
+// SetUsage set func returning traffic of client ip in current month,
+// quotas are not checked without it.
+func (lim *Limiter) SetUsage(f func(client string) uint64) {
+	if lim != nil {
+		lim.usage = f
+	}
+}
+
+// OverQuota return action for proxied connections of client ip, ok is
+// false if client is not over quota. Quota of 0 MB is unlimited, it can
+// exclude an ip from quota of its network.
+func (lim *Limiter) OverQuota(ip net.IP) (action rule.Action, ok bool) {
+	if lim == nil || lim.usage == nil || ip == nil {
+		return action, false
+	}
+	for _, q := range lim.quotas {
+		if q.ipnet.Contains(ip) {
+			return q.action, q.bytes > 0 && lim.usage(ip.String()) >= q.bytes
+		}
+	}
+	return action, false
+}
@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"snet/cidradix"
+	"snet/config"
+	"snet/rule"
+)
+
+func TestBucket(t *testing.T) {
+	if NewBucket(0) != nil || NewLimit(0, 0) != nil {
+		t.Error("zero rate should be unlimited")
+	}
+	b := NewBucket(1000)
+	now := b.last
+	if d := b.take(600, now); d != 0 {
+		t.Error("should not wait within burst", d)
+	}
+	if d := b.take(600, now); d != 200*time.Millisecond {
+		t.Error("unexpected wait", d)
+	}
+	// debt is paid after 200ms, tokens are capped by rate
+	if d := b.take(1000, now.Add(10*time.Second)); d != 0 {
+		t.Error("should not wait after refill", d)
+	}
+	if d := b.take(1, now.Add(10*time.Second)); d != time.Millisecond {
+		t.Error("tokens should be capped", d)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	if Wrap(context.Background(), local, nil, NewLimit(0, 0)) != local {
+		t.Error("unlimited conn should not be wrapped")
+	}
+	// 1KB/s download, unlimited upload
+	conn := Wrap(context.Background(), local, NewLimit(1, 0))
+	go func() {
+		buf := make([]byte, 1024)
+		remote.Write(buf)
+		remote.Write(buf)
+		remote.Read(buf)
+	}()
+	start := time.Now()
+	buf := make([]byte, 1024)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Error("download should be limited", d)
+	}
+	start = time.Now()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Error("upload should not be limited", d)
+	}
+
+	// waiting is stopped by cancelling ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	conn = Wrap(ctx, local, NewLimit(0, 1))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	if _, err := conn.Write(make([]byte, 10*1024)); err != context.Canceled {
+		t.Error("write should be cancelled", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Error("write should not wait after cancel", d)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	cn, _ := cidradix.NewTreeFromCIDRs([]string{"1.0.0.0/8"})
+	c := &config.Config{
+		RateLimit: config.RateLimit{Download: 1024},
+		ClientRateLimits: map[string]config.RateLimit{
+			"192.168.1.0/24": {Download: 100},
+			"192.168.1.10":   {Download: 10},
+		},
+		DstRateLimits: []config.DstRateLimit{{Match: "domain-suffix,youtube.com", RateLimit: config.RateLimit{Download: 500}}},
+		ClientQuotas: map[string]config.Quota{
+			"192.168.1.0/24": {MonthlyMB: 1},
+			"192.168.1.10":   {MonthlyMB: 0},
+			"192.168.2.0/24": {MonthlyMB: 1, Action: "direct"},
+		},
+	}
+	lim, err := NewFromConfig(c, cn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	conn := lim.Wrap(context.Background(), local, &rule.Target{Domain: "www.youtube.com", SrcIP: net.ParseIP("192.168.1.10")}).(*limitedConn)
+	if len(conn.down) != 3 || conn.down[1].rate != 10*1024 || conn.down[2].rate != 500*1024 {
+		t.Error("unexpected limits", conn.down)
+	}
+	conn = lim.Wrap(context.Background(), local, &rule.Target{Domain: "github.com", SrcIP: net.ParseIP("192.168.1.20")}).(*limitedConn)
+	if len(conn.down) != 2 || conn.down[1].rate != 100*1024 {
+		t.Error("unexpected limits", conn.down)
+	}
+	// each client has its own bucket
+	other := lim.Wrap(context.Background(), local, &rule.Target{SrcIP: net.ParseIP("192.168.1.21")}).(*limitedConn)
+	if other.down[1] == conn.down[1] || other.down[0] != conn.down[0] {
+		t.Error("client bucket should not be shared")
+	}
+
+	if _, ok := lim.OverQuota(net.ParseIP("192.168.1.20")); ok {
+		t.Error("quota should not be checked without usage")
+	}
+	lim.SetUsage(func(client string) uint64 { return 2 * mb })
+	if a, ok := lim.OverQuota(net.ParseIP("192.168.1.20")); !ok || a.Type != rule.ActionReject {
+		t.Error("client should be rejected", a, ok)
+	}
+	if _, ok := lim.OverQuota(net.ParseIP("192.168.1.10")); ok {
+		t.Error("0 MB quota should be unlimited")
+	}
+	if a, ok := lim.OverQuota(net.ParseIP("192.168.2.1")); !ok || a.Type != rule.ActionDirect {
+		t.Error("client should be direct", a, ok)
+	}
+	if _, ok := lim.OverQuota(net.ParseIP("10.0.0.1")); ok {
+		t.Error("client without quota")
+	}
+
+	c.ClientQuotas = map[string]config.Quota{"192.168.1.1": {MonthlyMB: 1, Action: "proxy"}}
+	if _, err := NewFromConfig(c, cn); err == nil {
+		t.Error("proxy action should be invalid")
+	}
+}
+
+func TestClientLimitIdle(t *testing.T) {
+	c := &clientLimit{downKB: 1, limits: make(map[string]*Limit)}
+	now := time.Now()
+	a := c.get(net.ParseIP("192.168.1.10"), now)
+	b := c.get(net.ParseIP("192.168.1.11"), now)
+	if c.get(net.ParseIP("192.168.1.10"), now) != a {
+		t.Error("limit of client should be reused")
+	}
+	// a is used, b is idle
+	later := now.Add(clientLimitIdle / 2)
+	a.Down.take(1, later)
+	later = now.Add(clientLimitIdle + time.Second)
+	c.get(net.ParseIP("192.168.1.12"), later)
+	if len(c.limits) != 2 || c.limits["192.168.1.10"] != a || c.limits["192.168.1.11"] == b {
+		t.Error("idle limit should be removed", c.limits)
+	}
+}
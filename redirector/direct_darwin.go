@@ -0,0 +1,87 @@
+package redirector
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"snet/utils"
+)
+
+// ips added to bypass table by DialDirect, with number of connections to
+// them. An ip is removed from table when its last connection is closed.
+var directIPs = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// DialDirect dial to host without going through snet.
+// pf can't match socket mark, target ip is added to bypass table before
+// dialing and removed after the connection is closed.
+func DialDirect(network, host string, port int, timeout time.Duration) (net.Conn, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, errors.New("No ip found for " + host)
+		}
+		ip = ips[0]
+	}
+	release, err := bypassDirect(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout(network, net.JoinHostPort(ip.String(), strconv.Itoa(port)), timeout)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &directConn{Conn: conn, release: release}, nil
+}
+
+// bypassDirect add ip to bypass table unless it's bypassed already, release
+// should be called when connection to ip is closed.
+func bypassDirect(ip string) (release func(), err error) {
+	directIPs.Lock()
+	defer directIPs.Unlock()
+	if n, ok := directIPs.m[ip]; ok {
+		directIPs.m[ip] = n + 1
+	} else {
+		if _, err := utils.Sh("pfctl -t", tableName, "-T test", ip); err == nil {
+			// in routes or bypass ips, it's never removed
+			return func() {}, nil
+		}
+		if out, err := utils.Sh("pfctl -t", tableName, "-T add", ip); err != nil {
+			return nil, errors.New(out)
+		}
+		directIPs.m[ip] = 1
+	}
+	return func() {
+		directIPs.Lock()
+		defer directIPs.Unlock()
+		if directIPs.m[ip] > 1 {
+			directIPs.m[ip]--
+			return
+		}
+		delete(directIPs.m, ip)
+		utils.Sh("pfctl -t", tableName, "-T delete", ip)
+	}, nil
+}
+
+// directConn release its ip from bypass table on close
+type directConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *directConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,25 @@
+package redirector
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// sockets dialed by DialDirect are marked, so they will skip snet's iptables rules
+const directMark = 0xff
+
+// DialDirect dial to host without going through snet
+func DialDirect(network, host string, port int, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout, Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, directMark)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	return d.Dial(network, net.JoinHostPort(host, strconv.Itoa(port)))
+}
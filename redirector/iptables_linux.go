@@ -1,6 +1,7 @@
 package redirector
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,19 +10,28 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"unsafe"
 
 	"snet/logger"
 	"snet/utils"
 )
 
 const (
-	chainName       = "SNET"
-	setName         = "BYPASS_SNET"
-	SO_ORIGINAL_DST = 80 // from: /usr/include/linux/netfilter_ipv4.h
+	chainName            = "SNET"
+	udpChainName         = "SNET_UDP"
+	udpMarkChainName     = "SNET_UDP_MARK"
+	setName              = "BYPASS_SNET"
+	setName6             = "BYPASS_SNET6"
+	SO_ORIGINAL_DST      = 80 // from: /usr/include/linux/netfilter_ipv4.h
+	IP6T_SO_ORIGINAL_DST = 80 // from: /usr/include/linux/netfilter_ipv6/ip6_tables.h
+	tproxyMark           = "0x1"
+	tproxyRouteTable     = "100"
 )
 
 type IPSet struct {
 	Name        string
+	Family      string   // inet or inet6
+	routes      []string // replaceable by Replace
 	bypassCidrs []string
 
 	l *logger.Logger
@@ -40,9 +50,9 @@ func (s *IPSet) Add(ip string) error {
 
 func (s *IPSet) Init() error {
 	s.Destroy()
-	result := make([]string, 0, len(s.bypassCidrs)+1)
-	result = append(result, "create "+s.Name+" hash:net family inet hashsize 1024 maxelem 65536")
-	for _, route := range s.bypassCidrs {
+	result := make([]string, 0, len(s.routes)+len(s.bypassCidrs)+1)
+	result = append(result, "create "+s.Name+" hash:net family "+s.Family+" hashsize 1024 maxelem 65536")
+	for _, route := range append(s.routes, s.bypassCidrs...) {
 		result = append(result, "add "+s.Name+" "+route+" -exist")
 	}
 	cmd := exec.Command("ipset", "restore")
@@ -62,109 +72,232 @@ func (s *IPSet) Init() error {
 	return nil
 }
 
+// Replace replace routes of set without flushing it, a new set is created
+// and swapped with the current one.
+func (s *IPSet) Replace(routes []string) error {
+	tmp := &IPSet{Name: s.Name + "_TMP", Family: s.Family, routes: routes, bypassCidrs: s.bypassCidrs, l: s.l}
+	if err := tmp.Init(); err != nil {
+		return err
+	}
+	defer tmp.Destroy()
+	if out, err := utils.Sh("ipset swap", tmp.Name, s.Name); err != nil {
+		if out != "" {
+			return errors.New(out)
+		}
+		return err
+	}
+	s.routes = routes
+	return nil
+}
+
 func (s *IPSet) Destroy() {
 	// ignore error, since this function will be called during starting
 	utils.Sh("ipset destroy", s.Name)
 }
 
-type IPTables struct {
+// ipFamily hold the commands and ipset used for one address family
+type ipFamily struct {
+	iptables     string // iptables or ip6tables
+	ip           string // ip or ip -6
+	anyAddr      string // 0.0.0.0/0 or ::/0
 	ipset        *IPSet
 	byPassSrcIPs []string
-	l            *logger.Logger
+}
+
+func (f *ipFamily) has(ip string) bool {
+	return isIPv6(ip) == (f.ipset.Family == "inet6")
+}
+
+type IPTables struct {
+	families []*ipFamily
+	l        *logger.Logger
 }
 
 func (r *IPTables) Init() error {
-	return r.ipset.Init()
+	for _, f := range r.families {
+		if err := f.ipset.Init(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *IPTables) sh(cmds [][]string) error {
+	for _, cmd := range cmds {
+		if out, err := utils.Sh(cmd...); err != nil {
+			r.l.Error(out)
+			return err
+		}
+	}
+	return nil
 }
 
 func (r *IPTables) SetupRules(mode string, snetHost string, snetPort int, dnsPort int, cnDNS string) error {
 	r.CleanupRules(mode, snetHost, snetPort, dnsPort)
 	port := strconv.Itoa(snetPort)
 	dport := strconv.Itoa(dnsPort)
-	if out, err := utils.Sh("iptables -t nat -N", chainName); err != nil {
-		r.l.Error(out)
-		return err
-	}
-	// by pass all tcp traffic for ips in BYPASS_SNET set
-	if out, err := utils.Sh("iptables -t nat -A ", chainName, "-p tcp -m set --match-set", r.ipset.Name, "dst -j RETURN"); err != nil {
-		r.l.Error(out)
-		return err
-	}
-	// redirect all tcp traffic in SNET chain to local proxy port
-	if out, err := utils.Sh("iptables -t nat -A ", chainName, "-p tcp -j REDIRECT --to-ports", port); err != nil {
-		r.l.Error(out)
-		return err
-	}
-	// send all output tcp traffic to SNET chain
-	if out, err := utils.Sh("iptables -t nat -A OUTPUT -p tcp -j", chainName); err != nil {
-		r.l.Error(out)
-		return err
-	}
-	if mode == modeLocal {
-		// avoid outgoing cn dns query be redirected to snet, it's a loop!
-		if out, err := utils.Sh("iptables -t nat -A", chainName, "-d", cnDNS, "-j RETURN"); err != nil {
-			r.l.Error(out)
-			return err
+	for _, f := range r.families {
+		ipt := f.iptables
+		cmds := [][]string{
+			{ipt, "-t nat -N", chainName},
+			// connections dialed by snet directly
+			{ipt, "-t nat -A ", chainName, "-m mark --mark", strconv.Itoa(directMark), "-j RETURN"},
+			// by pass all tcp traffic for ips in BYPASS_SNET set
+			{ipt, "-t nat -A ", chainName, "-p tcp -m set --match-set", f.ipset.Name, "dst -j RETURN"},
+			// redirect all tcp traffic in SNET chain to local proxy port
+			{ipt, "-t nat -A ", chainName, "-p tcp -j REDIRECT --to-ports", port},
+			// send all output tcp traffic to SNET chain
+			{ipt, "-t nat -A OUTPUT -p tcp -j", chainName},
 		}
-		// redirect dns query in SNET chain to snet listen address
-		if out, err := utils.Sh("iptables -t nat -A", chainName, "-p udp --dport 53 -j DNAT --to-destination", snetHost+":"+dport); err != nil {
-			r.l.Error(out)
+		if mode == modeLocal {
+			if cnDNS != "" && f.has(cnDNS) {
+				// avoid outgoing cn dns query be redirected to snet, it's a loop!
+				cmds = append(cmds, []string{ipt, "-t nat -A", chainName, "-d", cnDNS, "-j RETURN"})
+			}
+			if f.ipset.Family == "inet" {
+				// redirect dns query in SNET chain to snet listen address
+				cmds = append(cmds, []string{ipt, "-t nat -A", chainName, "-p udp --dport 53 -j DNAT --to-destination", snetHost + ":" + dport})
+			} else {
+				// REDIRECT in OUTPUT chain send packet to ::1
+				cmds = append(cmds, []string{ipt, "-t nat -A", chainName, "-p udp --dport 53 -j REDIRECT --to-ports", dport})
+			}
+			// redirect all outgoing dns query to SNET chain (except cn dns)
+			cmds = append(cmds, []string{ipt, "-t nat -A OUTPUT -p udp --dport 53 -j", chainName})
+		}
+		if mode == modeRouter {
+			cmds = append(cmds, []string{ipt, "-t nat -I PREROUTING -p tcp -j", chainName})
+			for _, src := range f.byPassSrcIPs {
+				cmds = append(cmds, []string{ipt, "-t nat -I PREROUTING -p tcp ", "-s ", src, "-j RETURN"})
+			}
+			cmds = append(cmds, []string{ipt, "-t nat -I PREROUTING -p udp --dport 53 -j REDIRECT --to-port", dport})
+			cmds = append(cmds, []string{ipt, "-t nat -I PREROUTING -p tcp --dport 53 -j REDIRECT --to-port", dport})
+		}
+		if err := r.sh(cmds); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// redirect all outgoing dns query to SNET chain (except cn dns)
-		if out, err := utils.Sh("iptables -t nat -A OUTPUT -p udp --dport 53 -j", chainName); err != nil {
-			r.l.Error(out)
-			return err
+func (r *IPTables) CleanupRules(mode string, snetHost string, snetPort int, dnsPort int) error {
+	if mode != modeLocal && mode != modeRouter {
+		return fmt.Errorf("Invalid mode %s", mode)
+	}
+	dport := strconv.Itoa(dnsPort)
+	for _, f := range r.families {
+		ipt := f.iptables
+		utils.Sh(ipt, "-t nat -D OUTPUT -p tcp -j ", chainName)
+		if mode == modeLocal {
+			utils.Sh(ipt, "-t nat -D OUTPUT -p udp --dport 53 -j", chainName)
 		}
+		if mode == modeRouter {
+			utils.Sh(ipt, "-t nat -D PREROUTING -p tcp -j", chainName)
+			utils.Sh(ipt, "-t nat -D PREROUTING -p udp --dport 53 -j REDIRECT --to-port", dport)
+			utils.Sh(ipt, "-t nat -D PREROUTING -p tcp --dport 53 -j REDIRECT --to-port", dport)
+			for _, src := range f.byPassSrcIPs {
+				utils.Sh(ipt, "-t nat -D PREROUTING -p tcp", "-s", src, "-j RETURN")
+			}
+		}
+		utils.Sh(ipt, "-t nat -F", chainName)
+		utils.Sh(ipt, "-t nat -X", chainName)
 	}
-	if mode == modeRouter {
-		if out, err := utils.Sh("iptables -t nat -I PREROUTING -p tcp -j", chainName); err != nil {
-			r.l.Error(out)
-			return err
+	return nil
+}
+
+// SetupUDPRules send udp traffic to snet's udp relay by TPROXY in mangle table.
+// TPROXY only works in PREROUTING chain, for local mode, outgoing packets are marked
+// in OUTPUT chain and rerouted to lo, so they will go through PREROUTING again.
+func (r *IPTables) SetupUDPRules(mode string, snetPort int) error {
+	r.CleanupUDPRules(mode)
+	port := strconv.Itoa(snetPort)
+	for _, f := range r.families {
+		ipt := f.iptables
+		cmds := [][]string{
+			// deliver marked packets to local stack
+			{f.ip, "rule add fwmark", tproxyMark, "table", tproxyRouteTable},
+			{f.ip, "route add local", f.anyAddr, "dev lo table", tproxyRouteTable},
+			{ipt, "-t mangle -N", udpChainName},
+			// skip packets to local address, eg: replies to local apps
+			{ipt, "-t mangle -A", udpChainName, "-m addrtype --dst-type LOCAL -j RETURN"},
+			{ipt, "-t mangle -A", udpChainName, "-p udp -m set --match-set", f.ipset.Name, "dst -j RETURN"},
+			// dns query is handled by snet dns server
+			{ipt, "-t mangle -A", udpChainName, "-p udp --dport 53 -j RETURN"},
 		}
-		for _, src := range r.byPassSrcIPs {
-			if out, err := utils.Sh("iptables -t nat -I PREROUTING -p tcp ", "-s ", src, "-j RETURN"); err != nil {
-				r.l.Error(out)
-				return err
+		if mode == modeRouter {
+			for _, src := range f.byPassSrcIPs {
+				cmds = append(cmds, []string{ipt, "-t mangle -A", udpChainName, "-s", src, "-j RETURN"})
 			}
 		}
-		if out, err := utils.Sh("iptables -t nat -I PREROUTING -p udp --dport 53 -j REDIRECT --to-port", dport); err != nil {
-			r.l.Error(out)
+		cmds = append(cmds,
+			[]string{ipt, "-t mangle -A", udpChainName, "-p udp -j TPROXY --on-port", port, "--tproxy-mark", tproxyMark + "/" + tproxyMark},
+			[]string{ipt, "-t mangle -A PREROUTING -p udp -j", udpChainName},
+		)
+		if mode == modeLocal {
+			cmds = append(cmds,
+				[]string{ipt, "-t mangle -N", udpMarkChainName},
+				[]string{ipt, "-t mangle -A", udpMarkChainName, "-m mark --mark", strconv.Itoa(directMark), "-j RETURN"},
+				[]string{ipt, "-t mangle -A", udpMarkChainName, "-m addrtype --dst-type LOCAL -j RETURN"},
+				[]string{ipt, "-t mangle -A", udpMarkChainName, "-p udp -m set --match-set", f.ipset.Name, "dst -j RETURN"},
+				[]string{ipt, "-t mangle -A", udpMarkChainName, "-p udp --dport 53 -j RETURN"},
+				[]string{ipt, "-t mangle -A", udpMarkChainName, "-p udp -j MARK --set-mark", tproxyMark},
+				[]string{ipt, "-t mangle -A OUTPUT -p udp -j", udpMarkChainName},
+			)
+		}
+		if err := r.sh(cmds); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (r *IPTables) CleanupRules(mode string, snetHost string, snetPort int, dnsPort int) error {
+func (r *IPTables) CleanupUDPRules(mode string) error {
 	if mode != modeLocal && mode != modeRouter {
 		return fmt.Errorf("Invalid mode %s", mode)
 	}
-	dport := strconv.Itoa(dnsPort)
-	utils.Sh("iptables -t nat -D OUTPUT -p tcp -j ", chainName)
-	if mode == modeLocal {
-		// utils.Sh("iptables -t nat -D", chainName, "-p  udp --dport 53 -j DNAT --to-destination", snetHost+":"+dport)
-		utils.Sh("iptables -t nat -D OUTPUT -p udp --dport 53 -j", chainName)
-	}
-	if mode == modeRouter {
-		utils.Sh("iptables -t nat -D PREROUTING -p tcp -j", chainName)
-		utils.Sh("iptables -t nat -D PREROUTING -p udp --dport 53 -j REDIRECT --to-port", dport)
-		for _, src := range r.byPassSrcIPs {
-			utils.Sh("iptables -t nat -D PREROUTING -p tcp", "-s", src, "-j RETURN")
+	for _, f := range r.families {
+		ipt := f.iptables
+		utils.Sh(ipt, "-t mangle -D PREROUTING -p udp -j", udpChainName)
+		utils.Sh(ipt, "-t mangle -F", udpChainName)
+		utils.Sh(ipt, "-t mangle -X", udpChainName)
+		if mode == modeLocal {
+			utils.Sh(ipt, "-t mangle -D OUTPUT -p udp -j", udpMarkChainName)
+			utils.Sh(ipt, "-t mangle -F", udpMarkChainName)
+			utils.Sh(ipt, "-t mangle -X", udpMarkChainName)
 		}
+		utils.Sh(f.ip, "rule del fwmark", tproxyMark, "table", tproxyRouteTable)
+		utils.Sh(f.ip, "route del local", f.anyAddr, "dev lo table", tproxyRouteTable)
 	}
-	utils.Sh("iptables -t nat -F", chainName)
-	utils.Sh("iptables -t nat -X", chainName)
 	return nil
 }
 
 func (r *IPTables) Destroy() {
-	r.ipset.Destroy()
+	for _, f := range r.families {
+		f.ipset.Destroy()
+	}
+}
+
+func (r *IPTables) UpdateRoutes(routes []string) error {
+	routes4, routes6 := splitByFamily(routes)
+	for _, f := range r.families {
+		family := routes4
+		if f.ipset.Family == "inet6" {
+			family = routes6
+		}
+		if err := f.ipset.Replace(family); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (r *IPTables) ByPass(ip string) error {
-	return r.ipset.Add(ip)
+	for _, f := range r.families {
+		if f.has(ip) {
+			return f.ipset.Add(ip)
+		}
+	}
+	// ipv6 is disabled
+	return nil
 }
 
 func GetDstAddr(conn *net.TCPConn) (dstHost string, dstPort int, err error) {
@@ -175,6 +308,17 @@ func GetDstAddr(conn *net.TCPConn) (dstHost string, dstPort int, err error) {
 	// f is a copy of tcp connection's underlying fd, close it won't affect current connection
 	defer f.Close()
 	fd := f.Fd()
+	if laddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+		// struct sockaddr_in6 is returned
+		var addr syscall.RawSockaddrInet6
+		size := uint32(syscall.SizeofSockaddrInet6)
+		if err := getsockopt(int(fd), syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST, unsafe.Pointer(&addr), &size); err != nil {
+			return "", -1, err
+		}
+		// port is in network byte order
+		port := (*[2]byte)(unsafe.Pointer(&addr.Port))
+		return net.IP(addr.Addr[:]).String(), int(binary.BigEndian.Uint16(port[:])), nil
+	}
 	addr, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, SO_ORIGINAL_DST)
 	if err != nil {
 		return "", -1, err
@@ -190,12 +334,31 @@ func GetDstAddr(conn *net.TCPConn) (dstHost string, dstPort int, err error) {
 	return host, int(addr.Multiaddr[2])<<8 + int(addr.Multiaddr[3]), err
 }
 
-func NewRedirector(byPassRoutes []string, byPassSrcIPs []string, eni string, l *logger.Logger) (Redirector, error) {
+func NewRedirector(byPassRoutes []string, byPassSrcIPs []string, eni string, ipv6 bool, l *logger.Logger) (Redirector, error) {
 
 	if _, err := utils.Sh("which ipset"); err != nil {
 		return nil, errors.New("ipset not found")
 	}
-	bypass := append(byPassRoutes, whitelistCIDR...)
-	ipset := &IPSet{Name: setName, bypassCidrs: bypass, l: l}
-	return &IPTables{ipset, byPassSrcIPs, l}, nil
+	routes, routes6 := splitByFamily(byPassRoutes)
+	srcIPs, srcIPs6 := splitByFamily(byPassSrcIPs)
+	families := []*ipFamily{{
+		iptables:     "iptables",
+		ip:           "ip",
+		anyAddr:      "0.0.0.0/0",
+		ipset:        &IPSet{Name: setName, Family: "inet", routes: routes, bypassCidrs: append([]string(nil), whitelistCIDR...), l: l},
+		byPassSrcIPs: srcIPs,
+	}}
+	if ipv6 {
+		if _, err := utils.Sh("which ip6tables"); err != nil {
+			return nil, errors.New("ip6tables not found")
+		}
+		families = append(families, &ipFamily{
+			iptables:     "ip6tables",
+			ip:           "ip -6",
+			anyAddr:      "::/0",
+			ipset:        &IPSet{Name: setName6, Family: "inet6", routes: routes6, bypassCidrs: append([]string(nil), whitelistCIDR6...), l: l},
+			byPassSrcIPs: srcIPs6,
+		})
+	}
+	return &IPTables{families, l}, nil
 }
@@ -3,7 +3,7 @@ package redirector
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
@@ -37,15 +37,47 @@ type pfioc_natlook struct {
 
 type PFTable struct {
 	Name        string
+	routes      []string // replaceable by Replace
 	bypassCidrs []string
 }
 
 func (t *PFTable) Add(ip string) {
+	for _, c := range t.bypassCidrs {
+		if c == ip {
+			return
+		}
+	}
 	t.bypassCidrs = append(t.bypassCidrs, ip)
 }
 
 func (t *PFTable) CIDRS() string {
-	return strings.Join(t.bypassCidrs, " ")
+	return strings.Join(append(append([]string(nil), t.routes...), t.bypassCidrs...), " ")
+}
+
+// Replace replace routes of loaded table, ips of direct connections are kept
+func (t *PFTable) Replace(routes []string) error {
+	f, err := ioutil.TempFile("", "snet-pf-table")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	// ips can't be added or removed by DialDirect during replacing
+	directIPs.Lock()
+	defer directIPs.Unlock()
+	entries := append(append([]string(nil), routes...), t.bypassCidrs...)
+	for ip := range directIPs.m {
+		entries = append(entries, ip)
+	}
+	_, err = f.WriteString(strings.Join(entries, "\n"))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if out, err := utils.Sh("pfctl -t", t.Name, "-T replace -f", f.Name()); err != nil {
+		return errors.New(out + err.Error())
+	}
+	t.routes = routes
+	return nil
 }
 
 type PacketFilter struct {
@@ -93,7 +125,7 @@ rdr on $lo proto tcp from $dev to any port 1:65535 -> {{.snetHost }} port {{ .sn
 rdr on $lo proto udp from $dev to any port 53 -> {{ .snetHost }} port {{ .dnsPort }}  # let proxy handle dns query
 pass out on $dev route-to $lo proto tcp from $dev to any port 1:65535  # re-route outgoing tcp
 pass out on $dev route-to $lo proto udp from $dev to any port 53  # re-route outgoing udp 
-pass out proto udp from any to {{ .cnDNS }} # skip cn dns
+{{ if .cnDNS }}pass out proto udp from any to {{ .cnDNS }} # skip cn dns{{ end }}
 pass out proto tcp from any to <{{ .bypassTable.Name}}>  # skip cn ip + upstream proxy ip
 ' | sudo pfctl -ef -
 `, map[string]interface{}{"bypassTable": pf.bypassTable, "snetHost": snetHost,
@@ -116,16 +148,28 @@ func (pf *PacketFilter) CleanupRules(mode string, snetHost string, snetPort int,
 	return nil
 }
 
+func (pf *PacketFilter) SetupUDPRules(mode string, snetPort int) error {
+	return errTProxyNotSupported
+}
+
+func (pf *PacketFilter) CleanupUDPRules(mode string) error {
+	return nil
+}
+
 func (pf *PacketFilter) Destroy() {
 	utils.Sh("pfctl -d")
 }
 
+func (pf *PacketFilter) UpdateRoutes(routes []string) error {
+	return pf.bypassTable.Replace(routes)
+}
+
 func (pf *PacketFilter) ByPass(ip string) error {
 	pf.bypassTable.Add(ip)
 	return nil
 }
 
-func NewRedirector(byPassRoutes []string, byPassSrcIPs []string, eni string, l *logger.Logger) (Redirector, error) {
+func NewRedirector(byPassRoutes []string, byPassSrcIPs []string, eni string, ipv6 bool, l *logger.Logger) (Redirector, error) {
 	// byPassSrcIPs is useless on mac, since it only works on router mode
 	if _, err := utils.Sh("which pfctl"); err != nil {
 		return nil, err
@@ -134,8 +178,11 @@ func NewRedirector(byPassRoutes []string, byPassSrcIPs []string, eni string, l *
 		eni = findActiveInterface(l)
 	}
 	l.Info("using interface ", eni)
-	bypass := append(byPassRoutes, whitelistCIDR...)
-	pfTable := &PFTable{Name: tableName, bypassCidrs: bypass}
+	bypass := append([]string(nil), whitelistCIDR...)
+	if ipv6 {
+		bypass = append(bypass, whitelistCIDR6...)
+	}
+	pfTable := &PFTable{Name: tableName, routes: byPassRoutes, bypassCidrs: bypass}
 	return &PacketFilter{pfTable, eni, l}, nil
 }
 
@@ -177,15 +224,22 @@ func GetDstAddr(conn *net.TCPConn) (dstHost string, dstPort int, err error) {
 	pnl.direction = PF_OUT
 	pnl.af = syscall.AF_INET
 	pnl.proto = syscall.IPPROTO_TCP
+	ipLen := net.IPv4len
+	caddrIP, laddrIP := caddr.IP.To4(), laddr.IP.To4()
+	if laddrIP == nil {
+		pnl.af = syscall.AF_INET6
+		ipLen = net.IPv6len
+		caddrIP, laddrIP = caddr.IP.To16(), laddr.IP.To16()
+	}
 
 	// fullfill client ip & port
-	copy(pnl.saddr[:4], caddr.IP)
+	copy(pnl.saddr[:ipLen], caddrIP)
 	cport := make([]byte, 2)
 	binary.BigEndian.PutUint16(cport, uint16(caddr.Port))
 	copy(pnl.sxport[:], cport)
 
 	// fullfill local proxy's bind ip & port
-	copy(pnl.daddr[0:4], laddr.IP)
+	copy(pnl.daddr[:ipLen], laddrIP)
 	lport := make([]byte, 2)
 	binary.BigEndian.PutUint16(lport, uint16(laddr.Port))
 	copy(pnl.dxport[:], lport)
@@ -198,6 +252,6 @@ func GetDstAddr(conn *net.TCPConn) (dstHost string, dstPort int, err error) {
 	// get redirected ip & port
 	rport := make([]byte, 2)
 	copy(rport, pnl.rdxport[:2])
-	raddr := pnl.rdaddr[:4]
-	return fmt.Sprintf("%d.%d.%d.%d", raddr[0], raddr[1], raddr[2], raddr[3]), int(binary.BigEndian.Uint16(rport)), nil
+	raddr := net.IP(append([]byte(nil), pnl.rdaddr[:ipLen]...))
+	return raddr.String(), int(binary.BigEndian.Uint16(rport)), nil
 }
@@ -1,5 +1,7 @@
 package redirector
 
+import "strings"
+
 const (
 	modeLocal  = "local"
 	modeRouter = "router"
@@ -24,10 +26,44 @@ var whitelistCIDR = []string{
 	"255.255.255.255/32",
 }
 
+// https://en.wikipedia.org/wiki/Reserved_IP_addresses#IPv6
+var whitelistCIDR6 = []string{
+	"::/128",
+	"::1/128",
+	"::ffff:0:0/96",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
 type Redirector interface {
 	Init() error
 	SetupRules(mode string, snetHost string, snetPort int, dnsPort int, cnDNS string) error
 	CleanupRules(mode string, snetHost string, snetPort int, dnsPort int) error
+	SetupUDPRules(mode string, snetPort int) error
+	CleanupUDPRules(mode string) error
 	Destroy()
 	ByPass(ip string) error
+	// UpdateRoutes replace bypass routes passed to NewRedirector,
+	// ips added by ByPass are kept.
+	UpdateRoutes(routes []string) error
+}
+
+func isIPv6(ip string) bool {
+	return strings.Contains(ip, ":")
+}
+
+// splitByFamily split ip or cidr list to ipv4 and ipv6 list
+func splitByFamily(ips []string) (v4 []string, v6 []string) {
+	for _, ip := range ips {
+		if isIPv6(ip) {
+			v6 = append(v6, ip)
+		} else {
+			v4 = append(v4, ip)
+		}
+	}
+	return
 }
@@ -0,0 +1,20 @@
+//go:build linux && !386
+// +build linux,!386
+
+package redirector
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getsockopt read option of fd into val, vallen is size of val and set to
+// size of option read
+func getsockopt(fd, level, name int, val unsafe.Pointer, vallen *uint32) error {
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name),
+		uintptr(val), uintptr(unsafe.Pointer(vallen)), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package redirector
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getsockopt of socketcall, from: /usr/include/linux/net.h
+const sysGetsockopt = 15
+
+// getsockopt read option of fd into val, vallen is size of val and set to
+// size of option read. 386 has no getsockopt syscall, it's called by
+// socketcall.
+func getsockopt(fd, level, name int, val unsafe.Pointer, vallen *uint32) error {
+	args := [5]uintptr{uintptr(fd), uintptr(level), uintptr(name), uintptr(val), uintptr(unsafe.Pointer(vallen))}
+	_, _, e := syscall.RawSyscall(syscall.SYS_SOCKETCALL, sysGetsockopt, uintptr(unsafe.Pointer(&args[0])), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
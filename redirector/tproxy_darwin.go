@@ -0,0 +1,20 @@
+package redirector
+
+import (
+	"errors"
+	"net"
+)
+
+var errTProxyNotSupported = errors.New("udp relay is only supported on linux")
+
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	return nil, errTProxyNotSupported
+}
+
+func ReadFromUDPWithDst(conn *net.UDPConn, b, oob []byte) (n int, src *net.UDPAddr, dst *net.UDPAddr, err error) {
+	return 0, nil, nil, errTProxyNotSupported
+}
+
+func DialUDPFrom(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTProxyNotSupported
+}
@@ -0,0 +1,105 @@
+package redirector
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// from: /usr/include/linux/in6.h
+const (
+	IPV6_RECVORIGDSTADDR = 74
+	IPV6_TRANSPARENT     = 75
+)
+
+// ListenTProxyUDP listen on addr to receive udp packets redirected by TPROXY,
+// original destination of each packet can be read by ReadFromUDPWithDst.
+func ListenTProxyUDP(addr string) (*net.UDPConn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	level, opts := syscall.SOL_IP, []int{syscall.IP_TRANSPARENT, syscall.IP_RECVORIGDSTADDR}
+	if isIPv6(host) {
+		network = "udp6"
+		level, opts = syscall.SOL_IPV6, []int{IPV6_TRANSPARENT, IPV6_RECVORIGDSTADDR}
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return setSockOpts(c, level, opts...)
+	}}
+	pc, err := lc.ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// ReadFromUDPWithDst read a packet from conn created by ListenTProxyUDP,
+// return client address and the original destination address. oob is the
+// buffer of control messages, both b and oob can be reused by caller.
+func ReadFromUDPWithDst(conn *net.UDPConn, b, oob []byte) (n int, src *net.UDPAddr, dst *net.UDPAddr, err error) {
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVORIGDSTADDR {
+			// struct sockaddr_in: family(2) + port(2) + addr(4)
+			if len(msg.Data) < 8 {
+				break
+			}
+			ip := net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7])
+			return n, src, &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(msg.Data[2:4]))}, nil
+		}
+		if msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == IPV6_RECVORIGDSTADDR {
+			// struct sockaddr_in6: family(2) + port(2) + flowinfo(4) + addr(16)
+			if len(msg.Data) < 24 {
+				break
+			}
+			ip := net.IP(append([]byte(nil), msg.Data[8:24]...))
+			return n, src, &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(msg.Data[2:4]))}, nil
+		}
+	}
+	return 0, nil, nil, errors.New("original destination not found")
+}
+
+// DialUDPFrom create a udp conn to raddr with a non-local source address laddr,
+// used to send replies to client on behalf of original destination.
+func DialUDPFrom(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+	if laddr.IP.To4() == nil {
+		level, opt = syscall.SOL_IPV6, IPV6_TRANSPARENT
+	}
+	d := net.Dialer{LocalAddr: laddr, Control: func(network, address string, c syscall.RawConn) error {
+		return setSockOpts(c, level, opt)
+	}}
+	conn, err := d.Dial("udp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func setSockOpts(c syscall.RawConn, level int, opts ...int) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return
+		}
+		for _, opt := range opts {
+			if err = syscall.SetsockoptInt(int(fd), level, opt, 1); err != nil {
+				return
+			}
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,300 @@
+// Package remotelist download lists(eg: chnroutes, block hosts) from url
+// periodically, valid lists are applied and persisted to a cache directory,
+// so last good version is used on next start even if download fails.
+package remotelist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"snet/logger"
+	"snet/utils"
+)
+
+const (
+	maxListSize     = 64 << 20
+	downloadTimeout = 60 * time.Second
+	// a valid chnroutes list should have at least this many cidrs
+	minChnroutes = 1000
+	// failed lists are retried after minRetryInterval, it's doubled after
+	// each failure up to maxRetryInterval
+	minRetryInterval = 30 * time.Second
+	maxRetryInterval = 30 * time.Minute
+)
+
+// DialFunc dial tcp connection to addr(host:port)
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// List is a remote list, Update validate and apply downloaded data, data
+// is persisted only if Update succeeded.
+type List struct {
+	URL    string
+	Update func(data []byte) error
+}
+
+func (l *List) cacheFile(dir string) string {
+	sum := sha1.Sum([]byte(l.URL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".list")
+}
+
+// Updater refresh lists in background
+type Updater struct {
+	lists    []*List
+	dir      string
+	interval time.Duration
+	retry    time.Duration  // first retry interval of failed lists
+	clients  []*http.Client // tried in order until one succeeded
+	l        *logger.Logger
+}
+
+// NewUpdater create updater, dials are tried in order to download lists,
+// eg: direct first, then through proxy.
+func NewUpdater(lists []*List, dir string, interval time.Duration, dials []DialFunc, l *logger.Logger) *Updater {
+	u := &Updater{lists: lists, dir: dir, interval: interval, retry: minRetryInterval, l: l}
+	for _, dial := range dials {
+		u.clients = append(u.clients, &http.Client{
+			Transport: &http.Transport{Dial: dial},
+			Timeout:   downloadTimeout,
+		})
+	}
+	if len(u.clients) == 0 {
+		u.clients = []*http.Client{{Timeout: downloadTimeout}}
+	}
+	return u
+}
+
+// LoadCache apply cached lists, stale lists return true, they should be
+// refreshed soon.
+func (u *Updater) LoadCache() (stale bool) {
+	for _, list := range u.lists {
+		path := list.cacheFile(u.dir)
+		info, err := os.Stat(path)
+		if err != nil {
+			stale = true
+			continue
+		}
+		if time.Since(info.ModTime()) > u.interval {
+			stale = true
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			u.l.Error("failed to read cached list", list.URL, err)
+			stale = true
+			continue
+		}
+		if err := list.Update(data); err != nil {
+			u.l.Error("invalid cached list", list.URL, err)
+			stale = true
+		}
+	}
+	return stale
+}
+
+// Run refresh lists every interval until ctx is done, refresh immediately
+// if now is true. Failed lists are retried with backoff before next
+// interval.
+func (u *Updater) Run(ctx context.Context, now bool) {
+	var failed []*List
+	if now {
+		failed = u.refreshLists(u.lists)
+	}
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	retry := time.NewTimer(u.retry)
+	defer retry.Stop()
+	if len(failed) == 0 {
+		retry.Stop()
+	}
+	backoff := u.retry
+	for {
+		select {
+		case <-ticker.C:
+			failed = u.refreshLists(u.lists)
+			backoff = u.retry
+		case <-retry.C:
+			failed = u.refreshLists(failed)
+			if backoff *= 2; backoff > maxRetryInterval {
+				backoff = maxRetryInterval
+			}
+		case <-ctx.Done():
+			return
+		}
+		if !retry.Stop() {
+			// drain it if it fired with ticker together
+			select {
+			case <-retry.C:
+			default:
+			}
+		}
+		if len(failed) > 0 {
+			retry.Reset(backoff)
+		}
+	}
+}
+
+// Refresh download and apply all lists, failed list keep the old version
+func (u *Updater) Refresh() {
+	u.refreshLists(u.lists)
+}
+
+// refreshLists refresh lists and return failed ones
+func (u *Updater) refreshLists(lists []*List) (failed []*List) {
+	for _, list := range lists {
+		if err := u.refresh(list); err != nil {
+			u.l.Error("failed to refresh list", list.URL, err)
+			failed = append(failed, list)
+			continue
+		}
+		u.l.Info("list refreshed", list.URL)
+	}
+	return failed
+}
+
+func (u *Updater) refresh(list *List) error {
+	data, err := u.download(list.URL)
+	if err != nil {
+		return err
+	}
+	if err := list.Update(data); err != nil {
+		return err
+	}
+	return u.save(list.cacheFile(u.dir), data)
+}
+
+func (u *Updater) download(url string) (data []byte, err error) {
+	for _, c := range u.clients {
+		if data, err = get(c, url); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func get(c *http.Client, url string) ([]byte, error) {
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad response status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxListSize {
+		return nil, errors.New("list is too large")
+	}
+	return data, nil
+}
+
+// save write file atomically, so a broken file is never loaded
+func (u *Updater) save(path string, data []byte) error {
+	return utils.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// ParseCIDRs parse cidr list, each line is a cidr, or a record of
+// APNIC delegated stats(apnic|CN|ipv4|1.0.1.0|256|...) of country.
+func ParseCIDRs(data []byte, country string) ([]string, error) {
+	var cidrs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.Contains(line, "|") {
+			records, err := parseDelegated(line, country)
+			if err != nil {
+				return nil, err
+			}
+			cidrs = append(cidrs, records...)
+			continue
+		}
+		if _, _, err := net.ParseCIDR(line); err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, line)
+	}
+	return cidrs, scanner.Err()
+}
+
+// parseDelegated parse a record of APNIC delegated stats, nil is returned
+// if record is not an ip block of country.
+func parseDelegated(line, country string) ([]string, error) {
+	fields := strings.Split(line, "|")
+	if len(fields) < 5 || fields[1] != country || (fields[2] != "ipv4" && fields[2] != "ipv6") {
+		return nil, nil
+	}
+	value, err := strconv.Atoi(fields[4])
+	ip := net.ParseIP(fields[3])
+	if err != nil || value <= 0 || ip == nil {
+		return nil, errors.New("invalid delegated record " + line)
+	}
+	if fields[2] == "ipv6" {
+		// value is prefix length for ipv6
+		if value > 128 {
+			return nil, errors.New("invalid delegated record " + line)
+		}
+		return []string{fields[3] + "/" + fields[4]}, nil
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, errors.New("invalid delegated record " + line)
+	}
+	// value is number of addresses for ipv4, split it to cidrs if it's
+	// not power of 2
+	var cidrs []string
+	start := uint64(binary.BigEndian.Uint32(ip4))
+	for count := uint64(value); count > 0; {
+		size := uint64(1)
+		for size*2 <= count && start%(size*2) == 0 {
+			size *= 2
+		}
+		ones := 32
+		for n := size; n > 1; n >>= 1 {
+			ones--
+		}
+		b := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(b, uint32(start))
+		cidrs = append(cidrs, b.String()+"/"+strconv.Itoa(ones))
+		start += size
+		count -= size
+		if start > 1<<32 {
+			return nil, errors.New("invalid delegated record " + line)
+		}
+	}
+	return cidrs, nil
+}
+
+// ParseChnroutes parse chnroutes list and check it's not too short, which
+// may be an error page or truncated.
+func ParseChnroutes(data []byte) ([]string, error) {
+	cidrs, err := ParseCIDRs(data, "CN")
+	if err != nil {
+		return nil, err
+	}
+	if len(cidrs) < minChnroutes {
+		return nil, fmt.Errorf("too few cidrs in chnroutes: %d", len(cidrs))
+	}
+	return cidrs, nil
+}
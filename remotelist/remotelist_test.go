@@ -0,0 +1,140 @@
+package remotelist
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"snet/logger"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	data := []byte(`2|apnic|20210819|1|19850701|20210818|+1000
+apnic|*|ipv4|*|1|summary
+apnic|CN|ipv4|1.0.1.0|256|20110414|allocated
+apnic|CN|ipv4|1.0.2.0|768|20110414|allocated
+apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated
+apnic|CN|ipv6|2001:250::|35|20000426|allocated
+# plain cidr
+10.0.0.0/8
+`)
+	cidrs, err := ParseCIDRs(data, "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"1.0.1.0/24", "1.0.2.0/23", "1.0.4.0/24", "2001:250::/35", "10.0.0.0/8"}
+	if !reflect.DeepEqual(cidrs, expected) {
+		t.Error("unexpected cidrs", cidrs)
+	}
+	for _, bad := range []string{"apnic|CN|ipv4|1.0.1.0|x|", "10.0.0.0/33", "<html>"} {
+		if _, err := ParseCIDRs([]byte(bad), "CN"); err == nil {
+			t.Error("should fail for", bad)
+		}
+	}
+	if _, err := ParseChnroutes([]byte("1.0.1.0/24\n")); err == nil {
+		t.Error("short chnroutes should fail")
+	}
+}
+
+func TestUpdater(t *testing.T) {
+	content := "good"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "snet-remotelist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var applied []string
+	update := func(data []byte) error {
+		if string(data) != "good" {
+			return errors.New("invalid list")
+		}
+		applied = append(applied, string(data))
+		return nil
+	}
+	lists := []*List{{URL: ts.URL + "/list", Update: update}, {URL: ts.URL + "/missing", Update: update}}
+	u := NewUpdater(lists, dir, time.Hour, nil, logger.NewLogger(logger.FATAL))
+	if !u.LoadCache() {
+		t.Error("lists without cache should be stale")
+	}
+	u.Refresh()
+	if len(applied) != 1 {
+		t.Fatal("list should be applied once", applied)
+	}
+	// invalid list is not applied nor persisted
+	content = "bad"
+	u.Refresh()
+	if len(applied) != 1 {
+		t.Fatal("invalid list should not be applied", applied)
+	}
+	applied = nil
+	u = NewUpdater(lists[:1], dir, time.Hour, nil, logger.NewLogger(logger.FATAL))
+	if u.LoadCache() || len(applied) != 1 {
+		t.Error("cached list should be loaded", applied)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		u.Run(ctx, false)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("updater should quit when ctx is done")
+	}
+}
+
+func TestUpdaterRetry(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail before dns is ready
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("good"))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "snet-remotelist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	applied := make(chan struct{}, 1)
+	lists := []*List{{URL: ts.URL + "/list", Update: func(data []byte) error {
+		applied <- struct{}{}
+		return nil
+	}}}
+	u := NewUpdater(lists, dir, time.Hour, nil, logger.NewLogger(logger.FATAL))
+	u.retry = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go u.Run(ctx, true)
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed list should be retried before next interval")
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Error("unexpected requests", n)
+	}
+}
@@ -0,0 +1,378 @@
+// Package rule implement an ordered rule list to decide how a connection
+// or dns query should be routed: direct, through a proxy or rejected.
+//
+// A rule is written as "type,value,action", eg:
+//
+//	domain-suffix,google.com,proxy
+//	geoip,CN,direct
+//	dst-port,25,reject
+//	final,proxy
+//
+// Rules are evaluated in order, first matched rule wins.
+package rule
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"snet/cidradix"
+	"snet/config"
+	"snet/domaintrie"
+)
+
+const (
+	ActionDirect = "direct"
+	ActionProxy  = "proxy"
+	ActionReject = "reject"
+)
+
+const (
+	TypeDomain        = "domain"
+	TypeDomainSuffix  = "domain-suffix"
+	TypeDomainKeyword = "domain-keyword"
+	TypeDomainRegex   = "domain-regex"
+	TypeIPCIDR        = "ip-cidr"
+	TypeGeoIP         = "geoip"
+	TypeDstPort       = "dst-port"
+	TypeSrcIP         = "src-ip"
+	TypeFinal         = "final"
+)
+
+type Action struct {
+	Type  string // direct, proxy or reject
+	Proxy string // proxy name for proxy action, empty means the default one
+}
+
+func (a Action) String() string {
+	if a.Type == ActionProxy && a.Proxy != "" {
+		return a.Type + ":" + a.Proxy
+	}
+	return a.Type
+}
+
+// ParseAction parse action in form of: direct, reject, proxy or proxy:<name>
+func ParseAction(s string) (Action, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	switch parts[0] {
+	case ActionDirect, ActionReject:
+		if len(parts) == 2 {
+			return Action{}, errors.New("unexpected name in action " + s)
+		}
+		return Action{Type: parts[0]}, nil
+	case ActionProxy:
+		a := Action{Type: ActionProxy}
+		if len(parts) == 2 {
+			a.Proxy = parts[1]
+		}
+		return a, nil
+	}
+	return Action{}, errors.New("invalid action " + s)
+}
+
+// Target is the connection or dns query to be matched.
+// Zero value fields are unknown, rules depend on them won't match.
+type Target struct {
+	Domain string
+	IP     net.IP
+	Port   int
+	SrcIP  net.IP
+	// Resolve is optional, used to get IP lazily by Domain when ip rules
+	// are evaluated, eg: destination is a fake ip.
+	Resolve func(domain string) net.IP
+}
+
+type matcher func(t *Target) bool
+
+type Rule struct {
+	Type   string
+	Value  string
+	Action Action
+	match  matcher
+}
+
+func (r *Rule) String() string {
+	if r.Type == TypeFinal {
+		return r.Type + "," + r.Action.String()
+	}
+	return r.Type + "," + r.Value + "," + r.Action.String()
+}
+
+func (r *Rule) isDomainRule() bool {
+	return strings.HasPrefix(r.Type, TypeDomain)
+}
+
+func (r *Rule) isIPRule() bool {
+	return r.Type == TypeIPCIDR || r.Type == TypeGeoIP
+}
+
+// Parse parse a single rule, geoip is a map from country code to cidr tree
+func Parse(s string, geoip map[string]*cidradix.Tree) (*Rule, error) {
+	fields := strings.Split(s, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) == 2 && fields[0] == TypeFinal {
+		a, err := ParseAction(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return &Rule{Type: TypeFinal, Action: a, match: func(t *Target) bool { return true }}, nil
+	}
+	if len(fields) != 3 {
+		return nil, errors.New("invalid rule " + s)
+	}
+	a, err := ParseAction(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	r := &Rule{Type: fields[0], Value: fields[1], Action: a}
+	value := strings.ToLower(r.Value)
+	switch r.Type {
+	case TypeDomain:
+		r.match = func(t *Target) bool {
+			return t.Domain != "" && t.Domain == value
+		}
+	case TypeDomainSuffix:
+		r.match = func(t *Target) bool {
+			return t.Domain != "" && (t.Domain == value || strings.HasSuffix(t.Domain, "."+value))
+		}
+	case TypeDomainKeyword:
+		r.match = func(t *Target) bool {
+			return t.Domain != "" && strings.Contains(t.Domain, value)
+		}
+	case TypeDomainRegex:
+		re, err := regexp.Compile(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		r.match = func(t *Target) bool {
+			return t.Domain != "" && re.MatchString(t.Domain)
+		}
+	case TypeIPCIDR, TypeSrcIP:
+		ipnet, err := ParseCIDR(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		if r.Type == TypeIPCIDR {
+			r.match = func(t *Target) bool { return t.IP != nil && ipnet.Contains(t.IP) }
+		} else {
+			r.match = func(t *Target) bool { return t.SrcIP != nil && ipnet.Contains(t.SrcIP) }
+		}
+	case TypeGeoIP:
+		tree, ok := geoip[strings.ToUpper(r.Value)]
+		if !ok {
+			return nil, errors.New("no ip data for country " + r.Value)
+		}
+		r.match = func(t *Target) bool { return t.IP != nil && tree.Contains(t.IP) }
+	case TypeDstPort:
+		from, to, err := parsePortRange(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		r.match = func(t *Target) bool { return t.Port >= from && t.Port <= to }
+	default:
+		return nil, errors.New("invalid rule type " + r.Type)
+	}
+	return r, nil
+}
+
+// ParseCIDR accept both cidr and single ip
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid ip " + s)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// parsePortRange accept single port(443) or port range(8000-9000)
+func parsePortRange(s string) (from int, to int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if from, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid port %s", s)
+	}
+	to = from
+	if len(parts) == 2 {
+		if to, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %s", s)
+		}
+	}
+	if from <= 0 || to > 65535 || from > to {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+	return from, to, nil
+}
+
+// minDomainSetSize is the minimum number of consecutive domain rules
+// merged into a domain set
+const minDomainSetSize = 4
+
+// domainSet is consecutive domain and domain-suffix rules with same action,
+// they are matched by a trie at once rather than one by one.
+type domainSet struct {
+	trie  *domaintrie.Trie
+	rules []*Rule // value in trie is index of rule
+}
+
+func (d *domainSet) match(domain string) *Rule {
+	if i, ok := d.trie.Lookup(domain); ok {
+		return d.rules[i]
+	}
+	return nil
+}
+
+type Rules struct {
+	rules []*Rule
+	sets  map[int]*domainSet // key is index of set's first rule in rules
+}
+
+func isTrieRule(r *Rule) bool {
+	return r.Type == TypeDomain || r.Type == TypeDomainSuffix
+}
+
+// buildSets merge consecutive domain rules with same action into sets,
+// order of rules is kept.
+func (rs *Rules) buildSets() {
+	rs.sets = make(map[int]*domainSet)
+	for i := 0; i < len(rs.rules); {
+		j := i
+		for j < len(rs.rules) && isTrieRule(rs.rules[j]) && rs.rules[j].Action == rs.rules[i].Action {
+			j++
+		}
+		if j-i >= minDomainSetSize {
+			set := &domainSet{trie: domaintrie.New(), rules: rs.rules[i:j]}
+			for k, r := range set.rules {
+				set.trie.Insert(r.Value, r.Type == TypeDomainSuffix, k)
+			}
+			rs.sets[i] = set
+		}
+		if j == i {
+			j++
+		}
+		i = j
+	}
+}
+
+// match evaluate rules in order, prepare is called before a single rule
+// is evaluated, rule is skipped if it returns false.
+func (rs *Rules) match(t *Target, prepare func(r *Rule) bool) *Rule {
+	for i := 0; i < len(rs.rules); i++ {
+		if set := rs.sets[i]; set != nil {
+			if r := set.match(t.Domain); r != nil {
+				return r
+			}
+			i += len(set.rules) - 1
+			continue
+		}
+		if r := rs.rules[i]; prepare(r) && r.match(t) {
+			return r
+		}
+	}
+	return nil
+}
+
+func New(rules []string, geoip map[string]*cidradix.Tree) (*Rules, error) {
+	result := make([]*Rule, 0, len(rules))
+	for _, s := range rules {
+		r, err := Parse(s, geoip)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+		if r.Type == TypeFinal {
+			// rules after final will never be reached
+			break
+		}
+	}
+	rs := &Rules{rules: result}
+	rs.buildSets()
+	return rs, nil
+}
+
+// NewFromConfig build rules from config, legacy options are converted to rules
+// and evaluated in order: bypass-hosts(direct), force-fq(proxy), rules,
+// proxy-scope(bypassCN: geoip CN direct), final proxy.
+func NewFromConfig(c *config.Config, chnroutes *cidradix.Tree) (*Rules, error) {
+	rules := make([]string, 0, len(c.BypassHosts)+len(c.ForceFQ)+len(c.Rules)+2)
+	for _, h := range c.BypassHosts {
+		if net.ParseIP(h) != nil {
+			rules = append(rules, TypeIPCIDR+","+h+","+ActionDirect)
+		} else {
+			rules = append(rules, TypeDomain+","+h+","+ActionDirect)
+		}
+	}
+	for _, p := range c.ForceFQ {
+		kind, value, err := domaintrie.ParsePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case domaintrie.KindSuffix:
+			rules = append(rules, TypeDomainSuffix+","+value+","+ActionProxy)
+		case domaintrie.KindRegex:
+			rules = append(rules, TypeDomainRegex+","+value+","+ActionProxy)
+		default:
+			rules = append(rules, TypeDomain+","+value+","+ActionProxy)
+		}
+	}
+	rules = append(rules, c.Rules...)
+	if c.ProxyScope == config.ProxyScopeBypassCN {
+		rules = append(rules, TypeGeoIP+",CN,"+ActionDirect)
+	}
+	rules = append(rules, TypeFinal+","+ActionProxy)
+	return New(rules, map[string]*cidradix.Tree{"CN": chnroutes})
+}
+
+// Match return the first matched rule for target, nil if nothing matched.
+// If target's IP is resolved during matching, it's set back to t.IP.
+func (rs *Rules) Match(t *Target) *Rule {
+	if rs == nil {
+		return nil
+	}
+	_t := *t
+	_t.Domain = strings.ToLower(strings.TrimSuffix(t.Domain, "."))
+	resolved := false
+	return rs.match(&_t, func(r *Rule) bool {
+		if r.isIPRule() && _t.IP == nil && _t.Domain != "" && _t.Resolve != nil && !resolved {
+			resolved = true
+			_t.IP = _t.Resolve(_t.Domain)
+			t.IP = _t.IP
+		}
+		return true
+	})
+}
+
+// MatchDomain only evaluate domain rules, used by dns server,
+// since ip and port is unknown before resolving.
+func (rs *Rules) MatchDomain(domain string) *Rule {
+	if rs == nil {
+		return nil
+	}
+	t := &Target{Domain: strings.ToLower(strings.TrimSuffix(domain, "."))}
+	return rs.match(t, (*Rule).isDomainRule)
+}
+
+// ProxyNames return proxy names used by rules
+func (rs *Rules) ProxyNames() []string {
+	names := []string{}
+	if rs == nil {
+		return names
+	}
+	for _, r := range rs.rules {
+		if r.Action.Type == ActionProxy && r.Action.Proxy != "" {
+			names = append(names, r.Action.Proxy)
+		}
+	}
+	return names
+}
@@ -0,0 +1,193 @@
+package rule
+
+import (
+	"net"
+	"testing"
+
+	"snet/cidradix"
+	"snet/config"
+)
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{
+		"domain,google.com,proxy",
+		"domain-suffix,google.com,proxy:ss",
+		"domain-keyword,google,direct",
+		"domain-regex,^ad[0-9]+\\.,reject",
+		"ip-cidr,10.0.0.0/8,direct",
+		"ip-cidr,2001:db8::/32,direct",
+		"src-ip,192.168.1.10,direct",
+		"dst-port,8000-9000,proxy",
+		"final,direct",
+	} {
+		r, err := Parse(s, nil)
+		if err != nil {
+			t.Fatal(s, err)
+		}
+		if r.String() != s {
+			t.Error("rule string mismatch:", r.String(), s)
+		}
+	}
+	for _, s := range []string{
+		"domain,google.com",
+		"domain,google.com,block",
+		"direct:x",
+		"unknown,x,proxy",
+		"ip-cidr,10.0.0/8,direct",
+		"dst-port,0,proxy",
+		"dst-port,9000-8000,proxy",
+		"geoip,US,direct",
+		"domain-regex,(,reject",
+	} {
+		if _, err := Parse(s, nil); err == nil {
+			t.Error("should fail to parse:", s)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	_, cn, _ := net.ParseCIDR("1.0.1.0/24")
+	tree := cidradix.NewTree()
+	tree.AddCIDR(cn)
+	rs, err := New([]string{
+		"dst-port,25,reject",
+		"domain-suffix,google.com,proxy",
+		"src-ip,192.168.1.10/32,direct",
+		"geoip,cn,direct",
+		"final,proxy",
+		"domain,never.reached,reject",
+	}, map[string]*cidradix.Tree{"CN": tree})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		target *Target
+		action string
+	}{
+		{&Target{IP: net.ParseIP("8.8.8.8"), Port: 25}, ActionReject},
+		{&Target{Domain: "WWW.Google.com.", Port: 443}, ActionProxy},
+		{&Target{IP: net.ParseIP("8.8.8.8"), Port: 443, SrcIP: net.ParseIP("192.168.1.10")}, ActionDirect},
+		{&Target{IP: net.ParseIP("1.0.1.1"), Port: 443}, ActionDirect},
+		{&Target{IP: net.ParseIP("8.8.8.8"), Port: 443}, ActionProxy},
+	}
+	for _, c := range cases {
+		r := rs.Match(c.target)
+		if r == nil || r.Action.Type != c.action {
+			t.Errorf("target %+v should match %s, got %v", c.target, c.action, r)
+		}
+	}
+	if len(rs.rules) != 5 {
+		t.Error("rules after final should be dropped")
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	rs, err := New([]string{"dst-port,443,reject", "domain-keyword,ads,reject", "final,proxy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rs.MatchDomain("ads.example.com"); r == nil || r.Action.Type != ActionReject {
+		t.Error("domain should be rejected")
+	}
+	if r := rs.MatchDomain("example.com"); r != nil {
+		t.Error("non domain rules should be skipped, got", r)
+	}
+	var nilRules *Rules
+	if nilRules.MatchDomain("example.com") != nil || nilRules.Match(&Target{}) != nil {
+		t.Error("nil rules should match nothing")
+	}
+}
+
+func TestDomainSet(t *testing.T) {
+	rs, err := New([]string{
+		"domain,a.com,direct",
+		"domain-suffix,b.com,proxy",
+		"domain,x.b.com,proxy:ss",
+		"domain-suffix,c.com,proxy",
+		"domain,d.com,proxy",
+		"domain,e.com,proxy",
+		"domain,f.com,proxy",
+		"domain-keyword,g,reject",
+		"domain,g.com,proxy",
+		"final,direct",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.sets) != 1 || rs.sets[3] == nil || len(rs.sets[3].rules) != 4 {
+		t.Fatal("unexpected domain sets", rs.sets)
+	}
+	for domain, want := range map[string]string{
+		"a.com":      "domain,a.com,direct",
+		"x.b.com":    "domain-suffix,b.com,proxy",
+		"y.c.com":    "domain-suffix,c.com,proxy",
+		"F.com.":     "domain,f.com,proxy",
+		"x.f.com":    "final,direct",
+		"g.com":      "domain-keyword,g,reject",
+		"x.a.com":    "final,direct",
+		"www.d.com":  "final,direct",
+		"www.ee.com": "final,direct",
+	} {
+		if r := rs.Match(&Target{Domain: domain}); r == nil || r.String() != want {
+			t.Errorf("%s should match %s, got %v", domain, want, r)
+		}
+	}
+	if r := rs.MatchDomain("e.com"); r == nil || r.String() != "domain,e.com,proxy" {
+		t.Error("unexpected rule", r)
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	c := &config.Config{
+		BypassHosts: []string{"1.2.3.4", "example.com"},
+		ForceFQ:     []string{"*.google.com", "ad*.example.net"},
+		Rules:       []string{"domain,example.org,proxy:ss"},
+		ProxyScope:  config.ProxyScopeBypassCN,
+	}
+	rs, err := NewFromConfig(c, cidradix.NewTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ip-cidr,1.2.3.4,direct",
+		"domain,example.com,direct",
+		"domain-suffix,google.com,proxy",
+		"domain-regex,^ad.*\\.example\\.net$,proxy",
+		"domain,example.org,proxy:ss",
+		"geoip,CN,direct",
+		"final,proxy",
+	}
+	if len(rs.rules) != len(expected) {
+		t.Fatal("unexpected rules:", rs.rules)
+	}
+	for i, r := range rs.rules {
+		if r.String() != expected[i] {
+			t.Errorf("rule %d: expected %s, got %s", i, expected[i], r)
+		}
+	}
+	if names := rs.ProxyNames(); len(names) != 1 || names[0] != "ss" {
+		t.Error("unexpected proxy names:", names)
+	}
+}
+
+func TestMatchResolve(t *testing.T) {
+	rs, err := New([]string{"domain,a.com,proxy", "ip-cidr,10.0.0.0/8,direct", "final,proxy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	resolve := func(domain string) net.IP {
+		count++
+		return net.ParseIP("10.0.0.1")
+	}
+	if r := rs.Match(&Target{Domain: "a.com", Resolve: resolve}); r.Action.Type != ActionProxy || count != 0 {
+		t.Error("domain rule should match without resolving")
+	}
+	target := &Target{Domain: "b.com", Resolve: resolve}
+	if r := rs.Match(target); r.Action.Type != ActionDirect || count != 1 {
+		t.Error("ip rule should match resolved ip")
+	}
+	if !target.IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Error("resolved ip should be set back to target")
+	}
+}
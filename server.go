@@ -5,12 +5,17 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"snet/config"
 	"snet/proxy"
+	"snet/proxy/group"
+	"snet/ratelimit"
 	"snet/redirector"
+	"snet/rule"
 	"snet/sniffer"
 	"snet/stats"
 	"snet/utils"
@@ -18,6 +23,8 @@ import (
 
 const (
 	SO_ORIGINAL_DST = 80 // /usr/includ/linux/netfilter_ipv4.h
+	// upstream name of direct connections in dial errors
+	upstreamDirect = "direct"
 )
 
 type HostBytesMap struct {
@@ -26,39 +33,53 @@ type HostBytesMap struct {
 }
 
 type Server struct {
-	ctx      context.Context
-	cfg      *config.Config
-	listener *net.TCPListener
-	proxy    proxy.Proxy
-	timeout  time.Duration
+	// first field to be 64-bit aligned for atomic on 32-bit platforms
+	activeConns int64
+
+	ctx       context.Context
+	cfg       *config.Config
+	listeners []*net.TCPListener
+	// named upstream proxies, defaultProxy is used if rule doesn't specify one
+	proxies      map[string]proxy.Proxy
+	defaultProxy string
+	rules        *rule.Rules
+	targets      *targetResolver
+	conns        *stats.ConnTable // track open connections if set
+	limiter      *ratelimit.Limiter
+	timeout      time.Duration
 
 	// Total number from start
 	HostRxBytesTotal *HostBytesMap
 	HostTxBytesTotal *HostBytesMap
 	rxCh             chan *stats.P
 	txCh             chan *stats.P
-}
 
-func NewServer(ctx context.Context, c *config.Config) (*Server, error) {
-	addr := fmt.Sprintf("%s:%d", c.LHost, c.LPort)
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
+	// dial errors by upstream, direct or proxy name
+	dialErrors     map[string]uint64
+	dialErrorsLock sync.Mutex
+}
 
+func NewServer(ctx context.Context, c *config.Config, rules *rule.Rules) (*Server, error) {
+	proxies, defaultProxy, err := newProxies(c)
 	if err != nil {
 		return nil, err
 	}
-	p, err := proxy.Get(c.ProxyType)
-	if err != nil {
-		return nil, err
-	}
-	cfg, err := genConfigByType(c, c.ProxyType)
-	if err != nil {
-		return nil, err
+	for _, name := range rules.ProxyNames() {
+		if _, ok := proxies[name]; !ok {
+			return nil, errors.New("unknown proxy in rules: " + name)
+		}
 	}
-	if err := p.Init(cfg); err != nil {
-		return nil, err
+	var listeners []*net.TCPListener
+	for _, host := range c.ListenHosts() {
+		addr := net.JoinHostPort(host, strconv.Itoa(c.LPort))
+		ln, err := net.Listen(utils.IPNetwork("tcp", host), addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln.(*net.TCPListener))
 	}
 	var rxCh, txCh chan *stats.P
 	if c.EnableStats {
@@ -68,23 +89,41 @@ func NewServer(ctx context.Context, c *config.Config) (*Server, error) {
 	return &Server{
 		ctx:              ctx,
 		cfg:              c,
-		listener:         ln.(*net.TCPListener),
-		proxy:            p,
+		listeners:        listeners,
+		proxies:          proxies,
+		defaultProxy:     defaultProxy,
+		rules:            rules,
 		timeout:          time.Duration(c.ProxyTimeout) * time.Second,
 		HostRxBytesTotal: &HostBytesMap{m: make(map[string]uint64)},
 		HostTxBytesTotal: &HostBytesMap{m: make(map[string]uint64)},
 		rxCh:             rxCh,
 		txCh:             txCh,
+		dialErrors:       make(map[string]uint64),
 	}, nil
 }
 
 func (s *Server) Run() error {
-	l.Infof("Proxy server listen on tcp %s:%d", s.cfg.LHost, s.cfg.LPort)
 	if s.cfg.EnableStats {
 		go s.receiveStat()
 	}
+	for _, p := range s.proxies {
+		if g, ok := p.(*group.Group); ok {
+			go g.Run(s.ctx)
+		}
+	}
+	errCh := make(chan error, len(s.listeners))
+	for _, ln := range s.listeners {
+		go func(ln *net.TCPListener) {
+			errCh <- s.serve(ln)
+		}(ln)
+	}
+	return <-errCh
+}
+
+func (s *Server) serve(ln *net.TCPListener) error {
+	l.Info("Proxy server listen on tcp", ln.Addr())
 	for {
-		conn, err := s.listener.AcceptTCP()
+		conn, err := ln.AcceptTCP()
 		if err != nil {
 			return err
 		}
@@ -128,28 +167,171 @@ func (s *Server) handle(conn *net.TCPConn) error {
 	if err != nil {
 		return err
 	}
-	if dstHost == "127.0.0.1" {
+	dstIP := net.ParseIP(dstHost)
+	if dstIP != nil && dstIP.IsLoopback() {
 		return errors.New("drop connection to localhost")
 	}
-	remoteConn, err := s.proxy.Dial(dstHost, dstPort)
+	t, err := s.targets.target(dstIP, dstPort, conn.RemoteAddr().(*net.TCPAddr).IP)
+	if err != nil {
+		return err
+	}
+	dst := net.JoinHostPort(dstHost, strconv.Itoa(dstPort))
+	if t.Domain != "" {
+		// stats keyed by domain
+		dstHost = t.Domain
+	}
+	remoteConn, upstream, err := s.dial(t)
 	if err != nil {
 		return err
 	}
 	defer remoteConn.Close()
+	atomic.AddInt64(&s.activeConns, 1)
+	defer atomic.AddInt64(&s.activeConns, -1)
 	var sn *sniffer.Sniffer
 	if s.cfg.EnableStats {
 		sn = sniffer.NewSniffer(s.cfg.StatsEnableTLSSNISniffer, s.cfg.StatsEnableHTTPHostSniffer)
 	}
-	if err := utils.Pipe(s.ctx, conn, remoteConn, s.timeout, s.rxCh, s.txCh, dstHost, dstPort, sn); err != nil {
+	ctx := s.ctx
+	if s.conns != nil {
+		// connection is closed by cancelling its context from api
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(s.ctx)
+		defer cancel()
+		c := s.conns.Add(conn.RemoteAddr().String(), dst, t.Domain, upstream, cancel)
+		defer s.conns.Remove(c.ID)
+		go func(remoteConn net.Conn) {
+			// unblock reading of pipe
+			<-ctx.Done()
+			conn.Close()
+			remoteConn.Close()
+		}(remoteConn)
+		remoteConn = c.Wrap(remoteConn)
+		if sn != nil {
+			sn.Found = c.SetHost
+		}
+	}
+	remoteConn = s.limiter.Wrap(ctx, remoteConn, t)
+	// errors of connections closed from api are expected
+	if err := utils.Pipe(ctx, conn, remoteConn, s.timeout, s.rxCh, s.txCh, dstHost, dstPort, sn); err != nil && ctx.Err() == nil {
 		l.Error(err)
 	}
 	return nil
 }
 
-func (s *Server) Shutdown() error {
-	err := s.listener.Close()
+// dial connect to target by matched rule's action, default to proxy.
+// Direct connection use target ip, proxy use domain if it's known,
+// so proxy server can resolve it by itself. upstream is direct or name
+// of the proxy.
+func (s *Server) dial(t *rule.Target) (conn net.Conn, upstream string, err error) {
+	host := t.Domain
+	if host == "" {
+		host = t.IP.String()
+	}
+	action := rule.Action{Type: rule.ActionProxy}
+	if r := s.rules.Match(t); r != nil {
+		l.Debug("connection to", host, t.Port, "matched rule:", r)
+		action = r.Action
+	}
+	if action.Type == rule.ActionProxy {
+		if a, ok := s.limiter.OverQuota(t.SrcIP); ok {
+			l.Debug("client", t.SrcIP, "is over quota, connection to", host, t.Port, "is", a)
+			action = a
+		}
+	}
+	switch action.Type {
+	case rule.ActionReject:
+		return nil, "", fmt.Errorf("connection to %s rejected", net.JoinHostPort(host, strconv.Itoa(t.Port)))
+	case rule.ActionDirect:
+		ip, err := s.targets.realIP(t)
+		if err != nil {
+			return nil, "", err
+		}
+		conn, err = redirector.DialDirect("tcp", ip.String(), t.Port, s.timeout)
+		if err != nil {
+			s.addDialError(upstreamDirect)
+		}
+		return conn, upstreamDirect, err
+	}
+	upstream = action.Proxy
+	if upstream == "" {
+		upstream = s.defaultProxy
+	}
+	p, err := s.getProxy(upstream)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	if conn, err = p.Dial(host, t.Port); err != nil {
+		s.addDialError(upstream)
+	}
+	return conn, upstream, err
+}
+
+func (s *Server) addDialError(upstream string) {
+	s.dialErrorsLock.Lock()
+	s.dialErrors[upstream]++
+	s.dialErrorsLock.Unlock()
+}
+
+// DialErrors return number of failed dials by upstream
+func (s *Server) DialErrors() map[string]uint64 {
+	s.dialErrorsLock.Lock()
+	defer s.dialErrorsLock.Unlock()
+	m := make(map[string]uint64, len(s.dialErrors))
+	for k, v := range s.dialErrors {
+		m[k] = v
+	}
+	return m
+}
+
+// ActiveConns return number of connections being relayed
+func (s *Server) ActiveConns() int64 {
+	return atomic.LoadInt64(&s.activeConns)
+}
+
+// getProxy return proxy by name, empty name means the default one
+func (s *Server) getProxy(name string) (proxy.Proxy, error) {
+	if name == "" {
+		name = s.defaultProxy
+	}
+	p, ok := s.proxies[name]
+	if !ok {
+		return nil, errors.New("unknown proxy " + name)
+	}
+	return p, nil
+}
+
+// ProxyIPs return ips of all upstream proxies, they should bypass redirector
+func (s *Server) ProxyIPs() []net.IP {
+	ips := make([]net.IP, 0, len(s.proxies))
+	for _, p := range s.proxies {
+		if _, ok := p.(*group.Group); ok {
+			// members are in proxies too
+			continue
+		}
+		ips = append(ips, p.GetProxyIP())
+	}
+	return ips
+}
+
+// ProxyGroupStates return health state of all proxy groups
+func (s *Server) ProxyGroupStates() map[string]*group.State {
+	states := make(map[string]*group.State)
+	for name, p := range s.proxies {
+		if g, ok := p.(*group.Group); ok {
+			states[name] = g.State()
+		}
+	}
+	return states
+}
+
+func (s *Server) Shutdown() error {
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.proxies {
+		p.Close()
 	}
 	l.Info("redirector tcp server shutdown")
 	return nil
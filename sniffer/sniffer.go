@@ -7,10 +7,12 @@ import (
 type Sniffer struct {
 	EnableTLS  bool
 	EnableHTTP bool
+	// called with server name sniffed from connection if set
+	Found func(serverName string)
 }
 
 func NewSniffer(enableTLS, enableHTTP bool) *Sniffer {
-	return &Sniffer{enableTLS, enableHTTP}
+	return &Sniffer{EnableTLS: enableTLS, EnableHTTP: enableHTTP}
 }
 
 func (s *Sniffer) SnifferTLSSNI(conn net.Conn) (serverName string, buf []byte, err error) {
@@ -0,0 +1,161 @@
+package stats
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// destinations kept for each client, the one with least traffic is dropped
+// when it's full
+const maxClientHosts = 1000
+
+type traffic struct {
+	rx    uint64
+	tx    uint64
+	conns int
+}
+
+// client keep traffic of closed connections from a source ip
+type client struct {
+	traffic
+	hosts map[string]*traffic
+}
+
+func (c *client) add(host string, rx, tx uint64) {
+	c.rx += rx
+	c.tx += tx
+	c.conns++
+	h, ok := c.hosts[host]
+	if !ok {
+		if len(c.hosts) >= maxClientHosts {
+			c.dropLeast()
+		}
+		h = new(traffic)
+		c.hosts[host] = h
+	}
+	h.rx += rx
+	h.tx += tx
+	h.conns++
+}
+
+func (c *client) dropLeast() {
+	var least string
+	var min uint64
+	for host, h := range c.hosts {
+		if least == "" || h.rx+h.tx < min {
+			least, min = host, h.rx+h.tx
+		}
+	}
+	delete(c.hosts, least)
+}
+
+// clientIP return ip of connection source
+func (c *Conn) clientIP() string {
+	host, _, err := net.SplitHostPort(c.Src)
+	if err != nil {
+		return c.Src
+	}
+	return host
+}
+
+// destination return domain or server name of destination, ip if unknown
+func (c *Conn) destination() string {
+	if host := c.Host(); host != "" {
+		return host
+	}
+	host, _, err := net.SplitHostPort(c.Dst)
+	if err != nil {
+		return c.Dst
+	}
+	return host
+}
+
+// ClientInfo is traffic of a source ip, including open connections
+type ClientInfo struct {
+	IP          string
+	RxSize      uint64
+	TxSize      uint64
+	ActiveConns int
+	TotalConns  int
+}
+
+// HostTraffic is traffic from a client to a destination host
+type HostTraffic struct {
+	Host        string
+	RxSize      uint64
+	TxSize      uint64
+	ActiveConns int
+	TotalConns  int
+}
+
+// Clients return traffic of all clients, sorted by rx size
+func (t *ConnTable) Clients() []*ClientInfo {
+	t.lock.RLock()
+	m := make(map[string]*ClientInfo, len(t.clients))
+	for ip, c := range t.clients {
+		m[ip] = &ClientInfo{IP: ip, RxSize: c.rx, TxSize: c.tx, TotalConns: c.conns}
+	}
+	for _, c := range t.conns {
+		ip := c.clientIP()
+		info, ok := m[ip]
+		if !ok {
+			info = &ClientInfo{IP: ip}
+			m[ip] = info
+		}
+		info.RxSize += atomic.LoadUint64(&c.rx)
+		info.TxSize += atomic.LoadUint64(&c.tx)
+		info.ActiveConns++
+		info.TotalConns++
+	}
+	t.lock.RUnlock()
+	result := make([]*ClientInfo, 0, len(m))
+	for _, info := range m {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].RxSize != result[j].RxSize {
+			return result[i].RxSize > result[j].RxSize
+		}
+		return result[i].IP < result[j].IP
+	})
+	return result
+}
+
+// Destinations return traffic from client ip to each host, sorted by rx size
+func (t *ConnTable) Destinations(ip string) []*HostTraffic {
+	m := make(map[string]*HostTraffic)
+	t.lock.RLock()
+	if c, ok := t.clients[ip]; ok {
+		for host, h := range c.hosts {
+			m[host] = &HostTraffic{Host: host, RxSize: h.rx, TxSize: h.tx, TotalConns: h.conns}
+		}
+	}
+	for _, c := range t.conns {
+		if c.clientIP() != ip {
+			continue
+		}
+		host := c.destination()
+		h, ok := m[host]
+		if !ok {
+			h = &HostTraffic{Host: host}
+			m[host] = h
+		}
+		h.RxSize += atomic.LoadUint64(&c.rx)
+		h.TxSize += atomic.LoadUint64(&c.tx)
+		h.ActiveConns++
+		h.TotalConns++
+	}
+	t.lock.RUnlock()
+	result := make([]*HostTraffic, 0, len(m))
+	for _, h := range m {
+		result = append(result, h)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].RxSize != result[j].RxSize {
+			return result[i].RxSize > result[j].RxSize
+		}
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
@@ -0,0 +1,215 @@
+package stats
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is an open connection relayed by snet
+type Conn struct {
+	// first fields to be 64-bit aligned for atomic on 32-bit platforms
+	rx uint64
+	tx uint64
+	// traffic already added to history, guarded by ConnTable.lock
+	rxSeen uint64
+	txSeen uint64
+
+	ID       uint64
+	Src      string // client address
+	Dst      string // original destination address
+	Upstream string // direct or proxy name
+	Start    time.Time
+	hostLock sync.Mutex
+	host     string // domain of destination or sniffed server name
+	close    func()
+}
+
+func (c *Conn) SetHost(host string) {
+	c.hostLock.Lock()
+	c.host = host
+	c.hostLock.Unlock()
+}
+
+func (c *Conn) Host() string {
+	c.hostLock.Lock()
+	defer c.hostLock.Unlock()
+	return c.host
+}
+
+// Wrap return conn counting bytes read as rx and written as tx of c, it
+// should wrap the remote side.
+func (c *Conn) Wrap(conn net.Conn) net.Conn {
+	return &countingConn{Conn: conn, c: c}
+}
+
+type countingConn struct {
+	net.Conn
+	c *Conn
+}
+
+func (cc *countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	atomic.AddUint64(&cc.c.rx, uint64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	atomic.AddUint64(&cc.c.tx, uint64(n))
+	return n, err
+}
+
+// ConnInfo is snapshot of a connection
+type ConnInfo struct {
+	ID       uint64
+	Src      string
+	Dst      string
+	Host     string
+	Upstream string
+	Start    time.Time
+	Duration string
+	RxSize   uint64
+	TxSize   uint64
+}
+
+// ConnTable track open connections, it's kept across config reload since
+// connections outlive the server accepted them.
+type ConnTable struct {
+	lock  sync.RWMutex
+	next  uint64
+	conns map[uint64]*Conn
+	// traffic of closed connections by client ip
+	clients map[string]*client
+	history *History
+}
+
+func NewConnTable() *ConnTable {
+	return &ConnTable{conns: make(map[uint64]*Conn), clients: make(map[string]*client)}
+}
+
+// Add register connection from src to dst with host, id and start time
+// are assigned. close is called to terminate the connection by Close.
+func (t *ConnTable) Add(src, dst, host, upstream string, close func()) *Conn {
+	c := &Conn{Src: src, Dst: dst, Upstream: upstream, Start: time.Now(), host: host, close: close}
+	t.lock.Lock()
+	t.next++
+	c.ID = t.next
+	t.conns[c.ID] = c
+	t.lock.Unlock()
+	return c
+}
+
+// Remove unregister closed connection, its traffic is added to client
+func (t *ConnTable) Remove(id uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c, ok := t.conns[id]
+	if !ok {
+		return
+	}
+	delete(t.conns, id)
+	ip := c.clientIP()
+	cl, ok := t.clients[ip]
+	if !ok {
+		cl = &client{hosts: make(map[string]*traffic)}
+		t.clients[ip] = cl
+	}
+	cl.add(c.destination(), atomic.LoadUint64(&c.rx), atomic.LoadUint64(&c.tx))
+	t.record(c, time.Now())
+}
+
+// SetHistory add traffic of connections to h, by Flush and when they're
+// removed.
+func (t *ConnTable) SetHistory(h *History) {
+	t.lock.Lock()
+	t.history = h
+	t.lock.Unlock()
+}
+
+// Flush add traffic of open connections since last flush to history, it
+// should be called every second or so.
+func (t *ConnTable) Flush() {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, c := range t.conns {
+		t.record(c, now)
+	}
+}
+
+// record add traffic of c not in history yet, t.lock must be held
+func (t *ConnTable) record(c *Conn, now time.Time) {
+	if t.history == nil {
+		return
+	}
+	rx, tx := atomic.LoadUint64(&c.rx), atomic.LoadUint64(&c.tx)
+	t.history.add(c.clientIP(), c.destination(), rx-c.rxSeen, tx-c.txSeen, now)
+	c.rxSeen, c.txSeen = rx, tx
+}
+
+// Close terminate connection of id, false is returned if it's not found
+func (t *ConnTable) Close(id uint64) bool {
+	t.lock.RLock()
+	c, ok := t.conns[id]
+	t.lock.RUnlock()
+	if ok && c.close != nil {
+		c.close()
+	}
+	return ok
+}
+
+// CloseHost terminate all connections to host, host is matched against
+// domain(or sniffed server name) and ip of destination. Number of closed
+// connections is returned.
+func (t *ConnTable) CloseHost(host string) int {
+	var matched []*Conn
+	t.lock.RLock()
+	for _, c := range t.conns {
+		if dstHost, _, _ := net.SplitHostPort(c.Dst); c.Host() == host || dstHost == host {
+			matched = append(matched, c)
+		}
+	}
+	t.lock.RUnlock()
+	for _, c := range matched {
+		if c.close != nil {
+			c.close()
+		}
+	}
+	return len(matched)
+}
+
+func (t *ConnTable) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.conns)
+}
+
+// List return snapshot of open connections, oldest first
+func (t *ConnTable) List() []*ConnInfo {
+	t.lock.RLock()
+	conns := make([]*Conn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.lock.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	now := time.Now()
+	result := make([]*ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		result = append(result, &ConnInfo{
+			ID:       c.ID,
+			Src:      c.Src,
+			Dst:      c.Dst,
+			Host:     c.Host(),
+			Upstream: c.Upstream,
+			Start:    c.Start,
+			Duration: now.Sub(c.Start).Truncate(time.Second).String(),
+			RxSize:   atomic.LoadUint64(&c.rx),
+			TxSize:   atomic.LoadUint64(&c.tx),
+		})
+	}
+	return result
+}
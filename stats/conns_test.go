@@ -0,0 +1,100 @@
+package stats
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestConnTable(t *testing.T) {
+	table := NewConnTable()
+	c1 := table.Add("192.168.1.2:5000", "1.2.3.4:443", "", "direct", nil)
+	c2 := table.Add("192.168.1.3:5000", "5.6.7.8:80", "example.com", "proxy", nil)
+	if c1.ID == c2.ID {
+		t.Fatal("id should be unique")
+	}
+	c1.SetHost("github.com")
+
+	local, remote := net.Pipe()
+	conn := c1.Wrap(local)
+	go func() {
+		remote.Write([]byte("hello"))
+		ioutil.ReadAll(remote)
+	}()
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	list := table.List()
+	if len(list) != 2 || list[0].ID != c1.ID || list[1].ID != c2.ID {
+		t.Fatal("unexpected connections", list)
+	}
+	if info := list[0]; info.Host != "github.com" || info.RxSize != 5 || info.TxSize != 2 || info.Upstream != "direct" {
+		t.Error("unexpected connection info", info)
+	}
+	table.Remove(c1.ID)
+	if table.Len() != 1 {
+		t.Error("c1 should be removed")
+	}
+}
+
+func TestConnTableClose(t *testing.T) {
+	table := NewConnTable()
+	closed := make(map[uint64]bool)
+	add := func(dst, host string) *Conn {
+		var c *Conn
+		c = table.Add("192.168.1.2:5000", dst, host, "direct", func() { closed[c.ID] = true })
+		return c
+	}
+	c1 := add("1.2.3.4:443", "github.com")
+	c2 := add("1.2.3.5:443", "github.com")
+	c3 := add("5.6.7.8:80", "")
+	if !table.Close(c1.ID) || !closed[c1.ID] {
+		t.Error("c1 should be closed")
+	}
+	if table.Close(100) {
+		t.Error("unknown connection should not be found")
+	}
+	if n := table.CloseHost("github.com"); n != 2 || !closed[c2.ID] {
+		t.Error("connections to github.com should be closed", n)
+	}
+	if n := table.CloseHost("5.6.7.8"); n != 1 || !closed[c3.ID] {
+		t.Error("connection to 5.6.7.8 should be closed", n)
+	}
+}
+
+func TestClients(t *testing.T) {
+	table := NewConnTable()
+	c1 := table.Add("192.168.1.2:5000", "1.2.3.4:443", "github.com", "direct", nil)
+	c1.rx, c1.tx = 100, 10
+	c2 := table.Add("192.168.1.2:5001", "1.2.3.5:443", "", "direct", nil)
+	c2.rx, c2.tx = 50, 5
+	c3 := table.Add("192.168.1.3:5000", "1.2.3.4:443", "github.com", "direct", nil)
+	c3.rx, c3.tx = 300, 30
+	table.Remove(c1.ID)
+	c4 := table.Add("192.168.1.2:5002", "1.2.3.4:443", "github.com", "direct", nil)
+	c4.rx = 1
+
+	clients := table.Clients()
+	if len(clients) != 2 || clients[0].IP != "192.168.1.3" {
+		t.Fatal("unexpected clients", clients)
+	}
+	if c := clients[1]; c.RxSize != 151 || c.TxSize != 15 || c.ActiveConns != 2 || c.TotalConns != 3 {
+		t.Error("unexpected client", c)
+	}
+	dsts := table.Destinations("192.168.1.2")
+	if len(dsts) != 2 {
+		t.Fatal("unexpected destinations", dsts)
+	}
+	if h := dsts[0]; h.Host != "github.com" || h.RxSize != 101 || h.ActiveConns != 1 || h.TotalConns != 2 {
+		t.Error("unexpected destination", h)
+	}
+	if h := dsts[1]; h.Host != "1.2.3.5" || h.RxSize != 50 {
+		t.Error("unexpected destination", h)
+	}
+}
@@ -0,0 +1,440 @@
+package stats
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	UnitMinute = "minute"
+	UnitHour   = "hour"
+	UnitDay    = "day"
+	UnitMonth  = "month" // aggregated from day buckets
+)
+
+const (
+	// bump it if format of history file changed, other version is ignored
+	historyVersion = 1
+	// hosts and clients kept in a bucket, traffic of others is counted as
+	// OtherKey
+	maxBucketKeys = 1000
+	OtherKey      = "other"
+	// hosts and clients kept in day buckets of past months, history file
+	// is kept small as it's rewritten periodically
+	maxOldBucketKeys = 50
+)
+
+// resolution of buckets, keep is number of buckets kept
+type resolution struct {
+	unit  string
+	keep  int
+	start func(t time.Time) time.Time
+}
+
+var resolutions = []resolution{
+	{UnitMinute, 120, minuteStart},
+	{UnitHour, 72, hourStart},
+	// more than a year, for monthly usage
+	{UnitDay, 400, dayStart},
+}
+
+// start of hour, day and month are in local time
+
+func minuteStart(t time.Time) time.Time {
+	return t.Truncate(time.Minute)
+}
+
+func hourStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+func dayStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// Usage is traffic in a period
+type Usage struct {
+	RxSize uint64
+	TxSize uint64
+}
+
+func (u *Usage) add(o Usage) {
+	u.RxSize += o.RxSize
+	u.TxSize += o.TxSize
+}
+
+type bucket struct {
+	Start   time.Time
+	Total   Usage
+	Hosts   map[string]*Usage
+	Clients map[string]*Usage
+}
+
+func newBucket(start time.Time) *bucket {
+	return &bucket{Start: start, Hosts: make(map[string]*Usage), Clients: make(map[string]*Usage)}
+}
+
+func addUsage(m map[string]*Usage, key string, u Usage) {
+	v, ok := m[key]
+	if !ok {
+		if len(m) >= maxBucketKeys {
+			key = OtherKey
+			v, ok = m[key]
+		}
+		if !ok {
+			v = new(Usage)
+			m[key] = v
+		}
+	}
+	v.add(u)
+}
+
+// monthUsage is traffic of each client in a month, clients are never merged
+// into OtherKey, so quota of every client can be checked.
+type monthUsage struct {
+	Start   time.Time
+	Clients map[string]*Usage
+}
+
+// History aggregate traffic of hosts and clients into minute, hour and day
+// buckets. It's fed by ConnTable and can be saved to file, so daily and
+// monthly usage survive restart.
+type History struct {
+	lock    sync.Mutex
+	series  map[string][]*bucket
+	month   *monthUsage // current month
+	changes uint64
+}
+
+func NewHistory() *History {
+	return &History{series: make(map[string][]*bucket)}
+}
+
+// add traffic from client to host at now
+func (h *History) add(client, host string, rx, tx uint64, now time.Time) {
+	if h == nil || rx == 0 && tx == 0 {
+		return
+	}
+	u := Usage{rx, tx}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.changes++
+	for _, r := range resolutions {
+		b := h.current(r, now)
+		b.Total.add(u)
+		addUsage(b.Hosts, host, u)
+		addUsage(b.Clients, client, u)
+	}
+	h.addMonth(client, u, now)
+}
+
+// addMonth add traffic of client to usage of the month now is in, usage of
+// previous month is dropped.
+func (h *History) addMonth(client string, u Usage, now time.Time) {
+	start := monthStart(now)
+	if h.month == nil || h.month.Start.Before(start) {
+		h.month = &monthUsage{Start: start, Clients: make(map[string]*Usage)}
+	}
+	v, ok := h.month.Clients[client]
+	if !ok {
+		v = new(Usage)
+		h.month.Clients[client] = v
+	}
+	v.add(u)
+}
+
+// current return bucket of now, new bucket is appended and old ones out of
+// resolution are dropped.
+func (h *History) current(r resolution, now time.Time) *bucket {
+	buckets := h.series[r.unit]
+	start := r.start(now)
+	if n := len(buckets); n > 0 && !buckets[n-1].Start.Before(start) {
+		// also used if clock goes back
+		return buckets[n-1]
+	}
+	b := newBucket(start)
+	buckets = append(buckets, b)
+	if len(buckets) > r.keep {
+		buckets = append(buckets[:0], buckets[len(buckets)-r.keep:]...)
+	}
+	if r.unit == UnitDay {
+		month := monthStart(start)
+		for _, old := range buckets {
+			if old.Start.Before(month) {
+				compactUsage(old.Hosts, maxOldBucketKeys)
+				compactUsage(old.Clients, maxOldBucketKeys)
+			}
+		}
+	}
+	h.series[r.unit] = buckets
+	return b
+}
+
+// compactUsage keep top n keys of m by rx + tx, others are merged into
+// OtherKey
+func compactUsage(m map[string]*Usage, n int) {
+	if len(m) <= n {
+		return
+	}
+	other, ok := m[OtherKey]
+	if !ok {
+		other = new(Usage)
+	}
+	delete(m, OtherKey)
+	top := make([]*NamedUsage, 0, len(m))
+	for k, u := range m {
+		top = append(top, &NamedUsage{k, *u})
+	}
+	sortUsages(top)
+	for _, u := range top[n-1:] {
+		other.add(u.Usage)
+		delete(m, u.Name)
+	}
+	m[OtherKey] = other
+}
+
+// sortUsages sort by rx + tx, largest first
+func sortUsages(usages []*NamedUsage) {
+	sort.Slice(usages, func(i, j int) bool {
+		a, b := usages[i], usages[j]
+		if a.RxSize+a.TxSize != b.RxSize+b.TxSize {
+			return a.RxSize+a.TxSize > b.RxSize+b.TxSize
+		}
+		return a.Name < b.Name
+	})
+}
+
+// Changes return number of updates of history, it's unchanged since last
+// save if number is the same.
+func (h *History) Changes() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.changes
+}
+
+// UsagePoint is total traffic of a bucket
+type UsagePoint struct {
+	Start time.Time
+	Usage
+}
+
+// Series return total traffic of last n buckets of unit, oldest first.
+func (h *History) Series(unit string, n int) ([]*UsagePoint, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var points []*UsagePoint
+	switch unit {
+	case UnitMinute, UnitHour, UnitDay:
+		for _, b := range h.series[unit] {
+			points = append(points, &UsagePoint{b.Start, b.Total})
+		}
+	case UnitMonth:
+		for _, b := range h.series[UnitDay] {
+			start := monthStart(b.Start)
+			if len(points) == 0 || !points[len(points)-1].Start.Equal(start) {
+				points = append(points, &UsagePoint{Start: start})
+			}
+			points[len(points)-1].add(b.Total)
+		}
+	default:
+		return nil, errors.New("invalid unit " + unit)
+	}
+	if n > 0 && len(points) > n {
+		points = points[len(points)-n:]
+	}
+	return points, nil
+}
+
+// NamedUsage is traffic of a host or client
+type NamedUsage struct {
+	Name string
+	Usage
+}
+
+// TopModel is traffic of current hour, day or month
+type TopModel struct {
+	Start time.Time
+	Usage
+	Top []*NamedUsage
+}
+
+// Top return total traffic of the hour, day or month now is in, and top n
+// hosts(by is "host") or clients(by is "client") of it, sorted by rx + tx.
+func (h *History) Top(unit, by string, n int, now time.Time) (*TopModel, error) {
+	var start, end time.Time
+	series := unit
+	switch unit {
+	case UnitHour:
+		start = hourStart(now)
+		end = start.Add(time.Hour)
+	case UnitDay:
+		start = dayStart(now)
+		end = start.AddDate(0, 0, 1)
+	case UnitMonth:
+		start = monthStart(now)
+		end = start.AddDate(0, 1, 0)
+		series = UnitDay
+	default:
+		return nil, errors.New("invalid unit " + unit)
+	}
+	if by != "host" && by != "client" {
+		return nil, errors.New("invalid by " + by)
+	}
+	h.lock.Lock()
+	result := &TopModel{Start: start}
+	m := make(map[string]*Usage)
+	for _, b := range h.series[series] {
+		if b.Start.Before(start) || !b.Start.Before(end) {
+			continue
+		}
+		result.add(b.Total)
+		usages := b.Hosts
+		if by == "client" {
+			usages = b.Clients
+		}
+		for k, u := range usages {
+			v, ok := m[k]
+			if !ok {
+				v = new(Usage)
+				m[k] = v
+			}
+			v.add(*u)
+		}
+	}
+	h.lock.Unlock()
+	result.Top = make([]*NamedUsage, 0, len(m))
+	for k, u := range m {
+		result.Top = append(result.Top, &NamedUsage{k, *u})
+	}
+	sortUsages(result.Top)
+	if n > 0 && len(result.Top) > n {
+		result.Top = result.Top[:n]
+	}
+	return result, nil
+}
+
+// MonthUsage return traffic of client in the month now is in
+func (h *History) MonthUsage(client string, now time.Time) Usage {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.month == nil || !h.month.Start.Equal(monthStart(now)) {
+		return Usage{}
+	}
+	if u, ok := h.month.Clients[client]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+type historySnapshot struct {
+	Version int
+	Series  map[string][]*bucket
+	Month   *monthUsage // missing in files of older snet
+}
+
+// Save write all buckets to w
+func (h *History) Save(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return gob.NewEncoder(w).Encode(&historySnapshot{historyVersion, h.series, h.month})
+}
+
+// Load replace buckets with ones saved by Save, traffic recorded before
+// loading is added back.
+func (h *History) Load(r io.Reader) error {
+	var snap historySnapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+	if snap.Version != historyVersion {
+		return errors.New("unsupported traffic history version")
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	recorded, recordedMonth := h.series, h.month
+	if len(recorded) > 0 {
+		// not in saved history yet
+		h.changes++
+	}
+	h.series = make(map[string][]*bucket)
+	h.month = snap.Month
+	if h.month == nil {
+		h.month = monthFromDays(snap.Series[UnitDay])
+	} else if h.month.Clients == nil {
+		h.month.Clients = make(map[string]*Usage)
+	}
+	for _, r := range resolutions {
+		buckets := snap.Series[r.unit]
+		if len(buckets) > r.keep {
+			buckets = buckets[len(buckets)-r.keep:]
+		}
+		for _, b := range buckets {
+			// empty maps are decoded as nil
+			if b.Hosts == nil {
+				b.Hosts = make(map[string]*Usage)
+			}
+			if b.Clients == nil {
+				b.Clients = make(map[string]*Usage)
+			}
+		}
+		h.series[r.unit] = buckets
+		for _, b := range recorded[r.unit] {
+			cur := h.current(r, b.Start)
+			cur.Total.add(b.Total)
+			for k, u := range b.Hosts {
+				addUsage(cur.Hosts, k, *u)
+			}
+			for k, u := range b.Clients {
+				addUsage(cur.Clients, k, *u)
+			}
+		}
+	}
+	if recordedMonth != nil {
+		for k, u := range recordedMonth.Clients {
+			h.addMonth(k, *u, recordedMonth.Start)
+		}
+	}
+	return nil
+}
+
+// monthFromDays sum client usage of day buckets in month of the last one,
+// clients merged into OtherKey are lost.
+func monthFromDays(days []*bucket) *monthUsage {
+	if len(days) == 0 {
+		return nil
+	}
+	m := &monthUsage{Start: monthStart(days[len(days)-1].Start), Clients: make(map[string]*Usage)}
+	for _, b := range days {
+		if b.Start.Before(m.Start) {
+			continue
+		}
+		for k, u := range b.Clients {
+			v, ok := m.Clients[k]
+			if !ok {
+				v = new(Usage)
+				m.Clients[k] = v
+			}
+			v.add(*u)
+		}
+	}
+	return m
+}
+
+// LoadFile load history saved by Save
+func (h *History) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return h.Load(f)
+}
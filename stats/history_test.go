@@ -0,0 +1,158 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	h := NewHistory()
+	start := time.Date(2020, 5, 31, 23, 0, 0, 0, time.Local)
+	h.add("192.168.1.2", "github.com", 100, 10, start)
+	h.add("192.168.1.3", "github.com", 50, 5, start.Add(30*time.Minute))
+	// next day and month
+	h.add("192.168.1.2", "google.com", 20, 2, start.Add(90*time.Minute))
+	h.add("192.168.1.2", "github.com", 10, 1, start.Add(150*time.Minute))
+
+	hours, err := h.Series(UnitHour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 3 || hours[0].RxSize != 150 || hours[1].RxSize != 20 || !hours[2].Start.Equal(start.Add(2*time.Hour)) {
+		t.Error("unexpected hours", hours)
+	}
+	months, _ := h.Series(UnitMonth, 0)
+	if len(months) != 2 || months[0].RxSize != 150 || months[1].RxSize != 30 || months[1].Start.Month() != time.June {
+		t.Error("unexpected months", months)
+	}
+	if last, _ := h.Series(UnitMinute, 1); len(last) != 1 || last[0].RxSize != 10 {
+		t.Error("unexpected last minute", last)
+	}
+	if _, err := h.Series("week", 0); err == nil {
+		t.Error("invalid unit should fail")
+	}
+
+	top, err := h.Top(UnitMonth, "host", 1, start.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if top.RxSize != 30 || top.TxSize != 3 || len(top.Top) != 1 || top.Top[0].Name != "google.com" {
+		t.Error("unexpected top hosts", top, top.Top)
+	}
+	top, _ = h.Top(UnitDay, "client", 10, start)
+	if len(top.Top) != 2 || top.Top[0].Name != "192.168.1.2" || top.Top[0].RxSize != 100 {
+		t.Error("unexpected top clients", top.Top)
+	}
+	if _, err := h.Top(UnitDay, "port", 10, start); err == nil {
+		t.Error("invalid by should fail")
+	}
+	if u := h.MonthUsage("192.168.1.2", start.Add(3*time.Hour)); u.RxSize != 30 || u.TxSize != 3 {
+		t.Error("unexpected month usage", u)
+	}
+
+	var buf bytes.Buffer
+	if err := h.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewHistory()
+	loaded.add("192.168.1.2", "github.com", 1, 1, start.Add(150*time.Minute))
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	months, _ = loaded.Series(UnitMonth, 0)
+	if len(months) != 2 || months[0].RxSize != 150 || months[1].RxSize != 31 {
+		t.Error("unexpected loaded months", months)
+	}
+	if u := loaded.MonthUsage("192.168.1.2", start.Add(3*time.Hour)); u.RxSize != 31 {
+		t.Error("unexpected loaded month usage", u)
+	}
+
+	// history saved without month usage
+	buf.Reset()
+	if err := gob.NewEncoder(&buf).Encode(&historySnapshot{Version: historyVersion, Series: h.series}); err != nil {
+		t.Fatal(err)
+	}
+	loaded = NewHistory()
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if u := loaded.MonthUsage("192.168.1.2", start.Add(3*time.Hour)); u.RxSize != 30 {
+		t.Error("month usage should be summed from days", u)
+	}
+}
+
+func TestHistoryBounded(t *testing.T) {
+	h := NewHistory()
+	now := time.Now()
+	for i := 0; i < maxBucketKeys+10; i++ {
+		h.add("192.168.1.2", strconv.Itoa(i)+".com", 1, 0, now)
+	}
+	top, _ := h.Top(UnitDay, "host", 0, now)
+	if len(top.Top) != maxBucketKeys+1 || top.Top[0].Name != OtherKey || top.Top[0].RxSize != 10 {
+		t.Error("unexpected hosts", len(top.Top), top.Top[0])
+	}
+	// clients merged into other still have month usage
+	for i := 0; i < maxBucketKeys+10; i++ {
+		h.add("10.0.0."+strconv.Itoa(i), "a.com", 1, 0, now)
+	}
+	if u := h.MonthUsage("10.0.0."+strconv.Itoa(maxBucketKeys+5), now); u.RxSize != 1 {
+		t.Error("unexpected month usage", u)
+	}
+	if u := h.MonthUsage("10.0.0.1", now.AddDate(0, 1, 0)); u.RxSize != 0 {
+		t.Error("month usage of next month should be empty", u)
+	}
+	for i := 0; i < 200; i++ {
+		h.add("192.168.1.2", "a.com", 1, 0, now.Add(time.Duration(i)*time.Minute))
+	}
+	if minutes, _ := h.Series(UnitMinute, 0); len(minutes) != 120 {
+		t.Error("unexpected minute buckets", len(minutes))
+	}
+}
+
+func TestHistoryCompact(t *testing.T) {
+	h := NewHistory()
+	start := time.Date(2020, 5, 30, 12, 0, 0, 0, time.Local)
+	for i := 0; i < maxOldBucketKeys+10; i++ {
+		h.add("192.168.1.2", strconv.Itoa(i)+".com", uint64(i+1), 0, start)
+	}
+	if h.Changes() != maxOldBucketKeys+10 {
+		t.Error("unexpected changes", h.Changes())
+	}
+	// same month, not compacted
+	h.add("192.168.1.2", "a.com", 1, 0, start.Add(24*time.Hour))
+	if top, _ := h.Top(UnitDay, "host", 0, start); len(top.Top) != maxOldBucketKeys+10 {
+		t.Error("bucket of current month should not be compacted", len(top.Top))
+	}
+	h.add("192.168.1.2", "a.com", 1, 0, start.Add(48*time.Hour))
+	top, _ := h.Top(UnitDay, "host", 0, start)
+	if len(top.Top) != maxOldBucketKeys || top.RxSize != 60*61/2 {
+		t.Error("bucket of last month should be compacted", len(top.Top), top.RxSize)
+	}
+	// 0.com to 10.com are merged
+	for _, u := range top.Top {
+		if u.Name == OtherKey && u.RxSize != 11*12/2 {
+			t.Error("unexpected other", u)
+		}
+	}
+}
+
+func TestConnTableHistory(t *testing.T) {
+	table := NewConnTable()
+	h := NewHistory()
+	table.SetHistory(h)
+	c := table.Add("192.168.1.2:5000", "1.2.3.4:443", "github.com", "direct", nil)
+	atomic.AddUint64(&c.rx, 100)
+	table.Flush()
+	atomic.AddUint64(&c.rx, 50)
+	table.Flush()
+	atomic.AddUint64(&c.tx, 5)
+	table.Remove(c.ID)
+	top, _ := h.Top(UnitDay, "host", 10, time.Now())
+	if top.RxSize != 150 || top.TxSize != 5 || len(top.Top) != 1 || top.Top[0].Name != "github.com" {
+		t.Error("unexpected history", top, top.Top)
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"container/ring"
 	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -119,9 +119,9 @@ func (s *Stats) ToJson() []byte {
 	result.Total = total{RxSize: s.rxBytes, TxSize: s.txBytes}
 	result.Hosts = make([]*host, 0, len(s.hosts))
 	for h, p := range s.hosts {
-		pa := strings.Split(h, ":")
-		port, _ := strconv.Atoi(pa[1])
-		result.Hosts = append(result.Hosts, &host{Host: pa[0],
+		hostname, _port, _ := net.SplitHostPort(h)
+		port, _ := strconv.Atoi(_port)
+		result.Hosts = append(result.Hosts, &host{Host: hostname,
 			Port:   port,
 			RxRate: p.RxRate2(), TxRate: p.TxRate2(),
 			RxSize: p.RxTotal(), TxSize: p.TxTotal(),
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"snet/dns"
+	"snet/rule"
+)
+
+// targetResolver build rule target for redirected destination, domain is
+// recovered from served dns answers or fake ip pool.
+type targetResolver struct {
+	ipDomains *dns.IPDomainMap
+	fakeIPs   *dns.FakeIPPool
+	// resolve real ip of domain, bypass fake ip
+	resolve func(domain string) (net.IP, error)
+}
+
+func (r *targetResolver) target(dstIP net.IP, dstPort int, srcIP net.IP) (*rule.Target, error) {
+	t := &rule.Target{IP: dstIP, Port: dstPort, SrcIP: srcIP}
+	if r == nil {
+		return t, nil
+	}
+	if r.fakeIPs.Contains(dstIP) {
+		domain := r.fakeIPs.Lookup(dstIP)
+		if domain == "" {
+			return nil, fmt.Errorf("fake ip %s is not allocated or recycled", dstIP)
+		}
+		// real ip is resolved only when needed
+		t.IP = nil
+		t.Domain = domain
+		t.Resolve = r.resolveIP
+		return t, nil
+	}
+	t.Domain = r.ipDomains.Lookup(dstIP)
+	return t, nil
+}
+
+func (r *targetResolver) resolveIP(domain string) net.IP {
+	if r.resolve == nil {
+		return nil
+	}
+	ip, err := r.resolve(domain)
+	if err != nil {
+		l.Error("failed to resolve", domain, err)
+		return nil
+	}
+	return ip
+}
+
+// realIP return target's ip, resolve it by domain if unknown
+func (r *targetResolver) realIP(t *rule.Target) (net.IP, error) {
+	if t.IP == nil && t.Resolve != nil {
+		t.IP = t.Resolve(t.Domain)
+	}
+	if t.IP == nil {
+		return nil, fmt.Errorf("failed to resolve %s", t.Domain)
+	}
+	return t.IP, nil
+}
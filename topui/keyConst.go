@@ -14,4 +14,11 @@ const (
 	keySortByHost   = 'h'
 	keySortByPort   = 'p'
 	keyFilter       = '/'
+	keyKill         = 'x'
+
+	// views
+	keyViewHosts   = '1'
+	keyViewClients = '2'
+	keyViewConns   = '3'
+	keyViewDNS     = '4'
 )
@@ -52,7 +52,32 @@ func NewToolBar(top *Top, actions ...tview.Primitive) *ToolBar {
 	})
 	flex.AddItem(filterAction, filterAction.TextLen(), 0, false)
 
+	killAction := NewSelectAction("Kill", keyKill, false, false, nil)
+	killInput := tview.NewInputField().SetLabel("Kill(id or host):").SetFieldWidth(inputLength)
+	killInput.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter && killInput.GetText() != "" {
+			top.Kill(killInput.GetText())
+		}
+		if key == tcell.KeyEscape || key == tcell.KeyEnter {
+			flex.RemoveItem(killInput)
+			killInput.SetText("")
+			flex.AddItem(killAction, killAction.TextLen(), 0, false)
+			top.app.SetFocus(bar)
+			top.UnSuspend()
+			top.Refresh(false)
+		}
+	})
+	flex.AddItem(killAction, killAction.TextLen(), 0, false)
+
 	flex.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyEnter:
+			top.Enter()
+			return nil
+		case tcell.KeyEscape:
+			top.Back()
+			return nil
+		}
 		key := event.Rune()
 		if a, ok := m[key]; ok {
 			if s, ok := a.(*SelectAction); ok {
@@ -71,12 +96,26 @@ func NewToolBar(top *Top, actions ...tview.Primitive) *ToolBar {
 			flex.AddItem(filterInput, inputLength, 0, false)
 			top.app.SetFocus(filterInput)
 			top.Suspend()
+		} else if key == keyKill {
+			// input connection id or host to kill
+			killInput.SetText(top.killTarget())
+			flex.RemoveItem(killAction)
+			flex.AddItem(killInput, inputLength+len("Kill(id or host):"), 0, false)
+			top.app.SetFocus(killInput)
+			top.Suspend()
 		}
 		return event
 	})
 	return bar
 }
 
+// AddKeys handle keys of actions in g, which is placed out of toolbar
+func (t *ToolBar) AddKeys(g *SelectGroupAction) {
+	for _, k := range g.keys {
+		t.keyActionMap[k] = g
+	}
+}
+
 func (t *ToolBar) Draw(screen tcell.Screen) {
 	t.Flex.Draw(screen)
 }
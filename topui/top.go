@@ -7,12 +7,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"text/tabwriter"
 	"time"
 
+	"snet/dns"
 	"snet/stats"
 )
 
@@ -50,11 +53,22 @@ type Top struct {
 	app           *tview.Application
 	network       *tview.TextView
 	stats         *stats.StatsApiModel
+	view          rune
+	clients       []*stats.ClientInfo
+	clientRates   map[string]*rate
+	client        string // client ip drilled down in clients view
+	destinations  []*stats.HostTraffic
+	conns         []*stats.ConnInfo
+	queryLog      []dns.QueryLogEntry
+	cursor        int      // selected row in clients and connections view
+	rows          []string // client ip or connection id of rows drawn
 	suspend       bool
 	suspendAction *SelectAction
 	sortBy        rune
 	hostFilter    string
 	refreshLock   sync.Mutex
+	// result of last action, shown above stats
+	message string
 }
 
 func (t *Top) Suspend() {
@@ -74,6 +88,50 @@ func (t *Top) FilterHost(search string) {
 	t.hostFilter = search
 }
 
+// setMessage set result of last action, it's shown by next refresh
+func (t *Top) setMessage(message string) {
+	t.refreshLock.Lock()
+	t.message = message
+	t.refreshLock.Unlock()
+}
+
+// Kill close connection by id, or all connections to host through api, it's
+// called from ui event handlers, so the request is sent in background.
+func (t *Top) Kill(target string) {
+	go func() {
+		t.setMessage(t.kill(target))
+		t.reload()
+	}()
+}
+
+// kill send request of Kill, return message of the result
+func (t *Top) kill(target string) string {
+	api := t.addr + "/connections?host=" + url.QueryEscape(target)
+	if _, err := strconv.ParseUint(target, 10, 64); err == nil {
+		api = t.addr + "/connections/" + target
+	}
+	req, err := http.NewRequest(http.MethodDelete, api, nil)
+	if err != nil {
+		return "[red]" + err.Error() + "[white]"
+	}
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "[red]" + err.Error() + "[white]"
+	}
+	defer r.Body.Close()
+	body, _ := ioutil.ReadAll(r.Body)
+	switch r.StatusCode {
+	case http.StatusNoContent:
+		return "connection " + target + " closed"
+	case http.StatusOK:
+		var result struct{ Closed int }
+		json.Unmarshal(body, &result)
+		return fmt.Sprintf("%d connections to %s closed", result.Closed, target)
+	default:
+		return "[red]" + strings.TrimSpace(string(body)) + "[white]"
+	}
+}
+
 func NewTop(addr string) *Top {
 	t := new(Top)
 
@@ -105,11 +163,19 @@ func NewTop(addr string) *Top {
 		}),
 		t.suspendAction,
 		NewSelectAction("↓", keyDown, false, false, func() {
+			if t.selectable() {
+				t.moveCursor(1)
+				return
+			}
 			t.Suspend()
 			r, c := t.network.GetScrollOffset()
 			t.network.ScrollTo(r+1, c)
 		}),
 		NewSelectAction("↑", keyUp, false, false, func() {
+			if t.selectable() {
+				t.moveCursor(-1)
+				return
+			}
 			t.Suspend()
 			r, c := t.network.GetScrollOffset()
 			t.network.ScrollTo(r-1, c)
@@ -142,8 +208,17 @@ func NewTop(addr string) *Top {
 		),
 	)
 	t.sort(keySortByRxSize)
+	tabs := NewSelectGroupAction("View:",
+		NewSelectAction("Hosts", keyViewHosts, true, true, func() { t.switchView(keyViewHosts) }),
+		NewSelectAction("Clients", keyViewClients, true, false, func() { t.switchView(keyViewClients) }),
+		NewSelectAction("Connections", keyViewConns, true, false, func() { t.switchView(keyViewConns) }),
+		NewSelectAction("DNS", keyViewDNS, true, false, func() { t.switchView(keyViewDNS) }),
+	)
+	bar.AddKeys(tabs)
+	t.view = keyViewHosts
 
-	layout.AddItem(t.network, 0, 1, false).
+	layout.AddItem(tabs, 1, 0, false).
+		AddItem(t.network, 0, 1, false).
 		AddItem(bar, 2, 0, true)
 	t.app.SetRoot(layout, true)
 	return t
@@ -153,8 +228,94 @@ func (t *Top) sort(key rune) {
 	t.sortBy = key
 }
 
-func (t *Top) pullMetrics() error {
-	r, err := http.Get(t.addr + "/stats")
+// switchView show hosts, clients, connections or dns queries
+func (t *Top) switchView(view rune) {
+	t.refreshLock.Lock()
+	t.view = view
+	t.client = ""
+	t.cursor = 0
+	t.refreshLock.Unlock()
+	t.reload()
+}
+
+// reload pull data of current view and redraw, it's called from ui event
+// handlers, so it shouldn't block.
+func (t *Top) reload() {
+	go func() {
+		if err := t.pullMetrics(); err != nil {
+			t.setMessage("[red]" + err.Error() + "[white]")
+		}
+		t.Refresh(true)
+	}()
+}
+
+// selectable check whether rows of current view can be selected by cursor
+func (t *Top) selectable() bool {
+	return (t.view == keyViewClients && t.client == "") || t.view == keyViewConns
+}
+
+func (t *Top) moveCursor(n int) {
+	t.refreshLock.Lock()
+	t.cursor += n
+	if t.cursor >= len(t.rows) {
+		t.cursor = len(t.rows) - 1
+	}
+	if t.cursor < 0 {
+		t.cursor = 0
+	}
+	t.refreshLock.Unlock()
+	t.Refresh(false)
+}
+
+func (t *Top) selected() string {
+	t.refreshLock.Lock()
+	defer t.refreshLock.Unlock()
+	if !t.selectable() || t.cursor >= len(t.rows) {
+		return ""
+	}
+	return t.rows[t.cursor]
+}
+
+// Enter show destinations of selected client in clients view
+func (t *Top) Enter() {
+	if t.view != keyViewClients {
+		return
+	}
+	ip := t.selected()
+	if ip == "" {
+		return
+	}
+	t.refreshLock.Lock()
+	t.client = ip
+	t.destinations = nil
+	t.refreshLock.Unlock()
+	t.reload()
+}
+
+// Back return to client list from destinations of a client
+func (t *Top) Back() {
+	if t.view != keyViewClients || t.client == "" {
+		return
+	}
+	t.refreshLock.Lock()
+	t.client = ""
+	t.refreshLock.Unlock()
+	t.reload()
+}
+
+// killTarget is default input of kill, selected connection in connections
+// view, or host filter.
+func (t *Top) killTarget() string {
+	if t.view == keyViewConns {
+		if id := t.selected(); id != "" {
+			return id
+		}
+	}
+	return t.hostFilter
+}
+
+func (t *Top) get(path string, v interface{}) error {
+	r, err := http.Get(t.addr + path)
 	if err != nil {
 		return err
 	}
@@ -163,10 +324,55 @@ func (t *Top) pullMetrics() error {
 	if err != nil {
 		return err
 	}
-	t.stats = new(stats.StatsApiModel)
-	if err := json.Unmarshal(body, t.stats); err != nil {
+	return json.Unmarshal(body, v)
+}
+
+// pullMetrics pull stats and data of current view
+func (t *Top) pullMetrics() error {
+	result := new(stats.StatsApiModel)
+	if err := t.get("/stats", result); err != nil {
 		return err
 	}
+	t.refreshLock.Lock()
+	view, client := t.view, t.client
+	t.refreshLock.Unlock()
+	var err error
+	var clients []*stats.ClientInfo
+	var destinations []*stats.HostTraffic
+	var conns []*stats.ConnInfo
+	var queryLog []dns.QueryLogEntry
+	switch {
+	case view == keyViewClients && client != "":
+		err = t.get("/clients/"+url.PathEscape(client), &destinations)
+	case view == keyViewClients:
+		err = t.get("/clients", &clients)
+	case view == keyViewConns:
+		err = t.get("/connections", &conns)
+	case view == keyViewDNS:
+		err = t.get("/dns/log?n=500", &queryLog)
+	}
+	if err != nil {
+		return err
+	}
+
+	t.refreshLock.Lock()
+	defer t.refreshLock.Unlock()
+	t.stats = result
+	if view != t.view || client != t.client {
+		// view changed while pulling
+		return nil
+	}
+	switch {
+	case view == keyViewClients && client != "":
+		t.destinations = destinations
+	case view == keyViewClients:
+		t.clientRates = clientRates(clients, t.clientRates)
+		t.clients = clients
+	case view == keyViewConns:
+		t.conns = conns
+	case view == keyViewDNS:
+		t.queryLog = queryLog
+	}
 	return nil
 }
 
@@ -179,7 +385,25 @@ func (t *Top) Refresh(draw bool) {
 
 	r := t.stats
 	t.network.Clear()
-	fmt.Fprintf(t.network, "Uptime: %s, Rx Total: %s, Tx Total: %s\n\n", r.Uptime, hb(r.Total.RxSize), hb(r.Total.TxSize))
+	fmt.Fprintf(t.network, "Uptime: %s, Rx Total: %s, Tx Total: %s\n", r.Uptime, hb(r.Total.RxSize), hb(r.Total.TxSize))
+	fmt.Fprintln(t.network, t.message)
+	switch t.view {
+	case keyViewClients:
+		t.drawClients()
+	case keyViewConns:
+		t.drawConns()
+	case keyViewDNS:
+		t.drawQueryLog()
+	default:
+		t.drawHosts()
+	}
+	if draw {
+		t.app.Draw()
+	}
+}
+
+func (t *Top) drawHosts() {
+	r := t.stats
 	switch t.sortBy {
 	case keySortByTxRate:
 		sort.Slice(r.Hosts, func(i, j int) bool {
@@ -226,9 +450,193 @@ func (t *Top) Refresh(draw bool) {
 	}
 	w.Flush()
 	t.network.ScrollToBeginning()
-	if draw {
-		t.app.Draw()
+}
+
+// rate is traffic rate of a client, computed from sizes of two pulls
+type rate struct {
+	rx, tx         uint64
+	at             time.Time
+	rxRate, txRate float64
+}
+
+func clientRates(clients []*stats.ClientInfo, last map[string]*rate) map[string]*rate {
+	now := time.Now()
+	rates := make(map[string]*rate, len(clients))
+	for _, c := range clients {
+		r := &rate{rx: c.RxSize, tx: c.TxSize, at: now}
+		if l, ok := last[c.IP]; ok {
+			if d := now.Sub(l.at).Seconds(); d > 0 {
+				if c.RxSize >= l.rx {
+					r.rxRate = float64(c.RxSize-l.rx) / d
+				}
+				if c.TxSize >= l.tx {
+					r.txRate = float64(c.TxSize-l.tx) / d
+				}
+			}
+		}
+		rates[c.IP] = r
+	}
+	return rates
+}
+
+// cursorPrefix mark the selected row
+func (t *Top) cursorPrefix(i int) string {
+	if i == t.cursor {
+		return "> "
+	}
+	return "  "
+}
+
+// scrollToCursor keep selected row visible, header lines are above rows
+func (t *Top) scrollToCursor(header int) {
+	if t.cursor >= len(t.rows) {
+		t.cursor = len(t.rows) - 1
+	}
+	if t.cursor < 0 {
+		t.cursor = 0
+	}
+	_, _, _, h := t.network.GetInnerRect()
+	offset := 0
+	if row := header + t.cursor; h > 0 && row >= h {
+		offset = row - h + 1
+	}
+	t.network.ScrollTo(offset, 0)
+}
+
+func (t *Top) drawClients() {
+	if t.client != "" {
+		t.drawDestinations()
+		return
+	}
+	clients := t.clients
+	rates := t.clientRates
+	switch t.sortBy {
+	case keySortByTxRate:
+		sort.Slice(clients, func(i, j int) bool {
+			return rates[clients[i].IP].txRate > rates[clients[j].IP].txRate
+		})
+	case keySortByRxRate:
+		sort.Slice(clients, func(i, j int) bool {
+			return rates[clients[i].IP].rxRate > rates[clients[j].IP].rxRate
+		})
+	case keySortByTxSize:
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].TxSize > clients[j].TxSize
+		})
+	case keySortByHost:
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].IP > clients[j].IP
+		})
+	default:
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].RxSize > clients[j].RxSize
+		})
+	}
+	w := tabwriter.NewWriter(t.network, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "  Client\tActive\tTotal\tRX\tTX\tRX rate\tTX rate\t")
+	t.rows = t.rows[:0]
+	for _, c := range clients {
+		if t.hostFilter != "" && !strings.Contains(c.IP, t.hostFilter) {
+			continue
+		}
+		var rxRate, txRate float64
+		if r, ok := rates[c.IP]; ok {
+			rxRate, txRate = r.rxRate, r.txRate
+		}
+		fmt.Fprintf(w, "%s%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n",
+			t.cursorPrefix(len(t.rows)), c.IP, c.ActiveConns, c.TotalConns, hb(c.RxSize), hb(c.TxSize),
+			hb(uint64(rxRate))+"/s", hb(uint64(txRate))+"/s")
+		t.rows = append(t.rows, c.IP)
+	}
+	w.Flush()
+	t.scrollToCursor(3)
+}
+
+func (t *Top) drawDestinations() {
+	dests := t.destinations
+	switch t.sortBy {
+	case keySortByTxSize, keySortByTxRate:
+		sort.Slice(dests, func(i, j int) bool {
+			return dests[i].TxSize > dests[j].TxSize
+		})
+	case keySortByHost:
+		sort.Slice(dests, func(i, j int) bool {
+			return dests[i].Host > dests[j].Host
+		})
+	default:
+		sort.Slice(dests, func(i, j int) bool {
+			return dests[i].RxSize > dests[j].RxSize
+		})
 	}
+	fmt.Fprintf(t.network, "Client: [yellow]%s[white] (Esc to go back)\n", t.client)
+	w := tabwriter.NewWriter(t.network, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Host\tActive\tTotal\tRX\tTX\t")
+	for _, d := range dests {
+		host := d.Host
+		if t.hostFilter != "" {
+			if !strings.Contains(host, t.hostFilter) {
+				continue
+			}
+			host = highlight(host, t.hostFilter)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t\n", host, d.ActiveConns, d.TotalConns, hb(d.RxSize), hb(d.TxSize))
+	}
+	w.Flush()
+	t.network.ScrollToBeginning()
+}
+
+func (t *Top) drawConns() {
+	conns := t.conns
+	switch t.sortBy {
+	case keySortByTxSize, keySortByTxRate:
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].TxSize > conns[j].TxSize
+		})
+	case keySortByRxSize, keySortByRxRate:
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].RxSize > conns[j].RxSize
+		})
+	case keySortByHost:
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].Host > conns[j].Host
+		})
+	default:
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].ID < conns[j].ID
+		})
+	}
+	w := tabwriter.NewWriter(t.network, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  ID\tSource\tDestination\tHost\tUpstream\tDuration\tRX\tTX\t")
+	t.rows = t.rows[:0]
+	for _, c := range conns {
+		if t.hostFilter != "" && !strings.Contains(c.Host, t.hostFilter) &&
+			!strings.Contains(c.Src, t.hostFilter) && !strings.Contains(c.Dst, t.hostFilter) {
+			continue
+		}
+		id := strconv.FormatUint(c.ID, 10)
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			t.cursorPrefix(len(t.rows)), id, c.Src, c.Dst, c.Host, c.Upstream, c.Duration, hb(c.RxSize), hb(c.TxSize))
+		t.rows = append(t.rows, id)
+	}
+	w.Flush()
+	t.scrollToCursor(3)
+}
+
+func (t *Top) drawQueryLog() {
+	w := tabwriter.NewWriter(t.network, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Time\tClient\tDomain\tResult\t")
+	for _, e := range t.queryLog {
+		domain := e.Domain
+		if t.hostFilter != "" {
+			if !strings.Contains(domain, t.hostFilter) && !strings.Contains(e.Src, t.hostFilter) {
+				continue
+			}
+			domain = highlight(domain, t.hostFilter)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", e.Time.Format("15:04:05"), e.Src, domain, e.Reason)
+	}
+	w.Flush()
+	t.network.ScrollToBeginning()
 }
 
 func (t *Top) Run() {
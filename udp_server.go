@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"snet/config"
+	"snet/proxy"
+	"snet/ratelimit"
+	"snet/redirector"
+	"snet/rule"
+	"snet/stats"
+)
+
+const (
+	udpBufSize = 64 * 1024
+	udpOOBSize = 1024
+	// packets queued while session is dialing, later ones are dropped
+	maxPendingPackets = 16
+)
+
+// udpSession is a NAT entry for a single client -> original destination flow.
+// It's added before dialing, so dialing doesn't block other flows, packets
+// received meanwhile are queued.
+type udpSession struct {
+	remote  net.Conn     // conn to target through proxy
+	reply   *net.UDPConn // conn to client, bind on original destination address
+	lock    sync.Mutex
+	ready   bool
+	closed  bool
+	pending [][]byte
+	untrack func() // remove session from connection table
+	cancel  func() // stop waiting of rate limits
+}
+
+func (s *udpSession) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.pending = nil
+	if s.remote != nil {
+		s.remote.Close()
+	}
+	if s.reply != nil {
+		s.reply.Close()
+	}
+	if s.untrack != nil {
+		s.untrack()
+		s.untrack = nil
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// queue a copy of packet if session is not ready, false is returned if it's
+// ready, data is read buffer of listener and reused after that.
+func (s *udpSession) queue(data []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ready {
+		return false
+	}
+	if len(s.pending) < maxPendingPackets {
+		s.pending = append(s.pending, append([]byte(nil), data...))
+	}
+	return true
+}
+
+type UDPServer struct {
+	ctx       context.Context
+	cfg       *config.Config
+	listeners []*net.UDPConn
+	proxies   map[string]proxy.Proxy
+	defProxy  string
+	rules     *rule.Rules
+	targets   *targetResolver
+	conns     *stats.ConnTable // track sessions if set
+	limiter   *ratelimit.Limiter
+	timeout   time.Duration
+	sessions  map[string]*udpSession
+	lock      sync.Mutex
+}
+
+func NewUDPServer(ctx context.Context, c *config.Config, proxies map[string]proxy.Proxy, defaultProxy string, rules *rule.Rules) (*UDPServer, error) {
+	if _, ok := proxies[defaultProxy].(proxy.UDPProxy); !ok {
+		return nil, errors.New("udp relay is not supported by proxy " + defaultProxy)
+	}
+	var listeners []*net.UDPConn
+	for _, host := range c.ListenHosts() {
+		ln, err := redirector.ListenTProxyUDP(net.JoinHostPort(host, strconv.Itoa(c.LPort)))
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return &UDPServer{
+		ctx:       ctx,
+		cfg:       c,
+		listeners: listeners,
+		proxies:   proxies,
+		defProxy:  defaultProxy,
+		rules:     rules,
+		timeout:   time.Duration(c.UDPTimeout) * time.Second,
+		sessions:  make(map[string]*udpSession),
+	}, nil
+}
+
+func (s *UDPServer) Run() error {
+	errCh := make(chan error, len(s.listeners))
+	for _, ln := range s.listeners {
+		go func(ln *net.UDPConn) {
+			errCh <- s.serve(ln)
+		}(ln)
+	}
+	return <-errCh
+}
+
+func (s *UDPServer) serve(ln *net.UDPConn) error {
+	l.Info("Proxy server listen on udp", ln.LocalAddr())
+	b := make([]byte, udpBufSize)
+	oob := make([]byte, udpOOBSize)
+	for {
+		n, src, dst, err := redirector.ReadFromUDPWithDst(ln, b, oob)
+		if err != nil {
+			if isClosedConnError(err) {
+				return err
+			}
+			// error of a single packet, eg: original destination is missing
+			l.Error(err)
+			continue
+		}
+		if err := s.handle(src, dst, b[:n]); err != nil {
+			l.Error(err)
+		}
+	}
+}
+
+// isClosedConnError check whether err is caused by reading closed listener
+func isClosedConnError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
+
+func (s *UDPServer) handle(src, dst *net.UDPAddr, data []byte) error {
+	if dst.IP.IsLoopback() {
+		return errors.New("drop udp packet to localhost")
+	}
+	key := src.String() + "->" + dst.String()
+	s.lock.Lock()
+	sess, ok := s.sessions[key]
+	if !ok {
+		sess = new(udpSession)
+		s.sessions[key] = sess
+		go s.connect(key, sess, src, dst)
+	}
+	s.lock.Unlock()
+	if sess.queue(data) {
+		return nil
+	}
+	return s.send(sess, data)
+}
+
+func (s *UDPServer) send(sess *udpSession, data []byte) error {
+	// client is still active, extend session's idle timeout
+	if err := sess.remote.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+		return err
+	}
+	_, err := sess.remote.Write(data)
+	return err
+}
+
+// connect dial remote and reply conn of session, then send queued packets.
+// Session is removed if it fails, so next packet will retry.
+func (s *UDPServer) connect(key string, sess *udpSession, src, dst *net.UDPAddr) {
+	t, err := s.targets.target(dst.IP, dst.Port, src.IP)
+	if err != nil {
+		l.Error(err)
+		s.removeSession(key, sess)
+		return
+	}
+	remote, upstream, err := s.dial(t, dst)
+	if err != nil {
+		l.Error(err)
+		s.removeSession(key, sess)
+		return
+	}
+	reply, err := redirector.DialUDPFrom(dst, src)
+	if err != nil {
+		l.Error(err)
+		remote.Close()
+		s.removeSession(key, sess)
+		return
+	}
+	var untrack func()
+	if s.conns != nil {
+		// traffic is counted in stats and history like tcp connections
+		c := s.conns.Add(src.String(), dst.String(), t.Domain, upstream, func() { s.removeSession(key, sess) })
+		untrack = func() { s.conns.Remove(c.ID) }
+		remote = c.Wrap(remote)
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	remote = s.limiter.Wrap(ctx, remote, t)
+	sess.lock.Lock()
+	if sess.closed {
+		// removed by shutdown
+		sess.lock.Unlock()
+		cancel()
+		remote.Close()
+		reply.Close()
+		if untrack != nil {
+			untrack()
+		}
+		return
+	}
+	sess.remote, sess.reply, sess.untrack, sess.cancel = remote, reply, untrack, cancel
+	sess.lock.Unlock()
+	go s.relayReply(key, sess)
+	// session is ready only after queue is empty, packets received while
+	// flushing are queued, so the flow is sent in order
+	for {
+		sess.lock.Lock()
+		pending := sess.pending
+		sess.pending = nil
+		if len(pending) == 0 {
+			sess.ready = true
+			sess.lock.Unlock()
+			return
+		}
+		sess.lock.Unlock()
+		for _, data := range pending {
+			if err := s.send(sess, data); err != nil {
+				l.Error(err)
+				break
+			}
+		}
+	}
+}
+
+// dial remote of target t by matched rule, upstream is direct or name of
+// the proxy.
+func (s *UDPServer) dial(t *rule.Target, dst *net.UDPAddr) (conn net.Conn, upstream string, err error) {
+	host := t.Domain
+	if host == "" {
+		host = dst.IP.String()
+	}
+	action := rule.Action{Type: rule.ActionProxy}
+	if r := s.rules.Match(t); r != nil {
+		action = r.Action
+	}
+	if action.Type == rule.ActionProxy {
+		if a, ok := s.limiter.OverQuota(t.SrcIP); ok {
+			l.Debug("client", t.SrcIP, "is over quota, udp to", host, dst.Port, "is", a)
+			action = a
+		}
+	}
+	switch action.Type {
+	case rule.ActionReject:
+		return nil, "", errors.New("udp packet to " + dst.String() + " rejected")
+	case rule.ActionDirect:
+		ip, err := s.targets.realIP(t)
+		if err != nil {
+			return nil, "", err
+		}
+		conn, err = redirector.DialDirect("udp", ip.String(), dst.Port, s.timeout)
+		return conn, upstreamDirect, err
+	}
+	upstream = action.Proxy
+	if upstream == "" {
+		upstream = s.defProxy
+	}
+	up, ok := s.proxies[upstream].(proxy.UDPProxy)
+	if !ok {
+		return nil, "", errors.New("udp relay is not supported by proxy " + upstream)
+	}
+	conn, err = up.DialUDP(host, dst.Port)
+	return conn, upstream, err
+}
+
+// relayReply copy datagrams from remote to client until session is idle for timeout.
+func (s *UDPServer) relayReply(key string, sess *udpSession) {
+	defer s.removeSession(key, sess)
+	b := make([]byte, udpBufSize)
+	for {
+		n, err := sess.remote.Read(b)
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				l.Debug("udp session", key, "closed:", err)
+			}
+			return
+		}
+		if _, err := sess.reply.Write(b[:n]); err != nil {
+			l.Error(err)
+			return
+		}
+		if err := sess.remote.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+			return
+		}
+	}
+}
+
+// removeSession close sess and remove it if it's still the session of key
+func (s *UDPServer) removeSession(key string, sess *udpSession) {
+	s.lock.Lock()
+	if s.sessions[key] == sess {
+		delete(s.sessions, key)
+	}
+	s.lock.Unlock()
+	sess.Close()
+}
+
+func (s *UDPServer) Shutdown() error {
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil {
+			return err
+		}
+	}
+	s.lock.Lock()
+	for key, sess := range s.sessions {
+		sess.Close()
+		delete(s.sessions, key)
+	}
+	s.lock.Unlock()
+	l.Info("redirector udp server shutdown")
+	return nil
+}
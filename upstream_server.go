@@ -5,8 +5,8 @@ import (
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
 	"time"
 
 	"snet/config"
@@ -66,7 +66,7 @@ func runTLSServer(c *config.Config) {
 				return
 			}
 			port := int(binary.BigEndian.Uint16(b))
-			dstConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+			dstConn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 			if err != nil {
 				l.Error(err)
 				return
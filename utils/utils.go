@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	exec "os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -43,6 +46,28 @@ func DomainMatch(domain string, patterns []string) bool {
 	return false
 }
 
+// IPNetwork append ip version to network by host's family, eg: tcp -> tcp6,
+// so listening on 0.0.0.0 and :: at the same time won't conflict.
+func IPNetwork(network, host string) string {
+	if strings.Contains(host, ":") {
+		return network + "6"
+	}
+	return network + "4"
+}
+
+// SplitHostPort split addr into host and numeric port
+func SplitHostPort(addr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
 func NamedFmt(msg string, args map[string]interface{}) (string, error) {
 	var result bytes.Buffer
 	tpl, err := template.New("fmt").Parse(msg)
@@ -55,13 +80,52 @@ func NamedFmt(msg string, args map[string]interface{}) (string, error) {
 	return result.String(), nil
 }
 
+// WriteFileAtomic write file by write and replace filename with it, file and
+// its directory are synced, so filename is either old or complete new one
+// even if power is lost.
+func WriteFileAtomic(filename string, perm os.FileMode, write func(w io.Writer) error) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 func Pipe(ctx context.Context, src, remote net.Conn, timeout time.Duration, rxCh, txCh chan *stats.P, dstHost string, dstPort int, sn *sniffer.Sniffer) error {
 	count := 2
 	doneCh := make(chan bool, count)
 	errCh := make(chan error, count)
 	const toRemote = 1
 	const toLocal = 0
-	p := &stats.P{Host: fmt.Sprintf("%s:%d", dstHost, dstPort)}
+	p := &stats.P{Host: net.JoinHostPort(dstHost, strconv.Itoa(dstPort))}
 	// server name sniffer
 	if sn != nil {
 		var serverName string
@@ -75,7 +139,10 @@ func Pipe(ctx context.Context, src, remote net.Conn, timeout time.Duration, rxCh
 		if err != nil {
 			fmt.Println(err)
 		} else if serverName != "" {
-			p.Host = fmt.Sprintf("%s:%d", serverName, dstPort)
+			p.Host = net.JoinHostPort(serverName, strconv.Itoa(dstPort))
+			if sn.Found != nil {
+				sn.Found(serverName)
+			}
 		}
 		if buf != nil {
 			n, err := remote.Write(buf)
@@ -1,6 +1,11 @@
 package utils
 
 import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -17,3 +22,39 @@ func TestDomainMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "file")
+	write := func(data string) func(w io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, data)
+			return err
+		}
+	}
+	if err := WriteFileAtomic(path, 0600, write("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, 0600, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("failed")
+	}); err == nil {
+		t.Error("error of write should be returned")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "old" {
+		t.Error("file should not be replaced on failure", string(data))
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("tmp file should be removed", err)
+	}
+	if err := WriteFileAtomic(path, 0600, write("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "new" {
+		t.Error("unexpected content", string(data))
+	}
+}